@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	errHoldNotFound  = errors.New("hold not found")
+	errInvalidStatus = errors.New("invalid account status")
+)
+
+// adminOperators maps backoffice API tokens to operator names. It is
+// loaded from ADMIN_API_TOKENS as comma separated "<operator>:<token>" pairs.
+var adminOperators map[string]string
+
+// AdminAuditLog records every operator action taken through the admin API.
+type AdminAuditLog struct {
+	ID            uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Operator      string    `json:"operator" gorm:"index"`
+	Action        string    `json:"action"`
+	AccountID     uuid.UUID `json:"account_id" gorm:"type:uuid;index"`
+	Justification string    `json:"justification"`
+	Details       string    `json:"details" gorm:"type:jsonb"`
+	ClientIP      string    `json:"client_ip"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type TimelineEvent struct {
+	Type string      `json:"type"`
+	At   time.Time   `json:"at"`
+	Data interface{} `json:"data"`
+}
+
+func loadAdminOperators(spec string) map[string]string {
+	operators := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			operators[parts[1]] = parts[0]
+		}
+	}
+	return operators
+}
+
+// requireOperator authenticates backoffice staff. The admin API uses its own
+// tokens and never accepts customer JWTs.
+func requireOperator(c *gin.Context) {
+	token := c.GetHeader("X-Admin-Token")
+	for candidate, operator := range adminOperators {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			c.Set("operator", operator)
+			c.Next()
+			return
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+}
+
+func recordAdminAction(tx *gorm.DB, c *gin.Context, action string, accountID uuid.UUID, justification string, details interface{}) error {
+	payload, _ := json.Marshal(details)
+	return tx.Create(&AdminAuditLog{
+		ID:            uuid.New(),
+		Operator:      c.GetString("operator"),
+		Action:        action,
+		AccountID:     accountID,
+		Justification: justification,
+		Details:       string(payload),
+		ClientIP:      c.ClientIP(),
+		CreatedAt:     time.Now(),
+	}).Error
+}
+
+func adminSearchAccounts(c *gin.Context) {
+	query := db.Model(&Account{})
+
+	if v := c.Query("account_number"); v != "" {
+		query = query.Where("account_number = ?", v)
+	}
+	if v := c.Query("document"); v != "" {
+		query = query.Where("holder_document = ?", v)
+	}
+	if v := c.Query("name"); v != "" {
+		query = query.Where("holder_name ILIKE ?", "%"+v+"%")
+	}
+	if v := c.Query("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+	if v := c.Query("min_balance"); v != "" {
+		min, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_balance"})
+			return
+		}
+		query = query.Where("balance >= ?", min)
+	}
+	if v := c.Query("max_balance"); v != "" {
+		max, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_balance"})
+			return
+		}
+		query = query.Where("balance <= ?", max)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if pageSize < 1 || pageSize > 200 {
+		pageSize = 50
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var accounts []Account
+	query.Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&accounts)
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts":  accounts,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+func adminGetAccount(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var account Account
+	if err := db.First(&account, accountID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+
+	var holds []AccountHold
+	db.Where("account_id = ? AND status = ?", accountID, "active").Find(&holds)
+
+	c.JSON(http.StatusOK, gin.H{
+		"account":           account,
+		"available_balance": availableBalance(db, &account),
+		"active_holds":      holds,
+	})
+}
+
+func adminAccountTimeline(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	limit := 200
+
+	var transactions []Transaction
+	db.Where("from_account_id = ? OR to_account_id = ?", accountID, accountID).
+		Order("created_at DESC").Limit(limit).Find(&transactions)
+
+	var holds []AccountHold
+	db.Where("account_id = ?", accountID).Order("created_at DESC").Limit(limit).Find(&holds)
+
+	var changes []AccountStatusChange
+	db.Where("account_id = ?", accountID).Order("created_at DESC").Limit(limit).Find(&changes)
+
+	var actions []AdminAuditLog
+	db.Where("account_id = ?", accountID).Order("created_at DESC").Limit(limit).Find(&actions)
+
+	events := make([]TimelineEvent, 0, len(transactions)+len(holds)+len(changes)+len(actions))
+	for _, t := range transactions {
+		events = append(events, TimelineEvent{Type: "transaction", At: t.CreatedAt, Data: t})
+	}
+	for _, h := range holds {
+		events = append(events, TimelineEvent{Type: "hold", At: h.CreatedAt, Data: h})
+		if h.ReleasedAt != nil {
+			events = append(events, TimelineEvent{Type: "hold_released", At: *h.ReleasedAt, Data: h})
+		}
+	}
+	for _, s := range changes {
+		events = append(events, TimelineEvent{Type: "status_change", At: s.CreatedAt, Data: s})
+	}
+	for _, a := range actions {
+		events = append(events, TimelineEvent{Type: "operator_action", At: a.CreatedAt, Data: a})
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].At.After(events[j].At) })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"events":     events,
+	})
+}
+
+type justificationRequest struct {
+	Justification string `json:"justification" binding:"required,min=10"`
+}
+
+func adminFreezeAccount(c *gin.Context) {
+	adminSetStatus(c, "active", "frozen", "freeze")
+}
+
+func adminUnfreezeAccount(c *gin.Context) {
+	adminSetStatus(c, "frozen", "active", "unfreeze")
+}
+
+func adminSetStatus(c *gin.Context, from, to, action string) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req justificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var account Account
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if account.Status != from {
+			return errInvalidStatus
+		}
+
+		if err := changeAccountStatus(tx, &account, to, c.GetString("operator"), req.Justification); err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, action, accountID, req.Justification, gin.H{"from": from, "to": to})
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	case errInvalidStatus:
+		c.JSON(http.StatusConflict, gin.H{"error": "Account must be " + from + " to " + action, "status": account.Status})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account": account,
+		"message": "Account " + account.Status,
+	})
+}
+
+func adminAdjustBalance(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req struct {
+		justificationRequest
+		Amount int64 `json:"amount" binding:"required,ne=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var account Account
+	var transaction Transaction
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if req.Amount < 0 && availableBalance(tx, &account) < -req.Amount {
+			return errInsufficientBalance
+		}
+
+		account.Balance += req.Amount
+		account.UpdatedAt = now
+		if err := tx.Save(&account).Error; err != nil {
+			return err
+		}
+
+		transaction = Transaction{
+			ID:          uuid.New(),
+			Currency:    account.Currency,
+			Type:        "manual_adjustment",
+			Status:      "completed",
+			Description: req.Justification,
+			CreatedAt:   now,
+		}
+		if req.Amount > 0 {
+			transaction.ToAccountID = accountID
+			transaction.Amount = req.Amount
+		} else {
+			transaction.FromAccountID = accountID
+			transaction.Amount = -req.Amount
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+
+		return recordAdminAction(tx, c, "adjustment", accountID, req.Justification, gin.H{
+			"amount":         req.Amount,
+			"transaction_id": transaction.ID,
+		})
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	case errInsufficientBalance:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient available balance"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to adjust balance"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account":     account,
+		"transaction": transaction,
+		"message":     "Manual adjustment posted",
+	})
+}
+
+func adminPlaceHold(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req struct {
+		justificationRequest
+		Amount    int64      `json:"amount" binding:"required,gt=0"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hold := AccountHold{
+		ID:        uuid.New(),
+		AccountID: accountID,
+		Amount:    req.Amount,
+		Source:    "operator",
+		Reference: c.GetString("operator"),
+		Reason:    req.Justification,
+		Status:    "active",
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&Account{}, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if err := tx.Create(&hold).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, "place_hold", accountID, req.Justification, gin.H{
+			"hold_id": hold.ID,
+			"amount":  hold.Amount,
+		})
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to place hold"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"hold":    hold,
+		"message": "Hold placed",
+	})
+}
+
+func adminReleaseHold(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+	holdID, err := uuid.Parse(c.Param("hold_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+		return
+	}
+
+	var req justificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var hold AccountHold
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("account_id = ? AND status = ?", accountID, "active").First(&hold, holdID).Error; err != nil {
+			return errHoldNotFound
+		}
+
+		now := time.Now()
+		hold.Status = "released"
+		hold.ReleasedAt = &now
+		if err := tx.Save(&hold).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, "release_hold", accountID, req.Justification, gin.H{
+			"hold_id": hold.ID,
+			"amount":  hold.Amount,
+		})
+	})
+
+	switch err {
+	case nil:
+	case errHoldNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Active hold not found"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release hold"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"hold":    hold,
+		"message": "Hold released",
+	})
+}
+
+func adminAuditLog(c *gin.Context) {
+	query := db.Model(&AdminAuditLog{})
+	if v := c.Query("account_id"); v != "" {
+		accountID, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+			return
+		}
+		query = query.Where("account_id = ?", accountID)
+	}
+	if v := c.Query("operator"); v != "" {
+		query = query.Where("operator = ?", v)
+	}
+
+	var entries []AdminAuditLog
+	query.Order("created_at DESC").Limit(200).Find(&entries)
+
+	c.JSON(http.StatusOK, entries)
+}
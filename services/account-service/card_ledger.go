@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The endpoints below let other services reserve and move account funds.
+// Both are idempotent so callers can retry after a timeout without knowing
+// whether the first attempt landed.
+
+// setHold sets the amount of the hold identified by source and reference,
+// placing it on first use. Increases need available balance; decreasing to
+// zero releases the hold.
+func setHold(c *gin.Context) {
+	var req struct {
+		AccountID string     `json:"account_id" binding:"required"`
+		Source    string     `json:"source" binding:"required"`
+		Reference string     `json:"reference" binding:"required"`
+		Amount    int64      `json:"amount" binding:"gte=0"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accountID, err := uuid.Parse(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var hold AccountHold
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+
+		now := time.Now()
+		err := tx.Where("account_id = ? AND source = ? AND reference = ?", accountID, req.Source, req.Reference).
+			First(&hold).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if req.Amount == 0 {
+				return nil
+			}
+			hold = AccountHold{
+				ID:        uuid.New(),
+				AccountID: accountID,
+				Source:    req.Source,
+				Reference: req.Reference,
+				Status:    "active",
+				CreatedAt: now,
+			}
+		} else if err != nil {
+			return err
+		}
+
+		current := int64(0)
+		if hold.Status == "active" {
+			current = hold.Amount
+		}
+		if req.Amount > current {
+			if account.Status != "active" {
+				return errAccountNotActive
+			}
+			if availableBalance(tx, &account) < req.Amount-current {
+				return errInsufficientBalance
+			}
+		}
+
+		hold.Amount = req.Amount
+		hold.ExpiresAt = req.ExpiresAt
+		if req.Amount == 0 {
+			hold.Status = "released"
+			hold.ReleasedAt = &now
+		} else {
+			hold.Status = "active"
+			hold.ReleasedAt = nil
+		}
+		return tx.Save(&hold).Error
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	case errAccountNotActive:
+		c.JSON(http.StatusConflict, gin.H{"error": "Account is not active"})
+		return
+	case errInsufficientBalance:
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient balance"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set hold"})
+		return
+	}
+
+	c.JSON(http.StatusOK, hold)
+}
+
+// postDebit debits an account for funds that were already reserved, such
+// as a card capture. The caller's ID becomes the transaction ID, which is
+// what makes retries safe. Debits are posted even if they overdraw the
+// account, since the obligation already exists.
+func postDebit(c *gin.Context) {
+	postCardEntry(c, false)
+}
+
+// postCredit credits an account, such as for a card refund, with the same
+// idempotency as postDebit.
+func postCredit(c *gin.Context) {
+	postCardEntry(c, true)
+}
+
+func postCardEntry(c *gin.Context, credit bool) {
+	var req struct {
+		ID          string `json:"id" binding:"required"`
+		AccountID   string `json:"account_id" binding:"required"`
+		Amount      int64  `json:"amount" binding:"required,gt=0"`
+		Type        string `json:"type" binding:"required"`
+		Description string `json:"description"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transactionID, err := uuid.Parse(req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+	accountID, err := uuid.Parse(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var transaction Transaction
+	created := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+
+		if err := tx.Where("id = ?", transactionID).First(&transaction).Error; err == nil {
+			return nil
+		}
+
+		now := time.Now()
+		transaction = Transaction{
+			ID:          transactionID,
+			Amount:      req.Amount,
+			Currency:    account.Currency,
+			Type:        req.Type,
+			Status:      "completed",
+			Description: req.Description,
+			CreatedAt:   now,
+		}
+		if credit {
+			account.Balance += req.Amount
+			transaction.ToAccountID = account.ID
+		} else {
+			account.Balance -= req.Amount
+			transaction.FromAccountID = account.ID
+		}
+		account.UpdatedAt = now
+		if err := tx.Save(&account).Error; err != nil {
+			return err
+		}
+
+		created = true
+		return tx.Create(&transaction).Error
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post entry"})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, transaction)
+}
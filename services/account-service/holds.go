@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AccountHold reserves part of an account balance. Active holds are not
+// debited from Balance but reduce the amount available for withdrawals and
+// outgoing transfers until they are released or expire.
+type AccountHold struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	AccountID  uuid.UUID  `json:"account_id" gorm:"type:uuid;index"`
+	Amount     int64      `json:"amount"`
+	Source     string     `json:"source"`
+	Reference  string     `json:"reference" gorm:"index"`
+	Reason     string     `json:"reason"`
+	Status     string     `json:"status"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	ReleasedAt *time.Time `json:"released_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// AccountStatusChange records every transition of Account.Status.
+type AccountStatusChange struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	AccountID  uuid.UUID `json:"account_id" gorm:"type:uuid;index"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  string    `json:"changed_by"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func heldAmount(tx *gorm.DB, accountID uuid.UUID) int64 {
+	var held int64
+	tx.Model(&AccountHold{}).
+		Where("account_id = ? AND status = ? AND (expires_at IS NULL OR expires_at > ?)", accountID, "active", time.Now()).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&held)
+	return held
+}
+
+func availableBalance(tx *gorm.DB, account *Account) int64 {
+	return account.Balance - heldAmount(tx, account.ID)
+}
+
+func changeAccountStatus(tx *gorm.DB, account *Account, status, changedBy, reason string) error {
+	change := AccountStatusChange{
+		ID:         uuid.New(),
+		AccountID:  account.ID,
+		FromStatus: account.Status,
+		ToStatus:   status,
+		ChangedBy:  changedBy,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	}
+
+	account.Status = status
+	account.UpdatedAt = change.CreatedAt
+	if err := tx.Save(account).Error; err != nil {
+		return err
+	}
+	return tx.Create(&change).Error
+}
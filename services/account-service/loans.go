@@ -0,0 +1,751 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	amortizationSAC   = "sac"
+	amortizationPrice = "price"
+
+	loanTaxOperation = "credit_pf"
+)
+
+var (
+	errAccountNotFound     = errors.New("account not found")
+	errAccountNotActive    = errors.New("account is not active")
+	errLoanNotFound        = errors.New("loan not found")
+	errInsufficientBalance = errors.New("insufficient balance")
+)
+
+type LoanProduct struct {
+	ID               uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Name             string    `json:"name"`
+	MonthlyRate      float64   `json:"monthly_rate"`
+	MinAmount        int64     `json:"min_amount"`
+	MaxAmount        int64     `json:"max_amount"`
+	MinTerm          int       `json:"min_term"`
+	MaxTerm          int       `json:"max_term"`
+	LateFeeRate      float64   `json:"late_fee_rate"`
+	LateInterestRate float64   `json:"late_interest_rate"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type Loan struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	AccountID   uuid.UUID `json:"account_id" gorm:"type:uuid;index"`
+	ProductID   uuid.UUID `json:"product_id" gorm:"type:uuid;index"`
+	Principal   int64     `json:"principal"`
+	IOF         int64     `json:"iof"`
+	NetAmount   int64     `json:"net_amount"`
+	MonthlyRate float64   `json:"monthly_rate"`
+	Term        int       `json:"term"`
+	Method      string    `json:"method"`
+	CETMonthly  float64   `json:"cet_monthly"`
+	CETAnnual   float64   `json:"cet_annual"`
+	Status      string    `json:"status"`
+	DisbursedAt time.Time `json:"disbursed_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type LoanInstallment struct {
+	ID           uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	LoanID       uuid.UUID  `json:"loan_id" gorm:"type:uuid;index"`
+	Number       int        `json:"number"`
+	DueDate      time.Time  `json:"due_date" gorm:"index"`
+	Principal    int64      `json:"principal"`
+	Interest     int64      `json:"interest"`
+	Amount       int64      `json:"amount"`
+	Balance      int64      `json:"balance"`
+	LateFee      int64      `json:"late_fee"`
+	LateInterest int64      `json:"late_interest"`
+	PaidAmount   int64      `json:"paid_amount"`
+	Status       string     `json:"status"`
+	PaidAt       *time.Time `json:"paid_at"`
+}
+
+type LoanSimulation struct {
+	Method        string            `json:"method"`
+	Principal     int64             `json:"principal"`
+	IOF           int64             `json:"iof"`
+	NetAmount     int64             `json:"net_amount"`
+	TotalPayable  int64             `json:"total_payable"`
+	TotalInterest int64             `json:"total_interest"`
+	MonthlyRate   float64           `json:"monthly_rate"`
+	CETMonthly    float64           `json:"cet_monthly"`
+	CETAnnual     float64           `json:"cet_annual"`
+	Taxes         TaxBreakdown      `json:"taxes"`
+	Installments  []LoanInstallment `json:"installments"`
+}
+
+func createLoanProduct(c *gin.Context) {
+	var req struct {
+		Name             string  `json:"name" binding:"required"`
+		MonthlyRate      float64 `json:"monthly_rate" binding:"required,gt=0,lt=1"`
+		MinAmount        int64   `json:"min_amount" binding:"required,gt=0"`
+		MaxAmount        int64   `json:"max_amount" binding:"required,gtefield=MinAmount"`
+		MinTerm          int     `json:"min_term" binding:"required,gt=0"`
+		MaxTerm          int     `json:"max_term" binding:"required,gtefield=MinTerm"`
+		LateFeeRate      float64 `json:"late_fee_rate" binding:"gte=0,lt=1"`
+		LateInterestRate float64 `json:"late_interest_rate" binding:"gte=0,lt=1"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product := LoanProduct{
+		ID:               uuid.New(),
+		Name:             req.Name,
+		MonthlyRate:      req.MonthlyRate,
+		MinAmount:        req.MinAmount,
+		MaxAmount:        req.MaxAmount,
+		MinTerm:          req.MinTerm,
+		MaxTerm:          req.MaxTerm,
+		LateFeeRate:      req.LateFeeRate,
+		LateInterestRate: req.LateInterestRate,
+		Status:           "active",
+		CreatedAt:        time.Now(),
+	}
+
+	if err := db.Create(&product).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create loan product"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, product)
+}
+
+func getLoanProducts(c *gin.Context) {
+	var products []LoanProduct
+	db.Where("status = ?", "active").Order("name").Find(&products)
+
+	c.JSON(http.StatusOK, products)
+}
+
+type loanRequest struct {
+	ProductID    string    `json:"product_id" binding:"required"`
+	Amount       int64     `json:"amount" binding:"required,gt=0"`
+	Term         int       `json:"term" binding:"required,gt=0"`
+	Method       string    `json:"method"`
+	FirstDueDate time.Time `json:"first_due_date"`
+}
+
+// loadLoanProduct resolves the product of a loan request and checks the
+// requested amount and term against it.
+func loadLoanProduct(req loanRequest) (*LoanProduct, int, string) {
+	productID, err := uuid.Parse(req.ProductID)
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid product ID"
+	}
+
+	var product LoanProduct
+	if err := db.First(&product, productID).Error; err != nil || product.Status != "active" {
+		return nil, http.StatusNotFound, "Loan product not found"
+	}
+
+	if req.Amount < product.MinAmount || req.Amount > product.MaxAmount {
+		return nil, http.StatusBadRequest, "Amount outside product limits"
+	}
+	if req.Term < product.MinTerm || req.Term > product.MaxTerm {
+		return nil, http.StatusBadRequest, "Term outside product limits"
+	}
+
+	return &product, 0, ""
+}
+
+func simulateLoanHandler(c *gin.Context) {
+	var req loanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product, status, msg := loadLoanProduct(req)
+	if product == nil {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+
+	now := time.Now()
+	firstDue := req.FirstDueDate
+	if firstDue.IsZero() {
+		firstDue = now.AddDate(0, 1, 0)
+	}
+
+	methods := []string{amortizationSAC, amortizationPrice}
+	if req.Method != "" {
+		if req.Method != amortizationSAC && req.Method != amortizationPrice {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Method must be sac or price"})
+			return
+		}
+		methods = []string{req.Method}
+	}
+
+	simulations := gin.H{}
+	for _, method := range methods {
+		simulations[method] = simulateLoan(req.Amount, product.MonthlyRate, req.Term, method, now, firstDue)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product":     product,
+		"simulations": simulations,
+	})
+}
+
+func createLoan(c *gin.Context) {
+	var req struct {
+		loanRequest
+		AccountID string `json:"account_id" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accountID, err := uuid.Parse(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	if req.Method == "" {
+		req.Method = amortizationPrice
+	}
+	if req.Method != amortizationSAC && req.Method != amortizationPrice {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Method must be sac or price"})
+		return
+	}
+
+	product, status, msg := loadLoanProduct(req.loanRequest)
+	if product == nil {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+
+	now := time.Now()
+	firstDue := req.FirstDueDate
+	if firstDue.IsZero() {
+		firstDue = now.AddDate(0, 1, 0)
+	}
+	sim := simulateLoan(req.Amount, product.MonthlyRate, req.Term, req.Method, now, firstDue)
+
+	loan := Loan{
+		ID:          uuid.New(),
+		AccountID:   accountID,
+		ProductID:   product.ID,
+		Principal:   sim.Principal,
+		IOF:         sim.IOF,
+		NetAmount:   sim.NetAmount,
+		MonthlyRate: sim.MonthlyRate,
+		Term:        req.Term,
+		Method:      req.Method,
+		CETMonthly:  sim.CETMonthly,
+		CETAnnual:   sim.CETAnnual,
+		Status:      "active",
+		DisbursedAt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if account.Status != "active" {
+			return errAccountNotActive
+		}
+
+		if err := tx.Create(&loan).Error; err != nil {
+			return err
+		}
+		for i := range sim.Installments {
+			sim.Installments[i].ID = uuid.New()
+			sim.Installments[i].LoanID = loan.ID
+		}
+		if err := tx.Create(&sim.Installments).Error; err != nil {
+			return err
+		}
+
+		account.Balance += loan.Principal
+		account.UpdatedAt = now
+		if err := tx.Save(&account).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&Transaction{
+			ID:          uuid.New(),
+			ToAccountID: account.ID,
+			Amount:      loan.Principal,
+			Currency:    account.Currency,
+			Type:        "loan_disbursement",
+			Status:      "completed",
+			Description: "Loan " + loan.ID.String() + " disbursement",
+			CreatedAt:   now,
+		}).Error; err != nil {
+			return err
+		}
+
+		_, err := withholdTaxes(tx, &account, sim.Taxes, "loan "+loan.ID.String())
+		return err
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	case errAccountNotActive:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account is not active"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create loan"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"loan":         loan,
+		"installments": sim.Installments,
+		"message":      "Loan disbursed into account",
+	})
+}
+
+func getLoan(c *gin.Context) {
+	loanID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid loan ID"})
+		return
+	}
+
+	var loan Loan
+	if err := db.First(&loan, loanID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Loan not found"})
+		return
+	}
+
+	var installments []LoanInstallment
+	db.Where("loan_id = ?", loan.ID).Order("number").Find(&installments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"loan":         loan,
+		"installments": installments,
+	})
+}
+
+func getAccountLoans(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var loans []Loan
+	db.Where("account_id = ?", accountID).Order("created_at DESC").Find(&loans)
+
+	c.JSON(http.StatusOK, loans)
+}
+
+func getPayoffQuote(c *gin.Context) {
+	loanID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid loan ID"})
+		return
+	}
+
+	loan, product, installments, err := loadOpenLoan(db, loanID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open loan not found"})
+		return
+	}
+
+	now := time.Now()
+	total, discount := payoffAmount(loan, product, installments, now)
+
+	c.JSON(http.StatusOK, gin.H{
+		"loan_id":     loan.ID,
+		"payoff":      total,
+		"discount":    discount,
+		"quoted_at":   now,
+		"valid_until": endOfDay(now),
+	})
+}
+
+func payoffLoan(c *gin.Context) {
+	loanID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid loan ID"})
+		return
+	}
+
+	now := time.Now()
+	var total int64
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		loan, product, installments, err := loadOpenLoan(tx, loanID)
+		if err != nil {
+			return errLoanNotFound
+		}
+
+		total, _ = payoffAmount(loan, product, installments, now)
+
+		var account Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, loan.AccountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if availableBalance(tx, &account) < total {
+			return errInsufficientBalance
+		}
+
+		account.Balance -= total
+		account.UpdatedAt = now
+		if err := tx.Save(&account).Error; err != nil {
+			return err
+		}
+
+		for _, inst := range installments {
+			fee, interest := lateCharges(inst, product, now)
+			if err := tx.Model(&LoanInstallment{}).Where("id = ?", inst.ID).Updates(map[string]interface{}{
+				"status":        "paid",
+				"paid_at":       now,
+				"paid_amount":   payoffValue(loan, product, inst, now),
+				"late_fee":      fee,
+				"late_interest": interest,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		loan.Status = "paid_off"
+		loan.UpdatedAt = now
+		if err := tx.Save(loan).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&Transaction{
+			ID:            uuid.New(),
+			FromAccountID: account.ID,
+			Amount:        total,
+			Currency:      account.Currency,
+			Type:          "loan_payoff",
+			Status:        "completed",
+			Description:   "Loan " + loan.ID.String() + " early payoff",
+			CreatedAt:     now,
+		}).Error
+	})
+
+	switch err {
+	case nil:
+	case errLoanNotFound, errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open loan not found"})
+		return
+	case errInsufficientBalance:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pay off loan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"loan_id": loanID,
+		"paid":    total,
+		"message": "Loan paid off",
+	})
+}
+
+func loadOpenLoan(tx *gorm.DB, loanID uuid.UUID) (*Loan, *LoanProduct, []LoanInstallment, error) {
+	var loan Loan
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("status IN ?", []string{"active", "delinquent"}).First(&loan, loanID).Error; err != nil {
+		return nil, nil, nil, err
+	}
+
+	var product LoanProduct
+	if err := tx.First(&product, loan.ProductID).Error; err != nil {
+		return nil, nil, nil, err
+	}
+
+	var installments []LoanInstallment
+	tx.Where("loan_id = ? AND status <> ?", loan.ID, "paid").Order("number").Find(&installments)
+
+	return &loan, &product, installments, nil
+}
+
+// payoffAmount quotes the settlement of every open installment: overdue
+// ones in full with late charges, future ones discounted to present value
+// at the contract rate. It also returns the interest waived by the discount.
+func payoffAmount(loan *Loan, product *LoanProduct, installments []LoanInstallment, now time.Time) (int64, int64) {
+	var total, nominal int64
+	for _, inst := range installments {
+		total += payoffValue(loan, product, inst, now)
+		if inst.DueDate.After(now) {
+			nominal += inst.Amount
+		} else {
+			fee, interest := lateCharges(inst, product, now)
+			nominal += inst.Amount + fee + interest
+		}
+	}
+	return total, nominal - total
+}
+
+// payoffValue is what settling one installment early costs.
+func payoffValue(loan *Loan, product *LoanProduct, inst LoanInstallment, now time.Time) int64 {
+	if !inst.DueDate.After(now) {
+		fee, interest := lateCharges(inst, product, now)
+		return inst.Amount + fee + interest
+	}
+	periods := inst.DueDate.Sub(now).Hours() / 24 / 30
+	return roundCents(float64(inst.Amount) / math.Pow(1+loan.MonthlyRate, periods))
+}
+
+// lateCharges returns the one-off late fee (multa) and the pro rata late
+// interest (juros de mora) owed on an installment paid after its due date.
+func lateCharges(inst LoanInstallment, product *LoanProduct, now time.Time) (int64, int64) {
+	if !pastDue(inst, now) {
+		return 0, 0
+	}
+	daysLate := math.Floor(now.Sub(inst.DueDate).Hours() / 24)
+	fee := roundCents(float64(inst.Amount) * product.LateFeeRate)
+	interest := roundCents(float64(inst.Amount) * product.LateInterestRate * daysLate / 30)
+	return fee, interest
+}
+
+// pastDue reports whether the due date of an installment has gone by; an
+// installment may still be paid without charges on the day it is due.
+func pastDue(inst LoanInstallment, now time.Time) bool {
+	return now.After(endOfDay(inst.DueDate))
+}
+
+func simulateLoan(principal int64, monthlyRate float64, term int, method string, start, firstDue time.Time) LoanSimulation {
+	installments := buildSchedule(principal, monthlyRate, term, method, firstDue)
+	taxes := loanTaxes(db, principal, installments, start)
+
+	sim := LoanSimulation{
+		Method:       method,
+		Principal:    principal,
+		IOF:          taxes.TotalFor(taxIOF),
+		NetAmount:    principal - taxes.Total,
+		MonthlyRate:  monthlyRate,
+		Taxes:        taxes,
+		Installments: installments,
+	}
+	for _, inst := range installments {
+		sim.TotalPayable += inst.Amount
+		sim.TotalInterest += inst.Interest
+	}
+	sim.CETMonthly = calculateCET(sim.NetAmount, installments, start)
+	sim.CETAnnual = math.Pow(1+sim.CETMonthly, 12) - 1
+
+	return sim
+}
+
+// buildSchedule produces the amortization table. SAC amortizes a constant
+// share of principal per month; Price keeps the installment amount constant.
+// Rounding residue is absorbed by the last installment.
+func buildSchedule(principal int64, monthlyRate float64, term int, method string, firstDue time.Time) []LoanInstallment {
+	installments := make([]LoanInstallment, 0, term)
+	balance := principal
+
+	var pmt int64
+	if method == amortizationPrice {
+		pmt = roundCents(float64(principal) * monthlyRate / (1 - math.Pow(1+monthlyRate, -float64(term))))
+	}
+
+	for n := 1; n <= term; n++ {
+		interest := roundCents(float64(balance) * monthlyRate)
+
+		var amortization int64
+		switch {
+		case n == term:
+			amortization = balance
+		case method == amortizationSAC:
+			amortization = principal / int64(term)
+		default:
+			amortization = pmt - interest
+		}
+		balance -= amortization
+
+		installments = append(installments, LoanInstallment{
+			Number:    n,
+			DueDate:   firstDue.AddDate(0, n-1, 0),
+			Principal: amortization,
+			Interest:  interest,
+			Amount:    amortization + interest,
+			Balance:   balance,
+			Status:    "pending",
+		})
+	}
+
+	return installments
+}
+
+// loanTaxes computes the IOF on a credit operation: the daily rate applies
+// to each amortized amount for the days until its due date.
+func loanTaxes(tx *gorm.DB, principal int64, installments []LoanInstallment, start time.Time) TaxBreakdown {
+	amortizations := make([]TaxAmortization, len(installments))
+	for i, inst := range installments {
+		amortizations[i] = TaxAmortization{Amount: inst.Principal, DueDate: inst.DueDate}
+	}
+
+	return calculateTaxes(tx, TaxOperation{
+		OperationType: loanTaxOperation,
+		Amount:        principal,
+		StartDate:     start,
+		Date:          start,
+		Amortizations: amortizations,
+	})
+}
+
+// calculateCET finds the monthly rate that discounts the installments back
+// to the amount actually received, i.e. the effective total cost of credit.
+func calculateCET(net int64, installments []LoanInstallment, start time.Time) float64 {
+	presentValue := func(rate float64) float64 {
+		var pv float64
+		for _, inst := range installments {
+			periods := inst.DueDate.Sub(start).Hours() / 24 / 30
+			pv += float64(inst.Amount) / math.Pow(1+rate, periods)
+		}
+		return pv
+	}
+
+	low, high := 0.0, 1.0
+	for i := 0; i < 100; i++ {
+		mid := (low + high) / 2
+		if presentValue(mid) > float64(net) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return math.Round((low+high)/2*1e6) / 1e6
+}
+
+// startLoanCollector debits due installments from their accounts on a
+// fixed interval until the process exits.
+func startLoanCollector(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			collectDueInstallments(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func collectDueInstallments(now time.Time) {
+	var due []LoanInstallment
+	db.Where("status IN ? AND due_date <= ?", []string{"pending", "overdue"}, now).
+		Order("due_date").
+		Find(&due)
+
+	for _, inst := range due {
+		db.Transaction(func(tx *gorm.DB) error {
+			return collectInstallment(tx, inst.ID, now)
+		})
+	}
+}
+
+// collectInstallment locks the loan before the installment, as payoff
+// does, and skips installments settled since they were selected.
+func collectInstallment(tx *gorm.DB, instID uuid.UUID, now time.Time) error {
+	var inst LoanInstallment
+	if err := tx.First(&inst, instID).Error; err != nil {
+		return err
+	}
+	var loan Loan
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&loan, inst.LoanID).Error; err != nil {
+		return err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&inst, instID).Error; err != nil {
+		return err
+	}
+	if inst.Status == "paid" {
+		return nil
+	}
+	var product LoanProduct
+	if err := tx.First(&product, loan.ProductID).Error; err != nil {
+		return err
+	}
+	var account Account
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, loan.AccountID).Error; err != nil {
+		return err
+	}
+
+	inst.LateFee, inst.LateInterest = lateCharges(inst, &product, now)
+	owed := inst.Amount + inst.LateFee + inst.LateInterest
+
+	if account.Status != "active" || availableBalance(tx, &account) < owed {
+		inst.Status = "overdue"
+		if err := tx.Save(&inst).Error; err != nil {
+			return err
+		}
+		if pastDue(inst, now) && loan.Status == "active" {
+			loan.Status = "delinquent"
+			loan.UpdatedAt = now
+			return tx.Save(&loan).Error
+		}
+		return nil
+	}
+
+	account.Balance -= owed
+	account.UpdatedAt = now
+	if err := tx.Save(&account).Error; err != nil {
+		return err
+	}
+
+	inst.PaidAmount = owed
+	inst.Status = "paid"
+	inst.PaidAt = &now
+	if err := tx.Save(&inst).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Create(&Transaction{
+		ID:            uuid.New(),
+		FromAccountID: account.ID,
+		Amount:        owed,
+		Currency:      account.Currency,
+		Type:          "loan_installment",
+		Status:        "completed",
+		Description:   "Loan " + loan.ID.String() + " installment",
+		CreatedAt:     now,
+	}).Error; err != nil {
+		return err
+	}
+
+	var open, overdue int64
+	tx.Model(&LoanInstallment{}).Where("loan_id = ? AND status <> ?", loan.ID, "paid").Count(&open)
+	tx.Model(&LoanInstallment{}).Where("loan_id = ? AND status = ?", loan.ID, "overdue").Count(&overdue)
+
+	switch {
+	case open == 0:
+		loan.Status = "paid_off"
+	case overdue == 0:
+		loan.Status = "active"
+	}
+	loan.UpdatedAt = now
+	return tx.Save(&loan).Error
+}
+
+func roundCents(v float64) int64 {
+	return int64(math.Round(v))
+}
+
+func endOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 23, 59, 59, 0, t.Location())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBuildSchedule(t *testing.T) {
+	first := time.Date(2026, 2, 10, 0, 0, 0, 0, time.UTC)
+	for _, method := range []string{amortizationSAC, amortizationPrice} {
+		schedule := buildSchedule(1000000, 0.02, 12, method, first)
+		if len(schedule) != 12 {
+			t.Fatalf("%s: %d installments", method, len(schedule))
+		}
+
+		var principal int64
+		for i, inst := range schedule {
+			principal += inst.Principal
+			if inst.Amount != inst.Principal+inst.Interest {
+				t.Errorf("%s #%d: amount %d != principal %d + interest %d", method, inst.Number, inst.Amount, inst.Principal, inst.Interest)
+			}
+			if want := first.AddDate(0, i, 0); !inst.DueDate.Equal(want) {
+				t.Errorf("%s #%d: due %v, want %v", method, inst.Number, inst.DueDate, want)
+			}
+		}
+		if principal != 1000000 || schedule[11].Balance != 0 {
+			t.Errorf("%s: amortized %d, final balance %d", method, principal, schedule[11].Balance)
+		}
+	}
+
+	sac := buildSchedule(1200000, 0.02, 12, amortizationSAC, first)
+	if sac[0].Principal != 100000 || sac[0].Interest != 24000 || sac[1].Amount >= sac[0].Amount {
+		t.Errorf("SAC: first installment %+v, second %+v", sac[0], sac[1])
+	}
+
+	price := buildSchedule(1000000, 0.02, 12, amortizationPrice, first)
+	for _, inst := range price[:11] {
+		if inst.Amount != 94560 {
+			t.Errorf("Price #%d: amount %d, want constant 94560", inst.Number, inst.Amount)
+		}
+	}
+}
+
+func TestCalculateCET(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	schedule := buildSchedule(1000000, 0.02, 12, amortizationPrice, start.AddDate(0, 0, 30))
+
+	// With no charges the effective cost is the contract rate, allowing for
+	// months not being exactly 30 days.
+	if cet := calculateCET(1000000, schedule, start); math.Abs(cet-0.02) > 0.001 {
+		t.Errorf("CET without charges = %f, want about 0.02", cet)
+	}
+	if cet := calculateCET(980000, schedule, start); cet <= 0.021 {
+		t.Errorf("CET with 2%% withheld = %f, want above the contract rate", cet)
+	}
+}
+
+func TestLateCharges(t *testing.T) {
+	product := &LoanProduct{LateFeeRate: 0.02, LateInterestRate: 0.01}
+	due := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	inst := LoanInstallment{Amount: 100000, DueDate: due}
+
+	if pastDue(inst, due.Add(20*time.Hour)) {
+		t.Error("installment past due on its due date")
+	}
+	if fee, interest := lateCharges(inst, product, due.Add(20*time.Hour)); fee != 0 || interest != 0 {
+		t.Errorf("charges on the due date: %d, %d", fee, interest)
+	}
+
+	later := due.AddDate(0, 0, 15)
+	if !pastDue(inst, later) {
+		t.Error("installment not past due 15 days later")
+	}
+	if fee, interest := lateCharges(inst, product, later); fee != 2000 || interest != 500 {
+		t.Errorf("charges 15 days late: fee %d, interest %d; want 2000, 500", fee, interest)
+	}
+
+	// A product without a late fee still makes the installment past due.
+	if fee, _ := lateCharges(inst, &LoanProduct{}, later); fee != 0 || !pastDue(inst, later) {
+		t.Errorf("fee %d without a late fee rate", fee)
+	}
+}
+
+func TestPayoffAmount(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	loan := &Loan{MonthlyRate: 0.02}
+	product := &LoanProduct{LateFeeRate: 0.02}
+	installments := []LoanInstallment{
+		{Amount: 100000, DueDate: now.AddDate(0, 0, -10)},
+		{Amount: 100000, DueDate: now.AddDate(0, 0, 30)},
+	}
+
+	total, waived := payoffAmount(loan, product, installments, now)
+	overdue := payoffValue(loan, product, installments[0], now)
+	future := payoffValue(loan, product, installments[1], now)
+	if overdue != 102000 {
+		t.Errorf("overdue installment settles for %d, want 102000", overdue)
+	}
+	if future != 98039 {
+		t.Errorf("future installment settles for %d, want 98039", future)
+	}
+	if total != overdue+future || waived != 100000-future {
+		t.Errorf("total %d, waived %d", total, waived)
+	}
+}
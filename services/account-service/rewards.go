@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errInsufficientPoints = errors.New("insufficient points")
+
+type RewardCampaign struct {
+	ID                      uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Name                    string    `json:"name"`
+	Source                  string    `json:"source"`
+	Category                string    `json:"category"`
+	MerchantID              string    `json:"merchant_id"`
+	CashbackPercent         float64   `json:"cashback_percent"`
+	MaxPointsPerTransaction int64     `json:"max_points_per_transaction"`
+	MaxPointsPerAccount     int64     `json:"max_points_per_account"`
+	PointsValidityDays      int       `json:"points_validity_days"`
+	StartsAt                time.Time `json:"starts_at"`
+	EndsAt                  time.Time `json:"ends_at"`
+	Status                  string    `json:"status"`
+	CreatedAt               time.Time `json:"created_at"`
+}
+
+// RewardEntry is a row of the points ledger. Accruals carry the points
+// still available for redemption in Remaining and are consumed oldest
+// expiry first; redemptions, reversals and expiries are recorded as
+// negative entries. One point is worth one cent of the account currency on
+// redemption. Entries from another service are unique per source ID, so
+// repeated calls cannot credit or reverse twice.
+type RewardEntry struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	AccountID  uuid.UUID  `json:"account_id" gorm:"type:uuid;index"`
+	CampaignID *uuid.UUID `json:"campaign_id" gorm:"type:uuid;index"`
+	Type       string     `json:"type"`
+	Points     int64      `json:"points"`
+	Remaining  int64      `json:"remaining"`
+	Source     string     `json:"source" gorm:"uniqueIndex:idx_reward_entries_source,where:source <> ''"`
+	SourceID   string     `json:"source_id" gorm:"uniqueIndex:idx_reward_entries_source"`
+	AccrualID  *uuid.UUID `json:"accrual_id,omitempty" gorm:"type:uuid;index"`
+	Amount     int64      `json:"amount"`
+	ExpiresAt  *time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func createRewardCampaign(c *gin.Context) {
+	var req struct {
+		Name                    string    `json:"name" binding:"required"`
+		Source                  string    `json:"source" binding:"required,oneof=card pix any"`
+		Category                string    `json:"category"`
+		MerchantID              string    `json:"merchant_id"`
+		CashbackPercent         float64   `json:"cashback_percent" binding:"required,gt=0,lte=100"`
+		MaxPointsPerTransaction int64     `json:"max_points_per_transaction" binding:"gte=0"`
+		MaxPointsPerAccount     int64     `json:"max_points_per_account" binding:"gte=0"`
+		PointsValidityDays      int       `json:"points_validity_days" binding:"gte=0"`
+		StartsAt                time.Time `json:"starts_at" binding:"required"`
+		EndsAt                  time.Time `json:"ends_at" binding:"required,gtfield=StartsAt"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	campaign := RewardCampaign{
+		ID:                      uuid.New(),
+		Name:                    req.Name,
+		Source:                  req.Source,
+		Category:                req.Category,
+		MerchantID:              req.MerchantID,
+		CashbackPercent:         req.CashbackPercent,
+		MaxPointsPerTransaction: req.MaxPointsPerTransaction,
+		MaxPointsPerAccount:     req.MaxPointsPerAccount,
+		PointsValidityDays:      req.PointsValidityDays,
+		StartsAt:                req.StartsAt,
+		EndsAt:                  req.EndsAt,
+		Status:                  "active",
+		CreatedAt:               time.Now(),
+	}
+
+	if err := db.Create(&campaign).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create campaign"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, campaign)
+}
+
+func getRewardCampaigns(c *gin.Context) {
+	var campaigns []RewardCampaign
+	db.Where("status = ?", "active").Order("starts_at DESC").Find(&campaigns)
+
+	c.JSON(http.StatusOK, campaigns)
+}
+
+func endRewardCampaign(c *gin.Context) {
+	campaignID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid campaign ID"})
+		return
+	}
+
+	result := db.Model(&RewardCampaign{}).Where("id = ?", campaignID).Update("status", "ended")
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Campaign ended"})
+}
+
+// accrueRewards is called by card-service and payment-service for every
+// approved card authorization or PIX payment. Repeated calls for the same
+// source ID are ignored.
+func accrueRewards(c *gin.Context) {
+	var req struct {
+		AccountID  string `json:"account_id" binding:"required"`
+		Source     string `json:"source" binding:"required,oneof=card pix"`
+		SourceID   string `json:"source_id" binding:"required"`
+		Amount     int64  `json:"amount" binding:"required,gt=0"`
+		Category   string `json:"category"`
+		MerchantID string `json:"merchant_id"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accountID, err := uuid.Parse(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var existing RewardEntry
+	if err := db.Where("source = ? AND source_id = ? AND type = ?", req.Source, req.SourceID, "accrual").
+		First(&existing).Error; err == nil {
+		c.JSON(http.StatusOK, gin.H{"entry": existing, "message": "Already accrued"})
+		return
+	}
+
+	now := time.Now()
+	var campaigns []RewardCampaign
+	db.Where("status = ? AND starts_at <= ? AND ends_at > ?", "active", now, now).
+		Where("source IN ?", []string{req.Source, "any"}).
+		Where("category = '' OR category = ?", req.Category).
+		Where("merchant_id = '' OR merchant_id = ?", req.MerchantID).
+		Find(&campaigns)
+
+	var best *RewardCampaign
+	var bestPoints int64
+	for i := range campaigns {
+		points := campaignPoints(&campaigns[i], accountID, req.Amount)
+		if points > bestPoints {
+			best, bestPoints = &campaigns[i], points
+		}
+	}
+
+	if best == nil {
+		c.JSON(http.StatusOK, gin.H{"points": 0, "message": "No campaign applies"})
+		return
+	}
+
+	entry := RewardEntry{
+		ID:         uuid.New(),
+		AccountID:  accountID,
+		CampaignID: &best.ID,
+		Type:       "accrual",
+		Points:     bestPoints,
+		Remaining:  bestPoints,
+		Source:     req.Source,
+		SourceID:   req.SourceID,
+		Amount:     req.Amount,
+		CreatedAt:  now,
+	}
+	if best.PointsValidityDays > 0 {
+		expiresAt := now.AddDate(0, 0, best.PointsValidityDays)
+		entry.ExpiresAt = &expiresAt
+	}
+
+	if err := db.Create(&entry).Error; err != nil {
+		if err := db.Where("source = ? AND source_id = ? AND type = ?", req.Source, req.SourceID, "accrual").
+			First(&existing).Error; err == nil {
+			c.JSON(http.StatusOK, gin.H{"entry": existing, "message": "Already accrued"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accrue points"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"entry":   entry,
+		"points":  bestPoints,
+		"message": "Points accrued",
+	})
+}
+
+// reverseRewards takes back the points accrued on a purchase that was
+// voided, reversed, refunded or charged back, in proportion to the amount
+// returned. reference identifies the returning event, so each is reversed
+// once. Points already redeemed are taken from the account's other lots;
+// what cannot be covered is written off.
+func reverseRewards(c *gin.Context) {
+	var req struct {
+		Source    string `json:"source" binding:"required,oneof=card pix"`
+		SourceID  string `json:"source_id" binding:"required"`
+		Reference string `json:"reference" binding:"required"`
+		Amount    int64  `json:"amount" binding:"required,gt=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var entry *RewardEntry
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var accrual RewardEntry
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("source = ? AND source_id = ? AND type = ?", req.Source, req.SourceID, "accrual").
+			Limit(1).Find(&accrual).Error
+		if err != nil || accrual.ID == uuid.Nil {
+			return err
+		}
+
+		var existing RewardEntry
+		tx.Where("source = ? AND source_id = ? AND type = ?", req.Source, req.Reference, "reversal").
+			Limit(1).Find(&existing)
+		if existing.ID != uuid.Nil {
+			entry = &existing
+			return nil
+		}
+
+		var reversed int64
+		tx.Model(&RewardEntry{}).Where("accrual_id = ? AND type = ?", accrual.ID, "reversal").
+			Select("COALESCE(SUM(-points), 0)").Scan(&reversed)
+		points := reversalPoints(&accrual, reversed, req.Amount)
+
+		left := points
+		used := accrual.Remaining
+		if used > left {
+			used = left
+		}
+		accrual.Remaining -= used
+		left -= used
+		if err := tx.Save(&accrual).Error; err != nil {
+			return err
+		}
+		if _, err := consumePoints(tx, accrual.AccountID, left, now); err != nil {
+			return err
+		}
+
+		entry = &RewardEntry{
+			ID:         uuid.New(),
+			AccountID:  accrual.AccountID,
+			CampaignID: accrual.CampaignID,
+			Type:       "reversal",
+			Points:     -points,
+			Source:     req.Source,
+			SourceID:   req.Reference,
+			AccrualID:  &accrual.ID,
+			Amount:     req.Amount,
+			CreatedAt:  now,
+		}
+		return tx.Create(entry).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse points"})
+		return
+	}
+	if entry == nil {
+		c.JSON(http.StatusOK, gin.H{"points": 0, "message": "Nothing accrued"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entry":   entry,
+		"points":  -entry.Points,
+		"message": "Points reversed",
+	})
+}
+
+// reversalPoints is the share of an accrual's points that amount returns,
+// never more than what is left after earlier reversals.
+func reversalPoints(accrual *RewardEntry, reversed, amount int64) int64 {
+	left := accrual.Points - reversed
+	if accrual.Amount <= 0 || left <= 0 {
+		return 0
+	}
+	points := int64(math.Ceil(float64(accrual.Points) * float64(amount) / float64(accrual.Amount)))
+	if points > left {
+		points = left
+	}
+	return points
+}
+
+// consumePoints takes points from the account's available lots, oldest
+// expiry first, and returns how many could not be covered.
+func consumePoints(tx *gorm.DB, accountID uuid.UUID, points int64, now time.Time) (int64, error) {
+	if points <= 0 {
+		return 0, nil
+	}
+
+	var lots []RewardEntry
+	tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("account_id = ? AND remaining > 0 AND (expires_at IS NULL OR expires_at > ?)", accountID, now).
+		Order("expires_at IS NULL, expires_at, created_at").
+		Find(&lots)
+
+	left := points
+	for i := range lots {
+		if left == 0 {
+			break
+		}
+		used := lots[i].Remaining
+		if used > left {
+			used = left
+		}
+		lots[i].Remaining -= used
+		left -= used
+		if err := tx.Save(&lots[i]).Error; err != nil {
+			return 0, err
+		}
+	}
+	return left, nil
+}
+
+// campaignPoints applies the cashback percentage and the campaign caps.
+func campaignPoints(campaign *RewardCampaign, accountID uuid.UUID, amount int64) int64 {
+	points := int64(math.Floor(float64(amount) * campaign.CashbackPercent / 100))
+	if campaign.MaxPointsPerTransaction > 0 && points > campaign.MaxPointsPerTransaction {
+		points = campaign.MaxPointsPerTransaction
+	}
+
+	if campaign.MaxPointsPerAccount > 0 {
+		var earned int64
+		db.Model(&RewardEntry{}).
+			Where("account_id = ? AND campaign_id = ? AND type = ?", accountID, campaign.ID, "accrual").
+			Select("COALESCE(SUM(points), 0)").
+			Scan(&earned)
+		if left := campaign.MaxPointsPerAccount - earned; points > left {
+			points = left
+		}
+	}
+
+	if points < 0 {
+		return 0
+	}
+	return points
+}
+
+func getAccountRewards(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	now := time.Now()
+	var balance, expiringSoon int64
+	db.Model(&RewardEntry{}).
+		Where("account_id = ? AND remaining > 0 AND (expires_at IS NULL OR expires_at > ?)", accountID, now).
+		Select("COALESCE(SUM(remaining), 0)").
+		Scan(&balance)
+	db.Model(&RewardEntry{}).
+		Where("account_id = ? AND remaining > 0 AND expires_at > ? AND expires_at <= ?", accountID, now, now.AddDate(0, 0, 30)).
+		Select("COALESCE(SUM(remaining), 0)").
+		Scan(&expiringSoon)
+
+	var entries []RewardEntry
+	db.Where("account_id = ?", accountID).Order("created_at DESC").Limit(100).Find(&entries)
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id":          accountID,
+		"points":              balance,
+		"points_value":        balance,
+		"expiring_in_30_days": expiringSoon,
+		"entries":             entries,
+	})
+}
+
+func redeemRewards(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req struct {
+		Points int64 `json:"points" binding:"required,gt=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var account Account
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if account.Status != "active" {
+			return errAccountNotActive
+		}
+
+		left, err := consumePoints(tx, accountID, req.Points, now)
+		if err != nil {
+			return err
+		}
+		if left > 0 {
+			return errInsufficientPoints
+		}
+
+		if err := tx.Create(&RewardEntry{
+			ID:        uuid.New(),
+			AccountID: accountID,
+			Type:      "redemption",
+			Points:    -req.Points,
+			Amount:    req.Points,
+			CreatedAt: now,
+		}).Error; err != nil {
+			return err
+		}
+
+		account.Balance += req.Points
+		account.UpdatedAt = now
+		if err := tx.Save(&account).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&Transaction{
+			ID:          uuid.New(),
+			ToAccountID: accountID,
+			Amount:      req.Points,
+			Currency:    account.Currency,
+			Type:        "rewards_redemption",
+			Status:      "completed",
+			Description: "Rewards points redemption",
+			CreatedAt:   now,
+		}).Error
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	case errAccountNotActive:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account is not active"})
+		return
+	case errInsufficientPoints:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient points"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem points"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account":  account,
+		"redeemed": req.Points,
+		"message":  "Points redeemed into account balance",
+	})
+}
+
+// startRewardsExpiry writes off expired points on a fixed interval.
+func startRewardsExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			expireRewards(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func expireRewards(now time.Time) {
+	var lots []RewardEntry
+	db.Where("remaining > 0 AND expires_at <= ?", now).Find(&lots)
+
+	for _, lot := range lots {
+		db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lot, lot.ID).Error; err != nil {
+				return err
+			}
+			if lot.Remaining <= 0 {
+				return nil
+			}
+			expired := lot.Remaining
+			lot.Remaining = 0
+			if err := tx.Save(&lot).Error; err != nil {
+				return err
+			}
+			return tx.Create(&RewardEntry{
+				ID:         uuid.New(),
+				AccountID:  lot.AccountID,
+				CampaignID: lot.CampaignID,
+				Type:       "expiry",
+				Points:     -expired,
+				SourceID:   lot.ID.String(),
+				CreatedAt:  now,
+			}).Error
+		})
+	}
+}
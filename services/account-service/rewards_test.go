@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestReversalPoints(t *testing.T) {
+	accrual := &RewardEntry{Points: 15, Amount: 1000}
+	cases := []struct {
+		reversed, amount, want int64
+	}{
+		{0, 1000, 15},
+		{0, 500, 8},
+		{8, 500, 7},
+		{8, 1000, 7},
+		{15, 100, 0},
+		{0, 1, 1},
+	}
+	for _, tc := range cases {
+		if got := reversalPoints(accrual, tc.reversed, tc.amount); got != tc.want {
+			t.Errorf("reversed %d, amount %d: got %d, want %d", tc.reversed, tc.amount, got, tc.want)
+		}
+	}
+
+	if got := reversalPoints(&RewardEntry{Points: 10}, 0, 100); got != 0 {
+		t.Errorf("accrual without an amount reversed %d points", got)
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	taxIOF  = "iof"
+	taxIRRF = "irrf"
+
+	taxBasisAmount = "amount"
+	taxBasisGain   = "gain"
+)
+
+// TaxRate is one row of the rate tables. A row applies to an operation type
+// on dates within [ValidFrom, ValidTo) and, for holding-period tables such as
+// the regressive income tax, to holding periods within
+// [MinHoldingDays, MaxHoldingDays] (MaxHoldingDays 0 means unbounded).
+// Rate is charged once on the basis; DailyRate is charged per day up to
+// MaxDays, as IOF on credit is.
+type TaxRate struct {
+	ID             uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	Tax            string     `json:"tax" gorm:"index"`
+	OperationType  string     `json:"operation_type" gorm:"index"`
+	Basis          string     `json:"basis"`
+	Rate           float64    `json:"rate"`
+	DailyRate      float64    `json:"daily_rate"`
+	MaxDays        int        `json:"max_days"`
+	MinHoldingDays int        `json:"min_holding_days"`
+	MaxHoldingDays int        `json:"max_holding_days"`
+	Description    string     `json:"description"`
+	ValidFrom      time.Time  `json:"valid_from"`
+	ValidTo        *time.Time `json:"valid_to"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// TaxWithholding is a tax amount actually collected from a customer and
+// posted to the tax ledger account.
+type TaxWithholding struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	AccountID     uuid.UUID  `json:"account_id" gorm:"type:uuid;index"`
+	UserID        uuid.UUID  `json:"user_id" gorm:"type:uuid;index"`
+	Tax           string     `json:"tax"`
+	OperationType string     `json:"operation_type"`
+	Base          int64      `json:"base"`
+	Amount        int64      `json:"amount"`
+	Reference     string     `json:"reference" gorm:"index"`
+	TransactionID uuid.UUID  `json:"transaction_id" gorm:"type:uuid"`
+	ReversedAt    *time.Time `json:"reversed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"index"`
+}
+
+type TaxAmortization struct {
+	Amount  int64     `json:"amount"`
+	DueDate time.Time `json:"due_date"`
+}
+
+type TaxOperation struct {
+	OperationType string            `json:"operation_type" binding:"required"`
+	Amount        int64             `json:"amount" binding:"gte=0"`
+	Gain          int64             `json:"gain" binding:"gte=0"`
+	StartDate     time.Time         `json:"start_date"`
+	Date          time.Time         `json:"date"`
+	Amortizations []TaxAmortization `json:"amortizations"`
+}
+
+type TaxLine struct {
+	Tax         string  `json:"tax"`
+	Description string  `json:"description"`
+	Base        int64   `json:"base"`
+	Rate        float64 `json:"rate"`
+	DailyRate   float64 `json:"daily_rate,omitempty"`
+	Days        int     `json:"days,omitempty"`
+	Amount      int64   `json:"amount"`
+}
+
+type TaxBreakdown struct {
+	OperationType string    `json:"operation_type"`
+	Date          time.Time `json:"date"`
+	HoldingDays   int       `json:"holding_days"`
+	Lines         []TaxLine `json:"lines"`
+	Total         int64     `json:"total"`
+}
+
+func (b TaxBreakdown) TotalFor(tax string) int64 {
+	var total int64
+	for _, line := range b.Lines {
+		if line.Tax == tax {
+			total += line.Amount
+		}
+	}
+	return total
+}
+
+func calculateTaxes(tx *gorm.DB, op TaxOperation) TaxBreakdown {
+	if op.Date.IsZero() {
+		op.Date = time.Now()
+	}
+	if op.StartDate.IsZero() {
+		op.StartDate = op.Date
+	}
+	holdingDays := daysBetween(op.StartDate, op.Date)
+
+	var rates []TaxRate
+	tx.Where("operation_type = ? AND valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)", op.OperationType, op.Date, op.Date).
+		Where("min_holding_days <= ? AND (max_holding_days = 0 OR max_holding_days >= ?)", holdingDays, holdingDays).
+		Order("tax, valid_from").
+		Find(&rates)
+
+	breakdown := TaxBreakdown{
+		OperationType: op.OperationType,
+		Date:          op.Date,
+		HoldingDays:   holdingDays,
+		Lines:         []TaxLine{},
+	}
+
+	// IOF rows sort before IRRF, so the income tax base on a gain can be
+	// reduced by the IOF already charged on that same gain.
+	var gainTaxed int64
+	for _, rate := range rates {
+		line := TaxLine{
+			Tax:         rate.Tax,
+			Description: rate.Description,
+			Base:        op.Amount,
+			Rate:        rate.Rate,
+			DailyRate:   rate.DailyRate,
+		}
+		if rate.Basis == taxBasisGain {
+			line.Base = op.Gain - gainTaxed
+		}
+
+		amount := float64(line.Base) * rate.Rate
+		if rate.DailyRate > 0 {
+			amortizations := op.Amortizations
+			if len(amortizations) == 0 {
+				amortizations = []TaxAmortization{{Amount: line.Base, DueDate: op.Date}}
+			}
+			for _, a := range amortizations {
+				days := daysBetween(op.StartDate, a.DueDate)
+				if rate.MaxDays > 0 && days > rate.MaxDays {
+					days = rate.MaxDays
+				}
+				if days > line.Days {
+					line.Days = days
+				}
+				amount += float64(a.Amount) * rate.DailyRate * float64(days)
+			}
+		}
+
+		line.Amount = roundCents(amount)
+		if line.Amount <= 0 {
+			continue
+		}
+		if rate.Basis == taxBasisGain {
+			gainTaxed += line.Amount
+		}
+		breakdown.Lines = append(breakdown.Lines, line)
+		breakdown.Total += line.Amount
+	}
+
+	return breakdown
+}
+
+// withholdTaxes debits the breakdown from the customer account and credits
+// each tax to its ledger account, recording one withholding per line.
+func withholdTaxes(tx *gorm.DB, account *Account, breakdown TaxBreakdown, reference string) ([]TaxWithholding, error) {
+	now := time.Now()
+	withholdings := make([]TaxWithholding, 0, len(breakdown.Lines))
+
+	for _, line := range breakdown.Lines {
+		ledger, err := taxLedgerAccount(tx, line.Tax)
+		if err != nil {
+			return nil, err
+		}
+
+		account.Balance -= line.Amount
+		account.UpdatedAt = now
+		ledger.Balance += line.Amount
+		ledger.UpdatedAt = now
+		if err := tx.Save(account).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Save(ledger).Error; err != nil {
+			return nil, err
+		}
+
+		transaction := Transaction{
+			ID:            uuid.New(),
+			FromAccountID: account.ID,
+			ToAccountID:   ledger.ID,
+			Amount:        line.Amount,
+			Currency:      account.Currency,
+			Type:          "tax_withholding",
+			Status:        "completed",
+			Description:   line.Description + " - " + reference,
+			CreatedAt:     now,
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return nil, err
+		}
+
+		withholding := TaxWithholding{
+			ID:            uuid.New(),
+			AccountID:     account.ID,
+			UserID:        account.UserID,
+			Tax:           line.Tax,
+			OperationType: breakdown.OperationType,
+			Base:          line.Base,
+			Amount:        line.Amount,
+			Reference:     reference,
+			TransactionID: transaction.ID,
+			CreatedAt:     now,
+		}
+		if err := tx.Create(&withholding).Error; err != nil {
+			return nil, err
+		}
+		withholdings = append(withholdings, withholding)
+	}
+
+	return withholdings, nil
+}
+
+// breakdownOf rebuilds the breakdown of taxes already withheld.
+func breakdownOf(withholdings []TaxWithholding) TaxBreakdown {
+	breakdown := TaxBreakdown{
+		OperationType: withholdings[0].OperationType,
+		Date:          withholdings[0].CreatedAt,
+		Lines:         []TaxLine{},
+	}
+	for _, w := range withholdings {
+		breakdown.Lines = append(breakdown.Lines, TaxLine{Tax: w.Tax, Base: w.Base, Amount: w.Amount})
+		breakdown.Total += w.Amount
+	}
+	return breakdown
+}
+
+// taxLedgerAccount returns the internal account that collects a tax until
+// it is paid to the tax authority, creating it on first use.
+func taxLedgerAccount(tx *gorm.DB, tax string) (*Account, error) {
+	number := "TAX-" + tax
+
+	var ledger Account
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("account_number = ?", number).First(&ledger).Error
+	if err == nil {
+		return &ledger, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	ledger = Account{
+		ID:            uuid.New(),
+		AccountNumber: number,
+		HolderName:    "Tax payable - " + tax,
+		Currency:      "BRL",
+		Status:        "active",
+		Type:          "tax_ledger",
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	if err := tx.Create(&ledger).Error; err != nil {
+		return nil, err
+	}
+	return &ledger, nil
+}
+
+func calculateTaxesHandler(c *gin.Context) {
+	var op TaxOperation
+	if err := c.ShouldBindJSON(&op); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, calculateTaxes(db, op))
+}
+
+func getTaxRates(c *gin.Context) {
+	date := time.Now()
+	if v := c.Query("date"); v != "" {
+		parsed, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Date must be YYYY-MM-DD"})
+			return
+		}
+		date = parsed
+	}
+
+	query := db.Where("valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)", date, date)
+	if v := c.Query("operation_type"); v != "" {
+		query = query.Where("operation_type = ?", v)
+	}
+
+	var rates []TaxRate
+	query.Order("operation_type, tax, min_holding_days").Find(&rates)
+
+	c.JSON(http.StatusOK, rates)
+}
+
+// createTaxRate adds a row to the rate tables. A new rate for an operation
+// closes the currently open row of the same tax and holding bracket.
+func createTaxRate(c *gin.Context) {
+	var req struct {
+		Tax            string    `json:"tax" binding:"required,oneof=iof irrf"`
+		OperationType  string    `json:"operation_type" binding:"required"`
+		Basis          string    `json:"basis" binding:"required,oneof=amount gain"`
+		Rate           float64   `json:"rate" binding:"gte=0,lt=1"`
+		DailyRate      float64   `json:"daily_rate" binding:"gte=0,lt=1"`
+		MaxDays        int       `json:"max_days" binding:"gte=0"`
+		MinHoldingDays int       `json:"min_holding_days" binding:"gte=0"`
+		MaxHoldingDays int       `json:"max_holding_days" binding:"gte=0"`
+		Description    string    `json:"description" binding:"required"`
+		ValidFrom      time.Time `json:"valid_from" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rate := TaxRate{
+		ID:             uuid.New(),
+		Tax:            req.Tax,
+		OperationType:  req.OperationType,
+		Basis:          req.Basis,
+		Rate:           req.Rate,
+		DailyRate:      req.DailyRate,
+		MaxDays:        req.MaxDays,
+		MinHoldingDays: req.MinHoldingDays,
+		MaxHoldingDays: req.MaxHoldingDays,
+		Description:    req.Description,
+		ValidFrom:      req.ValidFrom,
+		CreatedAt:      time.Now(),
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&TaxRate{}).
+			Where("tax = ? AND operation_type = ? AND min_holding_days = ? AND max_holding_days = ?",
+				rate.Tax, rate.OperationType, rate.MinHoldingDays, rate.MaxHoldingDays).
+			Where("valid_to IS NULL AND valid_from < ?", rate.ValidFrom).
+			Update("valid_to", rate.ValidFrom).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&rate).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, "create_tax_rate", uuid.Nil, req.Description, rate)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tax rate"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rate)
+}
+
+// withholdTaxesHandler lets other services (e.g. payment-service for FX
+// operations) have taxes computed and collected from an account. It is
+// idempotent by reference: a retry returns what was already withheld.
+func withholdTaxesHandler(c *gin.Context) {
+	var req struct {
+		TaxOperation
+		AccountID string `json:"account_id" binding:"required"`
+		Reference string `json:"reference" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accountID, err := uuid.Parse(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var breakdown TaxBreakdown
+	var withholdings []TaxWithholding
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+
+		// The account lock serializes withholdings from it, so a retry
+		// finds the first attempt's rows.
+		if err := tx.Where("account_id = ? AND reference = ? AND reversed_at IS NULL", account.ID, req.Reference).
+			Order("created_at").Find(&withholdings).Error; err != nil {
+			return err
+		}
+		if len(withholdings) > 0 {
+			breakdown = breakdownOf(withholdings)
+			return nil
+		}
+
+		breakdown = calculateTaxes(tx, req.TaxOperation)
+		if availableBalance(tx, &account) < breakdown.Total {
+			return errInsufficientBalance
+		}
+
+		withholdings, err = withholdTaxes(tx, &account, breakdown, req.Reference)
+		return err
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	case errInsufficientBalance:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance for taxes"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to withhold taxes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"breakdown":    breakdown,
+		"withholdings": withholdings,
+	})
+}
+
+// reverseWithholdingsHandler gives back the taxes withheld under a
+// reference, for an operation that did not go through. Reversing twice
+// has no further effect.
+func reverseWithholdingsHandler(c *gin.Context) {
+	var req struct {
+		AccountID string `json:"account_id" binding:"required"`
+		Reference string `json:"reference" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accountID, err := uuid.Parse(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var withholdings []TaxWithholding
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+			return errAccountNotFound
+		}
+		if err := tx.Where("account_id = ? AND reference = ? AND reversed_at IS NULL", account.ID, req.Reference).
+			Find(&withholdings).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for i := range withholdings {
+			w := &withholdings[i]
+			ledger, err := taxLedgerAccount(tx, w.Tax)
+			if err != nil {
+				return err
+			}
+
+			account.Balance += w.Amount
+			account.UpdatedAt = now
+			ledger.Balance -= w.Amount
+			ledger.UpdatedAt = now
+			if err := tx.Save(&account).Error; err != nil {
+				return err
+			}
+			if err := tx.Save(ledger).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Create(&Transaction{
+				ID:            uuid.New(),
+				FromAccountID: ledger.ID,
+				ToAccountID:   account.ID,
+				Amount:        w.Amount,
+				Currency:      account.Currency,
+				Type:          "tax_withholding_reversal",
+				Status:        "completed",
+				Description:   "Tax reversal - " + w.Reference,
+				CreatedAt:     now,
+			}).Error; err != nil {
+				return err
+			}
+
+			w.ReversedAt = &now
+			if err := tx.Save(w).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	switch err {
+	case nil:
+	case errAccountNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse taxes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reversed": withholdings})
+}
+
+func getTaxReport(c *gin.Context) {
+	userID, err := uuid.Parse(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	month, err := time.Parse("2006-01", c.DefaultQuery("month", time.Now().Format("2006-01")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Month must be YYYY-MM"})
+		return
+	}
+
+	var withholdings []TaxWithholding
+	db.Where("user_id = ? AND created_at >= ? AND created_at < ? AND reversed_at IS NULL", userID, month, month.AddDate(0, 1, 0)).
+		Order("created_at").
+		Find(&withholdings)
+
+	byTax := map[string]int64{}
+	byOperation := map[string]int64{}
+	var total int64
+	for _, w := range withholdings {
+		byTax[w.Tax] += w.Amount
+		byOperation[w.OperationType] += w.Amount
+		total += w.Amount
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":      userID,
+		"month":        month.Format("2006-01"),
+		"total":        total,
+		"by_tax":       byTax,
+		"by_operation": byOperation,
+		"withholdings": withholdings,
+	})
+}
+
+// seedTaxRates loads the default rate tables on an empty database.
+func seedTaxRates() {
+	var count int64
+	db.Model(&TaxRate{}).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	since := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02", s)
+		return t
+	}
+	until := func(s string) *time.Time {
+		t := since(s)
+		return &t
+	}
+
+	rates := []TaxRate{
+		{Tax: taxIOF, OperationType: "credit_pf", Basis: taxBasisAmount, Rate: 0.0038, DailyRate: 0.000082, MaxDays: 365,
+			Description: "IOF credit - individuals", ValidFrom: since("2022-01-01")},
+		{Tax: taxIOF, OperationType: "credit_pj", Basis: taxBasisAmount, Rate: 0.0038, DailyRate: 0.000041, MaxDays: 365,
+			Description: "IOF credit - companies", ValidFrom: since("2022-01-01")},
+		{Tax: taxIOF, OperationType: "fx_card", Basis: taxBasisAmount, Rate: 0.0438,
+			Description: "IOF FX - international card purchases", ValidFrom: since("2024-01-02"), ValidTo: until("2025-01-02")},
+		{Tax: taxIOF, OperationType: "fx_card", Basis: taxBasisAmount, Rate: 0.0338,
+			Description: "IOF FX - international card purchases", ValidFrom: since("2025-01-02"), ValidTo: until("2025-05-23")},
+		{Tax: taxIOF, OperationType: "fx_card", Basis: taxBasisAmount, Rate: 0.035,
+			Description: "IOF FX - international card purchases", ValidFrom: since("2025-05-23")},
+		{Tax: taxIOF, OperationType: "fx_purchase", Basis: taxBasisAmount, Rate: 0.011,
+			Description: "IOF FX - currency purchase", ValidFrom: since("2022-01-01"), ValidTo: until("2025-05-23")},
+		{Tax: taxIOF, OperationType: "fx_purchase", Basis: taxBasisAmount, Rate: 0.035,
+			Description: "IOF FX - currency purchase", ValidFrom: since("2025-05-23")},
+		{Tax: taxIOF, OperationType: "fx_transfer", Basis: taxBasisAmount, Rate: 0.011,
+			Description: "IOF FX - international transfer", ValidFrom: since("2022-01-01"), ValidTo: until("2025-05-23")},
+		{Tax: taxIOF, OperationType: "fx_transfer", Basis: taxBasisAmount, Rate: 0.035,
+			Description: "IOF FX - international transfer", ValidFrom: since("2025-05-23")},
+		{Tax: taxIRRF, OperationType: "investment_redemption", Basis: taxBasisGain, Rate: 0.225, MinHoldingDays: 0, MaxHoldingDays: 180,
+			Description: "IRRF fixed income - up to 180 days", ValidFrom: since("2005-01-01")},
+		{Tax: taxIRRF, OperationType: "investment_redemption", Basis: taxBasisGain, Rate: 0.20, MinHoldingDays: 181, MaxHoldingDays: 360,
+			Description: "IRRF fixed income - 181 to 360 days", ValidFrom: since("2005-01-01")},
+		{Tax: taxIRRF, OperationType: "investment_redemption", Basis: taxBasisGain, Rate: 0.175, MinHoldingDays: 361, MaxHoldingDays: 720,
+			Description: "IRRF fixed income - 361 to 720 days", ValidFrom: since("2005-01-01")},
+		{Tax: taxIRRF, OperationType: "investment_redemption", Basis: taxBasisGain, Rate: 0.15, MinHoldingDays: 721,
+			Description: "IRRF fixed income - over 720 days", ValidFrom: since("2005-01-01")},
+	}
+
+	// Regressive IOF on gains of investments redeemed within 30 days; a
+	// same-day redemption falls in the first bracket.
+	iofRegressive := []float64{96, 93, 90, 86, 83, 80, 76, 73, 70, 66, 63, 60, 56, 53, 50,
+		46, 43, 40, 36, 33, 30, 26, 23, 20, 16, 13, 10, 6, 3}
+	for i, pct := range iofRegressive {
+		day := i + 1
+		minDays := day
+		if day == 1 {
+			minDays = 0
+		}
+		rates = append(rates, TaxRate{
+			Tax: taxIOF, OperationType: "investment_redemption", Basis: taxBasisGain, Rate: pct / 100,
+			MinHoldingDays: minDays, MaxHoldingDays: day,
+			Description: "IOF regressive - redemption under 30 days", ValidFrom: since("2005-01-01"),
+		})
+	}
+
+	for i := range rates {
+		rates[i].ID = uuid.New()
+		rates[i].CreatedAt = time.Now()
+	}
+	db.Create(&rates)
+}
+
+func daysBetween(from, to time.Time) int {
+	days := int(math.Floor(to.Sub(from).Hours() / 24))
+	if days < 0 {
+		return 0
+	}
+	return days
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errUserNotFound             = errors.New("user not found")
+	errUserDirectoryUnavailable = errors.New("user directory unavailable")
+)
+
+// accountTypeKYC lists, per account type, the KYC statuses a user must be
+// in to open it. Simplified payment accounts may be opened while KYC is
+// still under review; deposit accounts require an approved KYC.
+var accountTypeKYC = map[string][]string{
+	"checking": {"approved"},
+	"savings":  {"approved"},
+	"payment":  {"pending", "approved"},
+}
+
+// User is the subset of the auth-service user that account-service needs.
+type User struct {
+	ID             string `json:"id"`
+	FullName       string `json:"full_name"`
+	DocumentNumber string `json:"document_number"`
+	KYCStatus      string `json:"kyc_status"`
+}
+
+type UserDirectory interface {
+	GetUser(ctx context.Context, id uuid.UUID) (*User, error)
+}
+
+var users UserDirectory
+
+// newUserDirectory returns the auth-service client, or an in-memory fake
+// when USER_DIRECTORY=fake. The fake is seeded from FAKE_USERS, a comma
+// separated list of "<uuid>:<kyc_status>" pairs.
+func newUserDirectory() UserDirectory {
+	if getEnv("USER_DIRECTORY", "auth-service") == "fake" {
+		fake := newFakeUserDirectory()
+		for _, entry := range strings.Split(getEnv("FAKE_USERS", ""), ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if id, err := uuid.Parse(parts[0]); err == nil {
+				fake.Add(User{ID: id.String(), KYCStatus: parts[1]})
+			}
+		}
+		return fake
+	}
+
+	return &authServiceClient{
+		baseURL: strings.TrimRight(getEnv("AUTH_SERVICE_URL", "http://localhost:8081"), "/"),
+		token:   getEnv("INTERNAL_API_TOKEN", ""),
+		client:  &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+type authServiceClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func (a *authServiceClient) GetUser(ctx context.Context, id uuid.UUID) (*User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.baseURL+"/internal/users/"+id.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Internal-Token", a.token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUserDirectoryUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errUserNotFound
+	default:
+		return nil, fmt.Errorf("%w: auth-service returned %d", errUserDirectoryUnavailable, resp.StatusCode)
+	}
+
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUserDirectoryUnavailable, err)
+	}
+	return &user, nil
+}
+
+type fakeUserDirectory struct {
+	users map[uuid.UUID]User
+}
+
+func newFakeUserDirectory(seed ...User) *fakeUserDirectory {
+	f := &fakeUserDirectory{users: make(map[uuid.UUID]User)}
+	for _, u := range seed {
+		f.Add(u)
+	}
+	return f
+}
+
+func (f *fakeUserDirectory) Add(u User) {
+	f.users[uuid.MustParse(u.ID)] = u
+}
+
+func (f *fakeUserDirectory) GetUser(_ context.Context, id uuid.UUID) (*User, error) {
+	u, ok := f.users[id]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return &u, nil
+}
+
+func kycPermits(accountType, kycStatus string) bool {
+	for _, status := range accountTypeKYC[accountType] {
+		if status == kycStatus {
+			return true
+		}
+	}
+	return false
+}
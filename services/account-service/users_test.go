@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestKYCPermits(t *testing.T) {
+	cases := []struct {
+		accountType, status string
+		want                bool
+	}{
+		{"checking", "approved", true},
+		{"checking", "pending", false},
+		{"savings", "rejected", false},
+		{"payment", "pending", true},
+		{"payment", "rejected", false},
+		{"brokerage", "approved", false},
+	}
+	for _, tc := range cases {
+		if got := kycPermits(tc.accountType, tc.status); got != tc.want {
+			t.Errorf("kycPermits(%q, %q) = %v, want %v", tc.accountType, tc.status, got, tc.want)
+		}
+	}
+}
+
+// TestCreateAccountChecksUser covers the refusals, which happen before the
+// account is stored.
+func TestCreateAccountChecksUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	pending := uuid.New()
+	users = newFakeUserDirectory(User{ID: pending.String(), KYCStatus: "pending"})
+
+	cases := []struct {
+		userID, accountType string
+		want                int
+	}{
+		{"not-a-uuid", "checking", http.StatusBadRequest},
+		{pending.String(), "brokerage", http.StatusBadRequest},
+		{uuid.NewString(), "checking", http.StatusNotFound},
+		{pending.String(), "checking", http.StatusForbidden},
+		{pending.String(), "savings", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		body, _ := json.Marshal(map[string]string{"user_id": tc.userID, "currency": "BRL", "type": tc.accountType})
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+
+		createAccount(c)
+		if w.Code != tc.want {
+			t.Errorf("%s %s: status %d, want %d", tc.userID, tc.accountType, w.Code, tc.want)
+		}
+	}
+}
@@ -31,6 +31,7 @@ type User struct {
 
 var db *gorm.DB
 var jwtSecret string
+var internalToken string
 
 type RegisterRequest struct {
 	Email          string `json:"email" binding:"required,email"`
@@ -52,6 +53,7 @@ type BiometricAuthRequest struct {
 
 func main() {
 	jwtSecret = getEnv("JWT_SECRET", "ultra-secret-key")
+	internalToken = getEnv("INTERNAL_API_TOKEN", "")
 	dbFile := getEnv("DB_FILE", "baas.db")
 	port := getEnv("PORT", "8081")
 
@@ -72,6 +74,10 @@ func main() {
 	r.POST("/auth/passwordless", passwordlessAuth)
 	r.GET("/health", health)
 
+	internal := r.Group("/internal", requireInternalToken)
+	internal.GET("/users/:id", getInternalUser)
+	internal.PUT("/users/:id/kyc", updateKYCStatus)
+
 	r.Run(":" + port)
 }
 
@@ -212,6 +218,53 @@ func refreshToken(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": newToken})
 }
 
+// requireInternalToken guards endpoints meant for other services only.
+func requireInternalToken(c *gin.Context) {
+	if internalToken == "" || c.GetHeader("X-Internal-Token") != internalToken {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid internal token"})
+		return
+	}
+	c.Next()
+}
+
+func getInternalUser(c *gin.Context) {
+	var user User
+	if err := db.Where("id = ?", c.Param("id")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// updateKYCStatus records the outcome of a KYC review. Users register as
+// pending; the onboarding backend approves or rejects them once their
+// documents are checked.
+func updateKYCStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required,oneof=pending approved rejected"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	if err := db.Where("id = ?", c.Param("id")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	user.KYCStatus = req.Status
+	if err := db.Save(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update KYC status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
 func generateJWT(userID, email string) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id": userID,
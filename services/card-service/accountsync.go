@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	fundingPrepaid = "prepaid"
+	fundingDebit   = "debit"
+	fundingCredit  = "credit"
+)
+
+const (
+	declineInsufficientFunds   = "insufficient_funds"
+	declineIssuerUnavailable   = "issuer_unavailable"
+	accountSyncMaxBackoff      = 5 * time.Minute
+	accountSyncBatchSize       = 100
+	accountSyncOperationHold   = "hold"
+	accountSyncOperationDebit  = "debit"
+	accountSyncOperationCredit = "credit"
+	accountSyncOperationIOF    = "iof"
+	accountSyncOperationFee    = "fee"
+)
+
+var (
+	errInsufficientFunds         = errors.New("insufficient funds")
+	errAccountServiceUnavailable = errors.New("account service unavailable")
+)
+
+// holdClient is used on the authorization path, where a slow account
+// service must not keep the merchant waiting.
+var holdClient = &http.Client{Timeout: holdTimeout()}
+
+var accountSyncKick = make(chan struct{}, 1)
+
+// AccountSyncOperation is an outbox entry for a change card activity must
+// make in account-service: debit card holds and postings, taxes, fees and
+// rewards. Entries are retried until they succeed, so
+// captures are posted and holds released even if account-service was down
+// when the card side changed.
+type AccountSyncOperation struct {
+	ID              uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	AuthorizationID uuid.UUID `json:"authorization_id" gorm:"type:uuid;index"`
+	AccountID       uuid.UUID `json:"account_id" gorm:"type:uuid"`
+	Kind            string    `json:"kind"`
+	// CaptureID is the capture a debit posts, or the refund event a
+	// credit posts; it becomes the account transaction ID.
+	CaptureID     uuid.UUID `json:"capture_id" gorm:"type:uuid"`
+	Amount        int64     `json:"amount"`
+	Description   string    `json:"description"`
+	Status        string    `json:"status" gorm:"index"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func holdTimeout() time.Duration {
+	ms, err := strconv.Atoi(getEnv("ACCOUNT_HOLD_TIMEOUT_MS", "2000"))
+	if err != nil || ms <= 0 {
+		ms = 2000
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// callAccountService sends an internal request to account-service. Network
+// errors and 5xx responses leave the outcome unknown and are reported as
+// errAccountServiceUnavailable.
+func callAccountService(client *http.Client, method, path string, body interface{}) (int, error) {
+	return callAccountServiceJSON(client, method, path, body, nil)
+}
+
+// callAccountServiceJSON is callAccountService decoding a successful
+// response into out.
+func callAccountServiceJSON(client *http.Client, method, path string, body, out interface{}) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(method, accountServiceURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Token", internalToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errAccountServiceUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return resp.StatusCode, fmt.Errorf("%w: status %d", errAccountServiceUnavailable, resp.StatusCode)
+	}
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// setAccountHold sets the account hold backing an authorization to amount.
+func setAccountHold(client *http.Client, accountID, authorizationID uuid.UUID, amount int64, expiresAt time.Time) error {
+	status, err := callAccountService(client, http.MethodPut, "/internal/holds", map[string]interface{}{
+		"account_id": accountID.String(),
+		"source":     "card",
+		"reference":  authorizationID.String(),
+		"amount":     amount,
+		"expires_at": expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusConflict:
+		return errInsufficientFunds
+	case status >= 300:
+		return fmt.Errorf("setting hold returned %d", status)
+	}
+	return nil
+}
+
+// reserveFunds holds amount on the debit card's account for the
+// authorization, synchronously, as part of approving it. When the outcome
+// is unknown a hold may have been placed anyway, so a sync is queued that
+// brings it back in line with the authorization, or releases it if the
+// authorization was never recorded.
+func reserveFunds(card *Card, auth *CardAuthorization, amount int64) error {
+	err := setAccountHold(holdClient, card.AccountID, auth.ID, amount, auth.ExpiresAt)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errInsufficientFunds):
+		return decline(declineInsufficientFunds, "Insufficient funds")
+	default:
+		log.Printf("reserving funds for authorization %s failed: %v", auth.ID, err)
+		if qerr := enqueueHoldSync(db, card, auth.ID); qerr != nil {
+			log.Printf("queueing hold sync for authorization %s failed: %v", auth.ID, qerr)
+		}
+		kickAccountSync()
+		return decline(declineIssuerUnavailable, "Account service unavailable")
+	}
+}
+
+// reserveFundsThen places the hold and then runs record, which records
+// what the hold backs. If record fails after the hold was placed, a sync
+// is queued that brings the hold back in line with the authorization.
+func reserveFundsThen(card *Card, auth *CardAuthorization, amount int64, record func() error) error {
+	if err := reserveFunds(card, auth, amount); err != nil {
+		return err
+	}
+	if err := record(); err != nil {
+		if qerr := enqueueHoldSync(db, card, auth.ID); qerr != nil {
+			log.Printf("queueing hold sync for authorization %s failed: %v", auth.ID, qerr)
+		}
+		kickAccountSync()
+		return err
+	}
+	return nil
+}
+
+func enqueueHoldSync(tx *gorm.DB, card *Card, authorizationID uuid.UUID) error {
+	now := time.Now()
+	return tx.Create(&AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: authorizationID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationHold,
+		Status:          "pending",
+		NextAttemptAt:   now,
+		CreatedAt:       now,
+	}).Error
+}
+
+func enqueueDebit(tx *gorm.DB, card *Card, auth *CardAuthorization, capture *CardCapture) error {
+	return tx.Create(&AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationDebit,
+		CaptureID:       capture.ID,
+		Amount:          capture.Amount,
+		Description:     "Card purchase - " + auth.MerchantID,
+		Status:          "pending",
+		NextAttemptAt:   capture.CreatedAt,
+		CreatedAt:       capture.CreatedAt,
+	}).Error
+}
+
+// enqueueCredit queues the account credit for a debit card refund.
+func enqueueCredit(tx *gorm.DB, card *Card, auth *CardAuthorization, refund *CardTransaction) error {
+	return tx.Create(&AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationCredit,
+		CaptureID:       refund.ID,
+		Amount:          refund.Amount,
+		Description:     "Card refund - " + auth.MerchantID,
+		Status:          "pending",
+		NextAttemptAt:   refund.CreatedAt,
+		CreatedAt:       refund.CreatedAt,
+	}).Error
+}
+
+func kickAccountSync() {
+	select {
+	case accountSyncKick <- struct{}{}:
+	default:
+	}
+}
+
+func startAccountSync(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runAccountSync(time.Now())
+			select {
+			case <-ticker.C:
+			case <-accountSyncKick:
+			}
+		}
+	}()
+}
+
+// runAccountSync delivers due operations in the order they were queued. An
+// authorization's later operations wait until its earlier ones succeed, so
+// a capture is always posted before the hold it consumed is reduced.
+func runAccountSync(now time.Time) {
+	var ops []AccountSyncOperation
+	db.Where("status = ?", "pending").
+		Order("created_at, kind").
+		Limit(accountSyncBatchSize).
+		Find(&ops)
+
+	blocked := map[uuid.UUID]bool{}
+	for i := range ops {
+		op := &ops[i]
+		if blocked[op.AuthorizationID] {
+			continue
+		}
+		if op.NextAttemptAt.After(now) {
+			blocked[op.AuthorizationID] = true
+			continue
+		}
+
+		if err := deliverAccountSync(op); err != nil {
+			blocked[op.AuthorizationID] = true
+			op.Attempts++
+			op.LastError = err.Error()
+			backoff := time.Duration(1<<uint(min(op.Attempts, 9))) * time.Second
+			if backoff > accountSyncMaxBackoff {
+				backoff = accountSyncMaxBackoff
+			}
+			op.NextAttemptAt = now.Add(backoff)
+			db.Save(op)
+			continue
+		}
+
+		op.Status = "done"
+		op.LastError = ""
+		db.Save(op)
+	}
+}
+
+func deliverAccountSync(op *AccountSyncOperation) error {
+	switch op.Kind {
+	case accountSyncOperationDebit, accountSyncOperationFee:
+		kind := "card_purchase"
+		if op.Kind == accountSyncOperationFee {
+			kind = "card_fee"
+		}
+		status, err := callAccountService(internalClient, http.MethodPost, "/internal/debits", map[string]interface{}{
+			"id":          op.CaptureID.String(),
+			"account_id":  op.AccountID.String(),
+			"amount":      op.Amount,
+			"type":        kind,
+			"description": op.Description,
+		})
+		if err != nil {
+			return err
+		}
+		if status >= 300 {
+			return fmt.Errorf("posting debit returned %d", status)
+		}
+		return nil
+
+	case accountSyncOperationCredit:
+		status, err := callAccountService(internalClient, http.MethodPost, "/internal/credits", map[string]interface{}{
+			"id":          op.CaptureID.String(),
+			"account_id":  op.AccountID.String(),
+			"amount":      op.Amount,
+			"type":        "card_refund",
+			"description": op.Description,
+		})
+		if err != nil {
+			return err
+		}
+		if status >= 300 {
+			return fmt.Errorf("posting credit returned %d", status)
+		}
+		return nil
+
+	case accountSyncOperationIOF:
+		return deliverIOF(op)
+
+	case accountSyncOperationRewardsAccrual, accountSyncOperationRewardsReversal:
+		return deliverRewards(op)
+
+	case accountSyncOperationHold:
+		// The hold always follows the authorization's current state; an
+		// authorization that was rolled back holds nothing.
+		var auth CardAuthorization
+		amount := int64(0)
+		expiresAt := time.Now()
+		if err := db.Where("id = ?", op.AuthorizationID).Limit(1).Find(&auth).Error; err != nil {
+			return err
+		}
+		if auth.ID != uuid.Nil {
+			amount = auth.remaining()
+			expiresAt = auth.ExpiresAt
+		}
+		err := setAccountHold(internalClient, op.AccountID, op.AuthorizationID, amount, expiresAt)
+		if errors.Is(err, errInsufficientFunds) {
+			// Only increases can be refused, and the authorization already
+			// holds what it was approved for.
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("unknown operation kind %q", op.Kind)
+}
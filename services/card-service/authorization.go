@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Decline reason codes returned with every refused authorization.
+const (
+	declineCardInactive        = "card_inactive"
+	declineCardExpired         = "card_expired"
+	declineInvalidExpiry       = "invalid_expiry"
+	declineCVVRequired         = "cvv_required"
+	declineInvalidCVV          = "invalid_cvv"
+	declineMerchantLocked      = "merchant_locked"
+	declineLimitExceeded       = "limit_exceeded"
+	declineMCCBlocked          = "mcc_blocked"
+	declineMCCNotAllowed       = "mcc_not_allowed"
+	declineCountryNotAllowed   = "country_not_allowed"
+	declineChannelDisabled     = "channel_disabled"
+	declineOutsideTimeWindow   = "outside_time_window"
+	declineTransactionMaxLimit = "transaction_max_exceeded"
+)
+
+var errCardNotFound = errors.New("card not found")
+
+// declineError is a refusal of an authorization for a business reason, as
+// opposed to a failure to process it.
+type declineError struct {
+	Code    string
+	Message string
+}
+
+func (e *declineError) Error() string {
+	return e.Message
+}
+
+func decline(code, message string) *declineError {
+	return &declineError{Code: code, Message: message}
+}
+
+// authorizationRequest is an authorization as received from any channel,
+// independent of the transport it arrived on.
+type authorizationRequest struct {
+	CardID      uuid.UUID
+	Amount      int64
+	MerchantID  string
+	Category    string
+	MCC         string
+	Country     string
+	Channel     string
+	Description string
+	CVV         string
+	CAVV        string
+	PINBlock    string
+	PINFormat   int
+
+	// Expiry is the MM/YY the merchant read from the card, when sent.
+	Expiry string
+
+	// Installments above one split a credit card purchase into a plan.
+	Installments    int
+	InstallmentType string
+
+	// Set for authorizations received over ISO 8583, to match reversals.
+	RetrievalRef string
+	NetworkRef   string
+}
+
+type authorizationResult struct {
+	Card          Card
+	Authorization CardAuthorization
+	TransactionID string
+}
+
+// processAuthorization runs every check on an authorization and, when it
+// is approved, records it and consumes the card limit. The card row is
+// locked for the duration so concurrent authorizations see each other's
+// spend. Debit cards also reserve the amount on their account; the hold is
+// placed after the checks, without the card locked, and the card's state
+// is checked again when the authorization is recorded.
+func processAuthorization(req authorizationRequest) (*authorizationResult, error) {
+	now := time.Now()
+
+	var card Card
+	var auth CardAuthorization
+	var fraud *FraudDecision
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, req.CardID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errCardNotFound
+			}
+			return err
+		}
+
+		// Every attempt is scored, so declined ones count towards the
+		// rules, but the fraud decision applies after the card's own
+		// checks so those report their specific reason.
+		fraud = evaluateFraud(tx, &card, req, now)
+
+		if d := checkCard(&card, req, now); d != nil {
+			return d
+		}
+		if exceedsCardLimit(tx, &card, req.Amount) {
+			return decline(declineLimitExceeded, "Transaction exceeds card limit")
+		}
+		if err := checkPIN(&card, req); err != nil {
+			return err
+		}
+
+		var controls CardControls
+		if err := tx.Where("card_id = ?", card.ID).Limit(1).Find(&controls).Error; err != nil {
+			return err
+		}
+		if controls.CardID != uuid.Nil {
+			if d := evaluateControls(&controls, req, now); d != nil {
+				return d
+			}
+		}
+		if err := checkProduct(tx, &card, req); err != nil {
+			return err
+		}
+		if err := checkPeriodicLimits(tx, &card, req.Amount, now); err != nil {
+			return err
+		}
+
+		if err := checkAuthenticationValue(tx, &card, req, now); err != nil {
+			return err
+		}
+
+		if fraud.Decision == fraudDecline {
+			return decline(declineSuspectedFraud, "Transaction declined as suspected fraud")
+		}
+
+		auth = CardAuthorization{
+			ID:           uuid.New(),
+			CardID:       card.ID,
+			MerchantID:   req.MerchantID,
+			MCC:          req.MCC,
+			Category:     req.Category,
+			Country:      req.Country,
+			Channel:      req.Channel,
+			Description:  req.Description,
+			ApprovalCode: approvalCode(),
+			RetrievalRef: req.RetrievalRef,
+			NetworkRef:   req.NetworkRef,
+			Amount:       req.Amount,
+			RiskScore:    fraud.Score,
+			FraudReview:  fraud.Decision == fraudReview,
+			Status:       authStatusAuthorized,
+			ExpiresAt:    now.Add(authorizationTTL()),
+			CreatedAt:    now,
+		}
+
+		if card.Funding == fundingDebit {
+			return nil
+		}
+		return recordAuthorization(tx, &card, &auth, req, now)
+	})
+	if err == nil && card.Funding == fundingDebit {
+		err = reserveFundsThen(&card, &auth, req.Amount, func() error {
+			return db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, req.CardID).Error; err != nil {
+					return err
+				}
+				if d := checkCard(&card, req, now); d != nil {
+					return d
+				}
+				if err := checkPeriodicLimits(tx, &card, req.Amount, now); err != nil {
+					return err
+				}
+				return recordAuthorization(tx, &card, &auth, req, now)
+			})
+		})
+	}
+	logFraudDecision(fraud, &auth, err)
+	if err != nil {
+		var d *declineError
+		if errors.As(err, &d) {
+			recordDecline(req, d, now)
+		}
+		return nil, err
+	}
+
+	transactionID := auth.ID.String()
+	kickAccountSync()
+
+	return &authorizationResult{Card: card, Authorization: auth, TransactionID: transactionID}, nil
+}
+
+// recordAuthorization consumes the card limit for an approved
+// authorization and records it, on the locked card.
+func recordAuthorization(tx *gorm.DB, card *Card, auth *CardAuthorization, req authorizationRequest, now time.Time) error {
+	card.SpentAmount += req.Amount
+	if err := applyUsageRules(tx, card, req.MerchantID); err != nil {
+		return err
+	}
+	if err := tx.Save(card).Error; err != nil {
+		return err
+	}
+	if err := tx.Create(auth).Error; err != nil {
+		return err
+	}
+	if req.Installments > 1 {
+		if err := createInstallmentPlan(tx, card, auth, req); err != nil {
+			return err
+		}
+	}
+	if err := enqueueRewardsAccrual(tx, card, auth, now); err != nil {
+		return err
+	}
+	_, err := recordAuthorizationEvent(tx, auth, txnAuthorization, auth.Amount, now)
+	return err
+}
+
+// exceedsCardLimit applies the card's overall limit, shared with the
+// cards it replaced. Debit cards spend the account balance, which their
+// holds check, and captures never give their limit back, so only periodic
+// limits apply to them.
+func exceedsCardLimit(tx *gorm.DB, card *Card, amount int64) bool {
+	return card.Funding != fundingDebit && lineageSpent(tx, card)+amount > card.Limit
+}
+
+// checkCard applies the checks that depend only on the card itself.
+func checkCard(card *Card, req authorizationRequest, now time.Time) *declineError {
+	if d := checkCardUsable(card, now); d != nil {
+		return d
+	}
+	if req.Expiry != "" && req.Expiry != card.ExpiryDate {
+		return decline(declineInvalidExpiry, "Expiry date does not match the card")
+	}
+	if card.CVVMode == cvvModeDynamic && req.CVV == "" {
+		return decline(declineCVVRequired, "CVV required")
+	}
+	if req.CVV != "" && !validCVV(card, req.CVV) {
+		return decline(declineInvalidCVV, "Invalid CVV")
+	}
+	if card.LockedMerchantID != "" && card.LockedMerchantID != req.MerchantID {
+		return decline(declineMerchantLocked, "Card is locked to another merchant")
+	}
+	return nil
+}
+
+// checkCardUsable declines cards that cannot be charged at all: not
+// active, or past their expiry even if not yet swept by the expiry job.
+func checkCardUsable(card *Card, now time.Time) *declineError {
+	switch card.Status {
+	case cardStatusActive:
+	case cardStatusLost:
+		return decline(declineCardLost, "Card reported lost")
+	case cardStatusStolen:
+		return decline(declineCardStolen, "Card reported stolen")
+	case cardStatusExpired:
+		return decline(declineCardExpired, "Card expired")
+	default:
+		return decline(declineCardInactive, "Card is not active")
+	}
+	if cardExpired(card, now) {
+		return decline(declineCardExpired, "Card expired")
+	}
+	return nil
+}
+
+func respondAuthorizationError(c *gin.Context, err error) {
+	var d *declineError
+	switch {
+	case errors.As(err, &d):
+		c.JSON(http.StatusForbidden, gin.H{
+			"authorized":   false,
+			"error":        d.Message,
+			"decline_code": d.Code,
+		})
+	case errors.Is(err, errCardNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authorize transaction"})
+	}
+}
+
+// approvalCode returns a six character authorization code, the value
+// returned to acquirers and later quoted back in clearing.
+func approvalCode() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ0123456789"
+	b := make([]byte, 6)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExceedsCardLimit(t *testing.T) {
+	cases := []struct {
+		funding string
+		spent   int64
+		want    bool
+	}{
+		{fundingCredit, 7000, false},
+		{fundingCredit, 7001, true},
+		{fundingPrepaid, 9000, true},
+		// Debit spend is checked against the account balance by the hold.
+		{fundingDebit, 50000, false},
+	}
+	for _, tc := range cases {
+		// Without a replaced card the lineage is the card alone and no
+		// query is made.
+		card := Card{Status: cardStatusActive, ExpiryDate: "12/30", Funding: tc.funding, Limit: 10000, SpentAmount: tc.spent}
+		if got := exceedsCardLimit(nil, &card, 3000); got != tc.want {
+			t.Errorf("%s card with %d spent: exceeds %v, want %v", tc.funding, tc.spent, got, tc.want)
+		}
+	}
+}
+
+func TestCheckCardStatus(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	req := authorizationRequest{Amount: 100, MerchantID: "m1"}
+
+	cases := map[string]string{
+		cardStatusActive:   "",
+		cardStatusInactive: declineCardInactive,
+		cardStatusBlocked:  declineCardInactive,
+		cardStatusLost:     declineCardLost,
+		cardStatusStolen:   declineCardStolen,
+		cardStatusExpired:  declineCardExpired,
+	}
+	for status, want := range cases {
+		card := Card{Status: status, ExpiryDate: "12/30", Funding: fundingCredit, Limit: 10000}
+		d := checkCard(&card, req, now)
+		got := ""
+		if d != nil {
+			got = d.Code
+		}
+		if got != want {
+			t.Errorf("status %s: decline %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestCheckCardMerchantLock(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	card := Card{Status: cardStatusActive, ExpiryDate: "12/30", Funding: fundingCredit, Limit: 10000, LockedMerchantID: "m1"}
+
+	if d := checkCard(&card, authorizationRequest{Amount: 100, MerchantID: "m1"}, now); d != nil {
+		t.Errorf("locked merchant declined: %v", d.Code)
+	}
+	if d := checkCard(&card, authorizationRequest{Amount: 100, MerchantID: "m2"}, now); d == nil || d.Code != declineMerchantLocked {
+		t.Errorf("other merchant: %v, want %s", d, declineMerchantLocked)
+	}
+}
+
+func TestCheckCardExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	card := Card{Status: cardStatusActive, ExpiryDate: "12/30", Funding: fundingCredit, Limit: 10000}
+
+	if d := checkCard(&card, authorizationRequest{Amount: 100, MerchantID: "m1", Expiry: "12/30"}, now); d != nil {
+		t.Errorf("matching expiry declined: %v", d.Code)
+	}
+	if d := checkCard(&card, authorizationRequest{Amount: 100, MerchantID: "m1", Expiry: "11/30"}, now); d == nil || d.Code != declineInvalidExpiry {
+		t.Errorf("wrong expiry: %v, want %s", d, declineInvalidExpiry)
+	}
+
+	card.ExpiryDate = "09/26"
+	if d := checkCard(&card, authorizationRequest{Amount: 100, MerchantID: "m1", Expiry: "09/26"}, now); d == nil || d.Code != declineCardExpired {
+		t.Errorf("past expiry: %v, want %s", d, declineCardExpired)
+	}
+}
+
+func TestCheckCardUsable(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+
+	cases := []struct {
+		name string
+		card Card
+		want string
+	}{
+		{"active", Card{Status: cardStatusActive, ExpiryDate: "12/30"}, ""},
+		{"lost", Card{Status: cardStatusLost, ExpiryDate: "12/30"}, declineCardLost},
+		{"stolen", Card{Status: cardStatusStolen, ExpiryDate: "12/30"}, declineCardStolen},
+		{"blocked", Card{Status: cardStatusBlocked, ExpiryDate: "12/30"}, declineCardInactive},
+		{"past expiry date, not yet swept", Card{Status: cardStatusActive, ExpiryDate: "09/26"}, declineCardExpired},
+		{"past custom expiry, not yet swept", Card{Status: cardStatusActive, ExpiryDate: "12/30", ExpiresAt: &past}, declineCardExpired},
+	}
+	for _, tc := range cases {
+		got := ""
+		if d := checkCardUsable(&tc.card, now); d != nil {
+			got = d.Code
+		}
+		if got != tc.want {
+			t.Errorf("%s: decline %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
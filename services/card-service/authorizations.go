@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	authStatusAuthorized        = "authorized"
+	authStatusPartiallyCaptured = "partially_captured"
+	authStatusCaptured          = "captured"
+	authStatusVoided            = "voided"
+	authStatusReversed          = "reversed"
+	authStatusExpired           = "expired"
+)
+
+var (
+	errAuthorizationNotFound  = errors.New("authorization not found")
+	errAuthorizationNotOpen   = errors.New("authorization is not open")
+	errAuthorizationCaptured  = errors.New("authorization already has captures")
+	errAmountExceedsRemaining = errors.New("amount exceeds the open authorization amount")
+)
+
+// CardAuthorization is an approved authorization and what became of it.
+// Amount is everything authorized so far, incremental authorizations
+// included; the part neither captured nor released still holds card limit.
+type CardAuthorization struct {
+	ID             uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	CardID         uuid.UUID  `json:"card_id" gorm:"type:uuid;index"`
+	MerchantID     string     `json:"merchant_id"`
+	MCC            string     `json:"mcc,omitempty"`
+	Category       string     `json:"category,omitempty"`
+	Country        string     `json:"country,omitempty"`
+	Channel        string     `json:"channel,omitempty"`
+	Description    string     `json:"description,omitempty"`
+	ApprovalCode   string     `json:"approval_code"`
+	RetrievalRef   string     `json:"retrieval_reference,omitempty"`
+	NetworkRef     string     `json:"network_reference,omitempty" gorm:"index"`
+	Amount         int64      `json:"amount"`
+	RiskScore      int        `json:"risk_score"`
+	FraudReview    bool       `json:"fraud_review"`
+	CapturedAmount int64      `json:"captured_amount"`
+	ReleasedAmount int64      `json:"released_amount"`
+	RefundedAmount int64      `json:"refunded_amount"`
+	Status         string     `json:"status" gorm:"index"`
+	ExpiresAt      time.Time  `json:"expires_at" gorm:"index"`
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// CardCapture is one capture against an authorization. An authorization
+// may be captured several times, up to its amount.
+type CardCapture struct {
+	ID              uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	AuthorizationID uuid.UUID `json:"authorization_id" gorm:"type:uuid;index"`
+	Amount          int64     `json:"amount"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (a *CardAuthorization) open() bool {
+	return a.Status == authStatusAuthorized || a.Status == authStatusPartiallyCaptured
+}
+
+// remaining is the part of the authorization still holding card limit.
+func (a *CardAuthorization) remaining() int64 {
+	return a.Amount - a.CapturedAmount - a.ReleasedAmount
+}
+
+func authorizationTTL() time.Duration {
+	days, err := strconv.Atoi(getEnv("AUTHORIZATION_EXPIRY_DAYS", "7"))
+	if err != nil || days <= 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// releaseAuthorization gives amount of the authorization back to the card
+// limit and closes the authorization once nothing remains open.
+func releaseAuthorization(card *Card, auth *CardAuthorization, amount int64, closedStatus string, now time.Time) {
+	auth.ReleasedAmount += amount
+	card.SpentAmount -= amount
+	if auth.remaining() == 0 {
+		auth.Status = closedStatus
+		if auth.CapturedAmount > 0 && closedStatus != authStatusExpired {
+			auth.Status = authStatusCaptured
+		}
+		auth.ClosedAt = &now
+	}
+}
+
+// updateAuthorization locks the authorization's card and then the
+// authorization itself, in the same order processAuthorization locks the
+// card, and applies fn to both. For debit cards the account hold is then
+// brought in line with what the authorization still holds.
+func updateAuthorization(id uuid.UUID, fn func(tx *gorm.DB, card *Card, auth *CardAuthorization) error) (*CardAuthorization, error) {
+	return lockAuthorization(id, (*CardAuthorization).open, fn)
+}
+
+// lockAuthorization is updateAuthorization for authorizations in the
+// states accept allows.
+func lockAuthorization(id uuid.UUID, accept func(*CardAuthorization) bool, fn func(tx *gorm.DB, card *Card, auth *CardAuthorization) error) (*CardAuthorization, error) {
+	var auth CardAuthorization
+	debit := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&auth, id).Error; err != nil {
+			return errAuthorizationNotFound
+		}
+
+		var card Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, auth.CardID).Error; err != nil {
+			return errCardNotFound
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&auth, id).Error; err != nil {
+			return errAuthorizationNotFound
+		}
+		if !accept(&auth) {
+			return errAuthorizationNotOpen
+		}
+
+		if err := fn(tx, &card, &auth); err != nil {
+			return err
+		}
+		if err := tx.Save(&card).Error; err != nil {
+			return err
+		}
+		if err := tx.Save(&auth).Error; err != nil {
+			return err
+		}
+		if card.Funding == fundingDebit {
+			debit = true
+			return enqueueHoldSync(tx, &card, auth.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if debit {
+		kickAccountSync()
+	}
+	return &auth, nil
+}
+
+// incrementAuthorization raises the authorization by amount. Debit cards
+// hold the raised amount first, without the card locked; the hold sync
+// queued with the increment then corrects it for anything that changed
+// meanwhile.
+func incrementAuthorization(id uuid.UUID, amount int64) (*CardAuthorization, error) {
+	increment := func() (*CardAuthorization, error) {
+		return updateAuthorization(id, func(tx *gorm.DB, card *Card, auth *CardAuthorization) error {
+			if d := checkCardUsable(card, time.Now()); d != nil {
+				return d
+			}
+			if exceedsCardLimit(tx, card, amount) {
+				return decline(declineLimitExceeded, "Transaction exceeds card limit")
+			}
+			if err := checkPeriodicLimits(tx, card, amount, time.Now()); err != nil {
+				return err
+			}
+
+			auth.ExpiresAt = time.Now().Add(authorizationTTL())
+			card.SpentAmount += amount
+			auth.Amount += amount
+			_, err := recordAuthorizationEvent(tx, auth, txnIncrement, amount, time.Now())
+			return err
+		})
+	}
+
+	var auth CardAuthorization
+	if err := db.First(&auth, id).Error; err != nil {
+		return nil, errAuthorizationNotFound
+	}
+	var card Card
+	if err := db.First(&card, auth.CardID).Error; err != nil {
+		return nil, errCardNotFound
+	}
+	if card.Funding != fundingDebit {
+		return increment()
+	}
+	if !auth.open() {
+		return nil, errAuthorizationNotOpen
+	}
+	if d := checkCardUsable(&card, time.Now()); d != nil {
+		return nil, d
+	}
+
+	auth.ExpiresAt = time.Now().Add(authorizationTTL())
+	var updated *CardAuthorization
+	err := reserveFundsThen(&card, &auth, auth.remaining()+amount, func() error {
+		var err error
+		updated, err = increment()
+		return err
+	})
+	return updated, err
+}
+
+// captureAuthorization settles amount of the authorization. A final
+// capture releases whatever is left uncaptured.
+func captureAuthorization(id uuid.UUID, amount int64, final bool) (*CardAuthorization, error) {
+	return updateAuthorization(id, func(tx *gorm.DB, card *Card, auth *CardAuthorization) error {
+		if amount > auth.remaining() {
+			return errAmountExceedsRemaining
+		}
+		return postCapture(tx, card, auth, amount, final, time.Now())
+	})
+}
+
+// postCapture records a capture on the locked card and authorization.
+func postCapture(tx *gorm.DB, card *Card, auth *CardAuthorization, amount int64, final bool, now time.Time) error {
+	capture := CardCapture{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		Amount:          amount,
+		CreatedAt:       now,
+	}
+	if err := tx.Create(&capture).Error; err != nil {
+		return err
+	}
+	if card.Funding == fundingDebit {
+		if err := enqueueDebit(tx, card, auth, &capture); err != nil {
+			return err
+		}
+	}
+	if international(auth) {
+		if err := enqueueIOF(tx, card, auth, &capture); err != nil {
+			return err
+		}
+		product, err := cardProduct(tx, card)
+		if err != nil {
+			return err
+		}
+		if _, err := chargeCardFee(tx, card, auth, "International purchase fee - "+auth.MerchantID,
+			internationalFee(product, auth, amount), now); err != nil {
+			return err
+		}
+	}
+
+	auth.CapturedAmount += amount
+	auth.Status = authStatusPartiallyCaptured
+	if final || auth.remaining() == 0 {
+		releaseAuthorization(card, auth, auth.remaining(), authStatusCaptured, now)
+		if card.Funding == fundingCredit {
+			if err := settleInstallmentPlan(tx, auth, amount, now); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := recordAuthorizationEvent(tx, auth, txnCapture, amount, now)
+	return err
+}
+
+// voidAuthorization cancels an authorization that was never captured.
+func voidAuthorization(id uuid.UUID) (*CardAuthorization, error) {
+	return updateAuthorization(id, func(tx *gorm.DB, card *Card, auth *CardAuthorization) error {
+		if auth.CapturedAmount > 0 {
+			return errAuthorizationCaptured
+		}
+		now := time.Now()
+		amount := auth.remaining()
+		releaseAuthorization(card, auth, amount, authStatusVoided, now)
+		event, err := recordAuthorizationEvent(tx, auth, txnVoid, amount, now)
+		if err != nil {
+			return err
+		}
+		if err := reopenSingleUseCard(tx, card, auth, now); err != nil {
+			return err
+		}
+		return enqueueRewardsReversal(tx, card, auth, event.ID, amount, now)
+	})
+}
+
+// reverseAuthorization releases amount of the uncaptured part, or all of
+// it when amount is zero.
+func reverseAuthorization(id uuid.UUID, amount int64) (*CardAuthorization, error) {
+	return updateAuthorization(id, func(tx *gorm.DB, card *Card, auth *CardAuthorization) error {
+		if amount == 0 {
+			amount = auth.remaining()
+		}
+		if amount > auth.remaining() {
+			return errAmountExceedsRemaining
+		}
+		now := time.Now()
+		releaseAuthorization(card, auth, amount, authStatusReversed, now)
+		event, err := recordAuthorizationEvent(tx, auth, txnReversal, amount, now)
+		if err != nil {
+			return err
+		}
+		if err := reopenSingleUseCard(tx, card, auth, now); err != nil {
+			return err
+		}
+		return enqueueRewardsReversal(tx, card, auth, event.ID, amount, now)
+	})
+}
+
+func getAuthorization(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid authorization ID"})
+		return
+	}
+
+	var auth CardAuthorization
+	if err := db.First(&auth, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authorization not found"})
+		return
+	}
+
+	var captures []CardCapture
+	db.Where("authorization_id = ?", auth.ID).Order("created_at").Find(&captures)
+
+	c.JSON(http.StatusOK, gin.H{
+		"authorization": auth,
+		"captures":      captures,
+	})
+}
+
+func getCardAuthorizations(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	query := db.Where("card_id = ?", cardID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var auths []CardAuthorization
+	query.Order("created_at DESC").Find(&auths)
+
+	c.JSON(http.StatusOK, auths)
+}
+
+func incrementAuthorizationHandler(c *gin.Context) {
+	var req struct {
+		Amount int64 `json:"amount" binding:"required,gt=0"`
+	}
+	handleAuthorizationUpdate(c, &req, func(id uuid.UUID) (*CardAuthorization, error) {
+		return incrementAuthorization(id, req.Amount)
+	})
+}
+
+func captureAuthorizationHandler(c *gin.Context) {
+	var req struct {
+		Amount int64 `json:"amount" binding:"required,gt=0"`
+		Final  bool  `json:"final"`
+	}
+	handleAuthorizationUpdate(c, &req, func(id uuid.UUID) (*CardAuthorization, error) {
+		return captureAuthorization(id, req.Amount, req.Final)
+	})
+}
+
+func voidAuthorizationHandler(c *gin.Context) {
+	handleAuthorizationUpdate(c, nil, voidAuthorization)
+}
+
+func reverseAuthorizationHandler(c *gin.Context) {
+	var req struct {
+		Amount int64 `json:"amount" binding:"gte=0"`
+	}
+	handleAuthorizationUpdate(c, &req, func(id uuid.UUID) (*CardAuthorization, error) {
+		return reverseAuthorization(id, req.Amount)
+	})
+}
+
+// handleAuthorizationUpdate binds the optional request body, runs the
+// lifecycle operation and maps its errors to responses.
+func handleAuthorizationUpdate(c *gin.Context, req interface{}, op func(uuid.UUID) (*CardAuthorization, error)) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid authorization ID"})
+		return
+	}
+
+	if req != nil && c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	auth, err := op(id)
+	var d *declineError
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, auth)
+	case errors.As(err, &d):
+		c.JSON(http.StatusForbidden, gin.H{"error": d.Message, "decline_code": d.Code})
+	case errors.Is(err, errAuthorizationNotFound), errors.Is(err, errCardNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authorization not found"})
+	case errors.Is(err, errAuthorizationNotOpen), errors.Is(err, errAuthorizationCaptured):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errAmountExceedsRemaining), errors.Is(err, errAmountExceedsRefundable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update authorization"})
+	}
+}
+
+func startAuthorizationExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			expireAuthorizations(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// expireAuthorizations releases the uncaptured part of authorizations that
+// were not captured in time.
+func expireAuthorizations(now time.Time) {
+	var due []CardAuthorization
+	db.Where("status IN ? AND expires_at <= ?",
+		[]string{authStatusAuthorized, authStatusPartiallyCaptured}, now).
+		Find(&due)
+
+	for _, auth := range due {
+		updateAuthorization(auth.ID, func(tx *gorm.DB, card *Card, auth *CardAuthorization) error {
+			amount := auth.remaining()
+			releaseAuthorization(card, auth, amount, authStatusExpired, now)
+			// What was captured before expiry is final, so an installment
+			// purchase starts billing on it.
+			if card.Funding == fundingCredit {
+				if err := activateInstallmentPlan(tx, auth, now); err != nil {
+					return err
+				}
+			}
+			event, err := recordAuthorizationEvent(tx, auth, txnExpiry, amount, now)
+			if err != nil {
+				return err
+			}
+			if err := reopenSingleUseCard(tx, card, auth, now); err != nil {
+				return err
+			}
+			return enqueueRewardsReversal(tx, card, auth, event.ID, amount, now)
+		})
+	}
+}
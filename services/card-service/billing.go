@@ -0,0 +1,760 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	invoiceClosed        = "closed"
+	invoicePartiallyPaid = "partially_paid"
+	invoicePaid          = "paid"
+	invoiceOverdue       = "overdue"
+	invoiceRolledOver    = "rolled_over"
+
+	invoicePaymentPending   = "pending"
+	invoicePaymentCompleted = "completed"
+	invoicePaymentFailed    = "failed"
+
+	// Payments still pending after this long are reconciled: the request
+	// that created them has given up or died.
+	invoicePaymentReconcileAfter = 5 * time.Minute
+)
+
+// billingCredits are the transaction types that reduce an invoice.
+var billingCredits = []string{txnRefund, txnDisputeCredit}
+
+var (
+	errInvoiceNotPayable    = errors.New("invoice is not payable")
+	errPaymentExceedsAmount = errors.New("amount exceeds what is owed on the invoice")
+)
+
+// CreditAccount holds the billing terms shared by the credit cards of an
+// account. Their purchases are billed together on one invoice per cycle.
+type CreditAccount struct {
+	AccountID           uuid.UUID `json:"account_id" gorm:"type:uuid;primary_key"`
+	ClosingDay          int       `json:"closing_day"`
+	DueDays             int       `json:"due_days"`
+	Timezone            string    `json:"timezone,omitempty"`
+	InterestRateBPS     int64     `json:"interest_rate_bps"`
+	MinimumPaymentPct   int64     `json:"minimum_payment_pct"`
+	MinimumPaymentFloor int64     `json:"minimum_payment_floor"`
+	CycleStartAt        time.Time `json:"cycle_start_at"`
+	NextClosingAt       time.Time `json:"next_closing_at" gorm:"index"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// Invoice is the statement (fatura) of one closed billing cycle. Its
+// total carries over whatever was left unpaid on the previous invoice,
+// plus interest on it. InstallmentInterest is the part of the purchases
+// that is interest on issuer installment plans; Taxes is the IOF on
+// purchases abroad and Fees the card product's fees.
+type Invoice struct {
+	ID                  uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	AccountID           uuid.UUID  `json:"account_id" gorm:"type:uuid;index"`
+	PeriodStart         time.Time  `json:"period_start"`
+	PeriodEnd           time.Time  `json:"period_end"`
+	DueDate             time.Time  `json:"due_date"`
+	PreviousBalance     int64      `json:"previous_balance"`
+	Interest            int64      `json:"interest"`
+	Purchases           int64      `json:"purchases"`
+	InstallmentInterest int64      `json:"installment_interest"`
+	Taxes               int64      `json:"taxes"`
+	Fees                int64      `json:"fees"`
+	Credits             int64      `json:"credits"`
+	Total               int64      `json:"total"`
+	MinimumPayment      int64      `json:"minimum_payment"`
+	PaidAmount          int64      `json:"paid_amount"`
+	InterestPaid        int64      `json:"interest_paid"`
+	Status              string     `json:"status" gorm:"index"`
+	PaidAt              *time.Time `json:"paid_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// InvoicePayment is a payment of an invoice from an account. It is
+// recorded as pending before the account is debited, so a debit whose
+// booking failed can be reconciled.
+type InvoicePayment struct {
+	ID              uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	InvoiceID       uuid.UUID `json:"invoice_id" gorm:"type:uuid;index"`
+	SourceAccountID uuid.UUID `json:"source_account_id" gorm:"type:uuid"`
+	Amount          int64     `json:"amount"`
+	Status          string    `json:"status"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func (a *CreditAccount) location() *time.Location {
+	if a.Timezone != "" {
+		if loc, err := time.LoadLocation(a.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// nextClosing is the first closing date after from: local midnight at the
+// start of the closing day.
+func (a *CreditAccount) nextClosing(from time.Time) time.Time {
+	local := from.In(a.location())
+	closing := time.Date(local.Year(), local.Month(), a.ClosingDay, 0, 0, 0, 0, local.Location())
+	if !closing.After(local) {
+		closing = closing.AddDate(0, 1, 0)
+	}
+	return closing
+}
+
+// cycleAt is the billing cycle containing t, from one closing to the
+// next, counting closings the billing job has not reached yet.
+func (a *CreditAccount) cycleAt(t time.Time) (start, end time.Time) {
+	start, end = a.CycleStartAt, a.NextClosingAt
+	for !t.Before(end) {
+		start, end = end, a.nextClosing(end)
+	}
+	return start, end
+}
+
+func (i *Invoice) outstanding() int64 {
+	return i.Total - i.PaidAmount
+}
+
+func billingSetting(env string, def int64) int64 {
+	v, err := strconv.ParseInt(getEnv(env, strconv.FormatInt(def, 10)), 10, 64)
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// ensureCreditAccount opens billing for the account with the default
+// terms when its first credit card is issued.
+func ensureCreditAccount(tx *gorm.DB, accountID uuid.UUID, now time.Time) error {
+	var account CreditAccount
+	if err := tx.Where("account_id = ?", accountID).Limit(1).Find(&account).Error; err != nil {
+		return err
+	}
+	if account.AccountID != uuid.Nil {
+		return nil
+	}
+
+	account = CreditAccount{
+		AccountID:           accountID,
+		ClosingDay:          int(billingSetting("CREDIT_CLOSING_DAY", 1)),
+		DueDays:             int(billingSetting("CREDIT_DUE_DAYS", 10)),
+		InterestRateBPS:     billingSetting("CREDIT_INTEREST_RATE_BPS", 800),
+		MinimumPaymentPct:   billingSetting("CREDIT_MINIMUM_PAYMENT_PCT", 15),
+		MinimumPaymentFloor: billingSetting("CREDIT_MINIMUM_PAYMENT_FLOOR", 2000),
+		CycleStartAt:        now,
+		CreatedAt:           now,
+		UpdatedAt:           now,
+	}
+	if account.ClosingDay < 1 || account.ClosingDay > 28 {
+		account.ClosingDay = 1
+	}
+	account.NextClosingAt = account.nextClosing(now)
+	return tx.Create(&account).Error
+}
+
+func creditCardIDs(tx *gorm.DB, accountID uuid.UUID) []uuid.UUID {
+	var ids []uuid.UUID
+	tx.Model(&Card{}).Where("account_id = ? AND funding = ?", accountID, fundingCredit).Pluck("id", &ids)
+	return ids
+}
+
+// unbilledTransactions are the account's captures, anticipated
+// installments, refunds, dispute adjustments, IOF and fees not yet on an
+// invoice, up to before. Captures of installment purchases are billed
+// through their installments instead.
+func unbilledTransactions(tx *gorm.DB, accountID uuid.UUID, before time.Time) *gorm.DB {
+	return tx.Model(&CardTransaction{}).
+		Where("card_id IN ? AND type IN ? AND invoice_id IS NULL AND created_at < ?",
+			creditCardIDs(tx, accountID), []string{txnCapture, txnInstallment, txnRefund, txnDisputeCredit, txnDisputeDebit, txnIOF, txnFee}, before).
+		Where("NOT (type = ? AND authorization_id IN (?))",
+			txnCapture, tx.Model(&InstallmentPlan{}).Select("authorization_id"))
+}
+
+// closeCycle issues the invoice for the cycle ending at the account's
+// closing date and starts the next cycle. It reports false once no cycle
+// is due.
+func closeCycle(accountID uuid.UUID, now time.Time) (bool, error) {
+	closed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var account CreditAccount
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_id = ?", accountID).Error; err != nil {
+			return err
+		}
+		if account.NextClosingAt.After(now) {
+			return nil
+		}
+		closed = true
+		closing := account.NextClosingAt
+
+		var totals struct {
+			Purchases int64
+			Credits   int64
+			Taxes     int64
+			Fees      int64
+		}
+		nonPurchases := append([]string{txnIOF, txnFee}, billingCredits...)
+		if err := unbilledTransactions(tx, accountID, closing).
+			Select("COALESCE(SUM(CASE WHEN type NOT IN ? THEN amount ELSE 0 END), 0) AS purchases, "+
+				"COALESCE(SUM(CASE WHEN type IN ? THEN amount ELSE 0 END), 0) AS credits, "+
+				"COALESCE(SUM(CASE WHEN type = ? THEN amount ELSE 0 END), 0) AS taxes, "+
+				"COALESCE(SUM(CASE WHEN type = ? THEN amount ELSE 0 END), 0) AS fees",
+				nonPurchases, billingCredits, txnIOF, txnFee).
+			Scan(&totals).Error; err != nil {
+			return err
+		}
+
+		invoice := Invoice{
+			ID:          uuid.New(),
+			AccountID:   accountID,
+			PeriodStart: account.CycleStartAt,
+			PeriodEnd:   closing,
+			DueDate:     closing.AddDate(0, 0, account.DueDays),
+			Purchases:   totals.Purchases,
+			Credits:     totals.Credits,
+			Taxes:       totals.Taxes,
+			Fees:        totals.Fees,
+			Status:      invoiceClosed,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+
+		installments, err := postInstallments(tx, accountID, &invoice, now)
+		if err != nil {
+			return err
+		}
+		invoice.Purchases += installments
+
+		// Whatever is left of the previous invoice revolves into this one,
+		// with interest if it is owed by the cardholder.
+		var previous Invoice
+		if err := tx.Where("account_id = ? AND status <> ?", accountID, invoiceRolledOver).
+			Order("period_end DESC").Limit(1).Find(&previous).Error; err != nil {
+			return err
+		}
+		if previous.ID != uuid.Nil && previous.outstanding() != 0 {
+			invoice.PreviousBalance = previous.outstanding()
+			if invoice.PreviousBalance > 0 {
+				invoice.Interest = invoice.PreviousBalance * account.InterestRateBPS / 10000
+			}
+			previous.Status = invoiceRolledOver
+			previous.UpdatedAt = now
+			if err := tx.Save(&previous).Error; err != nil {
+				return err
+			}
+		}
+
+		invoice.Total = invoice.PreviousBalance + invoice.Interest + invoice.Purchases + invoice.Taxes + invoice.Fees - invoice.Credits
+		if invoice.Total > 0 {
+			invoice.MinimumPayment = invoice.Total * account.MinimumPaymentPct / 100
+			if invoice.MinimumPayment < account.MinimumPaymentFloor {
+				invoice.MinimumPayment = account.MinimumPaymentFloor
+			}
+			if invoice.MinimumPayment > invoice.Total {
+				invoice.MinimumPayment = invoice.Total
+			}
+		} else {
+			invoice.Status = invoicePaid
+			invoice.PaidAt = &now
+		}
+		if err := tx.Create(&invoice).Error; err != nil {
+			return err
+		}
+		if err := unbilledTransactions(tx, accountID, closing).Update("invoice_id", invoice.ID).Error; err != nil {
+			return err
+		}
+
+		account.CycleStartAt = closing
+		account.NextClosingAt = account.nextClosing(closing)
+		account.UpdatedAt = now
+		return tx.Save(&account).Error
+	})
+	return closed && err == nil, err
+}
+
+// runBillingCycles closes due cycles and marks invoices past their due
+// date without the minimum payment as overdue.
+func runBillingCycles(now time.Time) {
+	var due []CreditAccount
+	db.Where("next_closing_at <= ?", now).Find(&due)
+	for _, account := range due {
+		// Catch up one cycle at a time if closings were missed.
+		for {
+			closed, err := closeCycle(account.AccountID, now)
+			if err != nil {
+				log.Printf("closing billing cycle of account %s failed: %v", account.AccountID, err)
+			}
+			if !closed {
+				break
+			}
+		}
+	}
+
+	db.Model(&Invoice{}).
+		Where("status IN ? AND due_date <= ? AND paid_amount < minimum_payment",
+			[]string{invoiceClosed, invoicePartiallyPaid}, now).
+		Updates(map[string]interface{}{"status": invoiceOverdue, "updated_at": now})
+}
+
+func startBillingCycles(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runBillingCycles(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// releaseCreditLimit gives amount of limit back to the account's credit
+// cards, newest first, but never more than a card has posted: what is
+// still held by open authorizations stays in use.
+func releaseCreditLimit(tx *gorm.DB, accountID uuid.UUID, amount int64) error {
+	var cards []Card
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("account_id = ? AND funding = ? AND replaced_by_id IS NULL", accountID, fundingCredit).
+		Order("created_at DESC").Find(&cards).Error; err != nil {
+		return err
+	}
+
+	for i := range cards {
+		if amount == 0 {
+			break
+		}
+		card := &cards[i]
+		var held int64
+		if err := tx.Model(&CardAuthorization{}).
+			Select("COALESCE(SUM(amount - captured_amount - released_amount), 0)").
+			Where("card_id = ? AND status IN ?", card.ID, []string{authStatusAuthorized, authStatusPartiallyCaptured}).
+			Scan(&held).Error; err != nil {
+			return err
+		}
+		unposted, err := unpostedPrincipal(tx, card.ID)
+		if err != nil {
+			return err
+		}
+		held += unposted
+
+		release := card.SpentAmount - held
+		if release > amount {
+			release = amount
+		}
+		if release <= 0 {
+			continue
+		}
+		card.SpentAmount -= release
+		amount -= release
+		if err := tx.Save(card).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingInvoicePayments is what payments of the invoice still being
+// debited will pay.
+func pendingInvoicePayments(tx *gorm.DB, invoiceID uuid.UUID) (int64, error) {
+	var amount int64
+	err := tx.Model(&InvoicePayment{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("invoice_id = ? AND status = ?", invoiceID, invoicePaymentPending).
+		Scan(&amount).Error
+	return amount, err
+}
+
+// applyInvoicePayment books a payment whose debit went through, once: a
+// payment no longer pending is left as it is. Interest, revolving or on
+// installments, taxes and fees are paid off first and don't use card limit;
+// the rest releases limit. A payment of an
+// invoice that rolled over meanwhile goes to the invoice now carrying its
+// balance, and whatever exceeds the outstanding amount stays on the
+// invoice as a credit for the next cycle without releasing limit.
+func applyInvoicePayment(payment *InvoicePayment) (*Invoice, error) {
+	var invoice Invoice
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invoice, payment.InvoiceID).Error; err != nil {
+			return err
+		}
+		if invoice.Status == invoiceRolledOver {
+			var current Invoice
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("account_id = ? AND status <> ?", invoice.AccountID, invoiceRolledOver).
+				Order("period_end DESC").Limit(1).Find(&current).Error; err != nil {
+				return err
+			}
+			if current.ID != uuid.Nil {
+				invoice = current
+			}
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payment, payment.ID).Error; err != nil {
+			return err
+		}
+		if payment.Status != invoicePaymentPending {
+			return nil
+		}
+
+		now := time.Now()
+		applied := payment.Amount
+		if outstanding := invoice.outstanding(); applied > outstanding {
+			applied = max(outstanding, 0)
+		}
+		toInterest := invoice.Interest + invoice.InstallmentInterest + invoice.Taxes + invoice.Fees - invoice.InterestPaid
+		if toInterest > applied {
+			toInterest = applied
+		}
+		invoice.InterestPaid += toInterest
+		invoice.PaidAmount += payment.Amount
+		invoice.UpdatedAt = now
+		if invoice.outstanding() <= 0 {
+			invoice.Status = invoicePaid
+			invoice.PaidAt = &now
+		} else if invoice.Status != invoiceOverdue || invoice.PaidAmount >= invoice.MinimumPayment {
+			invoice.Status = invoicePartiallyPaid
+		}
+		if err := tx.Save(&invoice).Error; err != nil {
+			return err
+		}
+
+		if err := releaseCreditLimit(tx, invoice.AccountID, applied-toInterest); err != nil {
+			return err
+		}
+
+		payment.Status = invoicePaymentCompleted
+		payment.UpdatedAt = now
+		return tx.Save(payment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// debitInvoicePayment posts the payment's debit, which account-service
+// applies once per payment ID.
+func debitInvoicePayment(payment *InvoicePayment, invoice *Invoice) (int, error) {
+	return callAccountService(internalClient, http.MethodPost, "/internal/debits", map[string]interface{}{
+		"id":          payment.ID.String(),
+		"account_id":  payment.SourceAccountID.String(),
+		"amount":      payment.Amount,
+		"type":        "card_invoice_payment",
+		"description": "Credit card invoice " + invoice.PeriodEnd.Format("2006-01-02"),
+	})
+}
+
+// reconcileInvoicePayments settles payments left pending when the outcome
+// of their debit was unknown or their booking failed. The debit is sent
+// again, which posts it if it never went through; a refused debit fails
+// the payment.
+func reconcileInvoicePayments(now time.Time) {
+	var pending []InvoicePayment
+	db.Where("status = ? AND updated_at <= ?", invoicePaymentPending, now.Add(-invoicePaymentReconcileAfter)).
+		Order("created_at").Find(&pending)
+
+	for i := range pending {
+		payment := &pending[i]
+		var invoice Invoice
+		if err := db.First(&invoice, payment.InvoiceID).Error; err != nil {
+			log.Printf("reconciling invoice payment %s failed: %v", payment.ID, err)
+			continue
+		}
+
+		status, err := debitInvoicePayment(payment, &invoice)
+		if err != nil {
+			log.Printf("reconciling invoice payment %s failed: %v", payment.ID, err)
+			continue
+		}
+		if releaseErr := setAccountHold(internalClient, payment.SourceAccountID, payment.ID, 0, now); releaseErr != nil {
+			log.Printf("releasing hold of invoice payment %s failed: %v", payment.ID, releaseErr)
+		}
+		if status >= 300 {
+			db.Model(payment).Where("status = ?", invoicePaymentPending).
+				Updates(map[string]interface{}{"status": invoicePaymentFailed, "updated_at": time.Now()})
+			continue
+		}
+		if _, err := applyInvoicePayment(payment); err != nil {
+			log.Printf("booking invoice payment %s failed: %v", payment.ID, err)
+		}
+	}
+}
+
+func startInvoicePaymentReconciliation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			reconcileInvoicePayments(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func payInvoice(c *gin.Context) {
+	invoiceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID"})
+		return
+	}
+
+	var req struct {
+		Amount          int64  `json:"amount" binding:"required,gt=0"`
+		SourceAccountID string `json:"source_account_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var invoice Invoice
+	if err := db.First(&invoice, invoiceID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	source := invoice.AccountID
+	if req.SourceAccountID != "" {
+		if source, err = uuid.Parse(req.SourceAccountID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+			return
+		}
+	}
+
+	// Payments still being debited count against what is owed, so
+	// concurrent payments cannot together overpay the invoice.
+	now := time.Now()
+	payment := InvoicePayment{
+		ID:              uuid.New(),
+		InvoiceID:       invoice.ID,
+		SourceAccountID: source,
+		Amount:          req.Amount,
+		Status:          invoicePaymentPending,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invoice, invoiceID).Error; err != nil {
+			return err
+		}
+		if invoice.Status == invoiceRolledOver || invoice.Status == invoicePaid {
+			return errInvoiceNotPayable
+		}
+		pending, err := pendingInvoicePayments(tx, invoice.ID)
+		if err != nil {
+			return err
+		}
+		if req.Amount > invoice.outstanding()-pending {
+			return errPaymentExceedsAmount
+		}
+		return tx.Create(&payment).Error
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, errInvoiceNotPayable), errors.Is(err, errPaymentExceedsAmount):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment"})
+		return
+	}
+
+	// Debits may overdraw, so the funds are held first, which checks the
+	// available balance, then debited and the hold released.
+	if err := setAccountHold(internalClient, source, payment.ID, req.Amount, now.Add(time.Hour)); err != nil {
+		db.Model(&payment).Updates(map[string]interface{}{"status": invoicePaymentFailed, "updated_at": time.Now()})
+		if errors.Is(err, errInsufficientFunds) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Insufficient funds"})
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Account service unavailable"})
+		return
+	}
+	status, err := debitInvoicePayment(&payment, &invoice)
+	if releaseErr := setAccountHold(internalClient, source, payment.ID, 0, now); releaseErr != nil {
+		log.Printf("releasing hold of invoice payment %s failed: %v", payment.ID, releaseErr)
+	}
+	if err != nil || status >= 300 {
+		// An unknown outcome leaves the payment pending for reconciliation;
+		// the debit is idempotent by payment ID.
+		if err == nil {
+			db.Model(&payment).Updates(map[string]interface{}{"status": invoicePaymentFailed, "updated_at": time.Now()})
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to debit account"})
+		return
+	}
+
+	updated, err := applyInvoicePayment(&payment)
+	if err != nil {
+		log.Printf("booking invoice payment %s failed: %v", payment.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment debited but not yet booked", "payment": payment})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"payment": payment,
+		"invoice": updated,
+		"message": "Invoice payment received",
+	})
+}
+
+func getCreditAccount(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("account_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var account CreditAccount
+	if err := db.First(&account, "account_id = ?", accountID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credit account not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// updateCreditAccount changes the billing terms. A new closing day takes
+// effect from the next closing after the current one.
+func updateCreditAccount(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("account_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req struct {
+		ClosingDay          int    `json:"closing_day" binding:"required,min=1,max=28"`
+		DueDays             int    `json:"due_days" binding:"required,min=1,max=30"`
+		Timezone            string `json:"timezone"`
+		InterestRateBPS     *int64 `json:"interest_rate_bps" binding:"omitempty,gte=0"`
+		MinimumPaymentPct   *int64 `json:"minimum_payment_pct" binding:"omitempty,gte=0,lte=100"`
+		MinimumPaymentFloor *int64 `json:"minimum_payment_floor" binding:"omitempty,gte=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+			return
+		}
+	}
+
+	var account CreditAccount
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_id = ?", accountID).Error; err != nil {
+			return err
+		}
+		account.ClosingDay = req.ClosingDay
+		account.DueDays = req.DueDays
+		account.Timezone = req.Timezone
+		if req.InterestRateBPS != nil {
+			account.InterestRateBPS = *req.InterestRateBPS
+		}
+		if req.MinimumPaymentPct != nil {
+			account.MinimumPaymentPct = *req.MinimumPaymentPct
+		}
+		if req.MinimumPaymentFloor != nil {
+			account.MinimumPaymentFloor = *req.MinimumPaymentFloor
+		}
+		account.UpdatedAt = time.Now()
+		return tx.Save(&account).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credit account not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update credit account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+func getInvoices(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("account_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var invoices []Invoice
+	db.Where("account_id = ?", accountID).Order("period_end DESC").Find(&invoices)
+
+	c.JSON(http.StatusOK, invoices)
+}
+
+// getCurrentInvoice shows the cycle still open: what has been posted so
+// far and when it closes.
+func getCurrentInvoice(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("account_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var account CreditAccount
+	if err := db.First(&account, "account_id = ?", accountID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credit account not found"})
+		return
+	}
+
+	var transactions []CardTransaction
+	unbilledTransactions(db, accountID, account.NextClosingAt).Order("created_at").Find(&transactions)
+
+	var total int64
+	for _, t := range transactions {
+		if t.Type == txnRefund || t.Type == txnDisputeCredit {
+			total -= t.Amount
+		} else {
+			total += t.Amount
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id":   account.AccountID,
+		"period_start": account.CycleStartAt,
+		"closes_at":    account.NextClosingAt,
+		"due_date":     account.NextClosingAt.AddDate(0, 0, account.DueDays),
+		"total":        total,
+		"transactions": transactions,
+	})
+}
+
+func getInvoice(c *gin.Context) {
+	invoiceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID"})
+		return
+	}
+
+	var invoice Invoice
+	if err := db.First(&invoice, invoiceID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+
+	var transactions []CardTransaction
+	db.Where("invoice_id = ?", invoice.ID).Order("created_at").Find(&transactions)
+
+	var payments []InvoicePayment
+	db.Where("invoice_id = ?", invoice.ID).Order("created_at").Find(&payments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"invoice":      invoice,
+		"transactions": transactions,
+		"payments":     payments,
+	})
+}
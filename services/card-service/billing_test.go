@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreditAccountNextClosing(t *testing.T) {
+	sp, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	account := CreditAccount{ClosingDay: 10, Timezone: "America/Sao_Paulo"}
+
+	cases := []struct {
+		from time.Time
+		want time.Time
+	}{
+		{time.Date(2026, 3, 5, 12, 0, 0, 0, sp), time.Date(2026, 3, 10, 0, 0, 0, 0, sp)},
+		{time.Date(2026, 3, 10, 0, 0, 0, 0, sp), time.Date(2026, 4, 10, 0, 0, 0, 0, sp)},
+		{time.Date(2026, 3, 10, 2, 0, 0, 0, time.UTC), time.Date(2026, 3, 10, 0, 0, 0, 0, sp)},
+		{time.Date(2026, 12, 20, 0, 0, 0, 0, sp), time.Date(2027, 1, 10, 0, 0, 0, 0, sp)},
+	}
+	for _, tc := range cases {
+		if got := account.nextClosing(tc.from); !got.Equal(tc.want) {
+			t.Errorf("nextClosing(%v) = %v, want %v", tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestCreditAccountLocationFallsBackToUTC(t *testing.T) {
+	for _, tz := range []string{"", "Not/AZone"} {
+		account := CreditAccount{Timezone: tz}
+		if loc := account.location(); loc != time.UTC {
+			t.Errorf("location(%q) = %v, want UTC", tz, loc)
+		}
+	}
+}
+
+func TestInvoiceOutstanding(t *testing.T) {
+	invoice := Invoice{Total: 10000, PaidAmount: 2500}
+	if got := invoice.outstanding(); got != 7500 {
+		t.Errorf("outstanding = %d, want 7500", got)
+	}
+	// Overpayments leave a credit that the next cycle carries over.
+	invoice.PaidAmount = 12000
+	if got := invoice.outstanding(); got != -2000 {
+		t.Errorf("outstanding = %d, want -2000", got)
+	}
+}
+
+func TestBillingSetting(t *testing.T) {
+	t.Setenv("CREDIT_TEST_SETTING", "42")
+	if got := billingSetting("CREDIT_TEST_SETTING", 7); got != 42 {
+		t.Errorf("billingSetting = %d, want 42", got)
+	}
+	for _, v := range []string{"-1", "abc"} {
+		t.Setenv("CREDIT_TEST_SETTING", v)
+		if got := billingSetting("CREDIT_TEST_SETTING", 7); got != 7 {
+			t.Errorf("billingSetting(%q) = %d, want the default", v, got)
+		}
+	}
+}
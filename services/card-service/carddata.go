@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const revealTokenTTL = 60 * time.Second
+
+// Card data keys. panKey encrypts PANs at rest, panHashKey indexes them for
+// lookups and uniqueness, and cvvKey derives CVVs, which are never stored.
+var (
+	panKey       []byte
+	panHashKey   []byte
+	cvvKey       []byte
+	revealAPIKey string
+)
+
+// CardAccessLog audits every attempt to reach full card details.
+type CardAccessLog struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	CardID    uuid.UUID `json:"card_id" gorm:"type:uuid;index"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	ClientIP  string    `json:"client_ip"`
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CardRevealToken grants a single, short-lived read of full card details.
+// Only a hash of the token is stored.
+type CardRevealToken struct {
+	TokenHash string     `json:"-" gorm:"primary_key"`
+	CardID    uuid.UUID  `json:"card_id" gorm:"type:uuid;index"`
+	Actor     string     `json:"actor"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func loadCardDataKeys() {
+	panKey = loadKey("CARD_DATA_KEY", "pan-encryption")
+	panHashKey = loadKey("CARD_HASH_KEY", "pan-hash")
+	cvvKey = loadKey("CARD_CVV_KEY", "cvv")
+	threeDSKey = loadKey("CARD_3DS_KEY", "3ds")
+	revealAPIKey = getEnv("CARD_REVEAL_API_KEY", "")
+}
+
+// loadKey reads a base64 encoded 32-byte key. Without one it falls back to a
+// fixed development key so the service still starts locally.
+func loadKey(env, label string) []byte {
+	if v := getEnv(env, ""); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) != 32 {
+			panic(env + " must be a base64 encoded 32-byte key")
+		}
+		return key
+	}
+	log.Printf("WARNING: %s not set, using insecure development key", env)
+	sum := sha256.Sum256([]byte("card-service-dev-" + label))
+	return sum[:]
+}
+
+func encryptPAN(pan string) (string, error) {
+	block, err := aes.NewCipher(panKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(pan), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptPAN(encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(panKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	pan, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(pan), nil
+}
+
+func hashPAN(pan string) string {
+	mac := hmac.New(sha256.New, panHashKey)
+	mac.Write([]byte(pan))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setPAN stores a PAN on the card in its protected forms only.
+func setPAN(card *Card, pan string) error {
+	encrypted, err := encryptPAN(pan)
+	if err != nil {
+		return err
+	}
+	card.PANEncrypted = encrypted
+	card.PANHash = hashPAN(pan)
+	card.MaskedNumber = maskPAN(pan)
+	card.Last4 = pan[len(pan)-4:]
+	return nil
+}
+
+// deriveCVV computes the card verification value from the PAN and expiry
+// under the CVV key, so it can be checked or shown without being stored.
+func deriveCVV(pan, expiry string) string {
+	mac := hmac.New(sha256.New, cvvKey)
+	mac.Write([]byte(pan + "|" + expiry))
+	return fmt.Sprintf("%03d", binary.BigEndian.Uint32(mac.Sum(nil)[:4])%1000)
+}
+
+// legacyCVVValue is the verification value kept in place of the printed
+// CVV of a card issued before CVVs were derived.
+func legacyCVVValue(cardID uuid.UUID, cvv string) string {
+	mac := hmac.New(sha256.New, cvvKey)
+	mac.Write([]byte("legacy|" + cardID.String() + "|" + cvv))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validCVV(card *Card, cvv string) bool {
+	if card.CVVMode == cvvModeDynamic {
+		return validDynamicCVV(card, cvv, time.Now())
+	}
+	if card.LegacyCVVHash != "" {
+		return subtle.ConstantTimeCompare([]byte(legacyCVVValue(card.ID, cvv)), []byte(card.LegacyCVVHash)) == 1
+	}
+
+	pan, err := decryptPAN(card.PANEncrypted)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(deriveCVV(pan, card.ExpiryDate)), []byte(cvv)) == 1
+}
+
+func findCardByPAN(tx *gorm.DB, pan string) (*Card, error) {
+	var card Card
+	if err := tx.Where("pan_hash = ?", hashPAN(pan)).First(&card).Error; err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+func logCardAccess(c *gin.Context, cardID uuid.UUID, action, actor, outcome string) {
+	db.Create(&CardAccessLog{
+		ID:        uuid.New(),
+		CardID:    cardID,
+		Action:    action,
+		Actor:     actor,
+		ClientIP:  c.ClientIP(),
+		Outcome:   outcome,
+		CreatedAt: time.Now(),
+	})
+}
+
+// createRevealToken is called by the app backend once the cardholder has
+// passed step-up authentication. It is guarded by its own API key.
+func createRevealToken(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var req struct {
+		RequestedBy string `json:"requested_by" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !revealAuthorized(c) {
+		logCardAccess(c, cardID, "reveal_token", req.RequestedBy, "unauthorized")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authorized to reveal card details"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	reveal := CardRevealToken{
+		TokenHash: hashToken(token),
+		CardID:    card.ID,
+		Actor:     req.RequestedBy,
+		ExpiresAt: now.Add(revealTokenTTL),
+		CreatedAt: now,
+	}
+	if err := db.Create(&reveal).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+
+	logCardAccess(c, card.ID, "reveal_token", req.RequestedBy, "issued")
+
+	c.JSON(http.StatusCreated, gin.H{
+		"reveal_token": token,
+		"expires_at":   reveal.ExpiresAt,
+	})
+}
+
+// revealCard is the only endpoint that returns the full card number and
+// CVV. It consumes a reveal token issued by createRevealToken.
+func revealCard(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	token := c.GetHeader("X-Reveal-Token")
+	now := time.Now()
+
+	// The token is consumed by a conditional update, so of two concurrent
+	// requests with the same token only one reveals the card.
+	var reveal CardRevealToken
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&CardRevealToken{}).
+			Where("token_hash = ? AND card_id = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), cardID, now).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("token_hash = ?", hashToken(token)).First(&reveal).Error
+	})
+	if err != nil {
+		logCardAccess(c, cardID, "reveal", "", "denied")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reveal token"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	pan, err := decryptPAN(card.PANEncrypted)
+	if err != nil {
+		logCardAccess(c, card.ID, "reveal", reveal.Actor, "decrypt_failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read card details"})
+		return
+	}
+
+	cvv := deriveCVV(pan, card.ExpiryDate)
+	switch {
+	case card.CVVMode == cvvModeDynamic:
+		secret, err := dcvvSecret(&card)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read card details"})
+			return
+		}
+		cvv = dynamicCVVAt(secret, card.DCVVPeriodMinutes, now)
+	case card.LegacyCVVHash != "":
+		// Only a verification value of the printed CVV is kept.
+		cvv = ""
+	}
+
+	logCardAccess(c, card.ID, "reveal", reveal.Actor, "revealed")
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"card_id":     card.ID,
+		"card_number": pan,
+		"cvv":         cvv,
+		"cvv_mode":    card.CVVMode,
+		"expiry_date": card.ExpiryDate,
+	})
+}
+
+// revealAuthorized checks the API key held by the app backend, which calls
+// the card detail endpoints only after authenticating the cardholder.
+func revealAuthorized(c *gin.Context) bool {
+	return revealAPIKey != "" &&
+		subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Reveal-Authorization")), []byte(revealAPIKey)) == 1
+}
+
+// panDigits drops the separators of a formatted card number.
+func panDigits(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, number)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// migratePlaintextCardData protects cards written before PAN encryption:
+// it encrypts their card_number, keeps a verification value of their cvv
+// so the printed CVV stays valid until the card is reissued, and drops the
+// plaintext columns once every card has been migrated. Any failure leaves
+// the columns in place for the next start.
+func migratePlaintextCardData() {
+	migrator := db.Migrator()
+	if !migrator.HasColumn(&Card{}, "card_number") {
+		return
+	}
+
+	columns := "id, COALESCE(card_number, '') AS card_number, '' AS cvv"
+	if migrator.HasColumn(&Card{}, "cvv") {
+		columns = "id, COALESCE(card_number, '') AS card_number, COALESCE(cvv, '') AS cvv"
+	}
+	var rows []struct {
+		ID         uuid.UUID
+		CardNumber string
+		CVV        string
+	}
+	if err := db.Table("cards").Select(columns).Where("pan_hash IS NULL OR pan_hash = ''").Scan(&rows).Error; err != nil {
+		log.Printf("reading plaintext card data failed: %v", err)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			// Legacy numbers were stored grouped with spaces.
+			pan := panDigits(row.CardNumber)
+			if len(pan) < 12 {
+				return fmt.Errorf("card %s has no valid card number", row.ID)
+			}
+
+			var card Card
+			if err := setPAN(&card, pan); err != nil {
+				return fmt.Errorf("card %s: %w", row.ID, err)
+			}
+			updates := map[string]interface{}{
+				"pan_encrypted": card.PANEncrypted,
+				"pan_hash":      card.PANHash,
+				"masked_number": card.MaskedNumber,
+				"last4":         card.Last4,
+			}
+			if row.CVV != "" {
+				updates["legacy_cvv_hash"] = legacyCVVValue(row.ID, row.CVV)
+			}
+			result := tx.Model(&Card{}).Where("id = ?", row.ID).Updates(updates)
+			if result.Error != nil {
+				return fmt.Errorf("card %s: %w", row.ID, result.Error)
+			}
+			if result.RowsAffected != 1 {
+				return fmt.Errorf("card %s was not updated", row.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("protecting plaintext card data failed, keeping the plaintext columns: %v", err)
+		return
+	}
+
+	if err := migrator.DropColumn(&Card{}, "card_number"); err != nil {
+		log.Printf("dropping card_number failed: %v", err)
+		return
+	}
+	if migrator.HasColumn(&Card{}, "cvv") {
+		if err := migrator.DropColumn(&Card{}, "cvv"); err != nil {
+			log.Printf("dropping cvv failed: %v", err)
+		}
+	}
+}
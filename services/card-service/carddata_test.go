@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPANDigits(t *testing.T) {
+	cases := map[string]string{
+		"5199 0001 0002 0003": "5199000100020003",
+		"4111-1111-1111-1111": "4111111111111111",
+		"4111111111111111":    "4111111111111111",
+	}
+	for number, want := range cases {
+		if got := panDigits(number); got != want {
+			t.Errorf("panDigits(%q) = %q, want %q", number, got, want)
+		}
+	}
+}
+
+func TestLegacyCVV(t *testing.T) {
+	card := Card{ID: uuid.New(), CVVMode: cvvModeStatic}
+	card.LegacyCVVHash = legacyCVVValue(card.ID, "731")
+
+	if !validCVV(&card, "731") {
+		t.Error("printed CVV of a legacy card refused")
+	}
+	if validCVV(&card, "732") {
+		t.Error("wrong CVV of a legacy card accepted")
+	}
+	if legacyCVVValue(uuid.New(), "731") == card.LegacyCVVHash {
+		t.Error("legacy CVV value does not depend on the card")
+	}
+}
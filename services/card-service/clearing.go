@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Clearing files are CSV, one presentment per line, with an optional
+// header line starting with "type":
+//
+//	type,pan,amount,approval_code,rrn,arn,merchant_id,mcc,transaction_date,description
+//
+// The type is 05 for a purchase and 06 for a credit (refund). Amounts are
+// in cents and dates are YYYY-MM-DD. The approval code and RRN identify
+// the authorization and may be empty. The ARN, the acquirer reference
+// number, is unique per presentment, which makes importing the same file
+// twice harmless.
+//
+// A purchase is matched to an authorization of the card with the same
+// approval code or RRN, made up to CLEARING_MATCH_DAYS before the
+// transaction date, whose open amount the presentment exceeds by at most
+// CLEARING_AMOUNT_TOLERANCE_PCT. Authorizations that expired before their
+// presentment arrived still match, on the amount they released. The match
+// is captured for the presented amount and closed. A purchase without approval code or RRN is a force
+// post and is captured without an authorization. A credit is refunded
+// against the captured authorization it names.
+const (
+	clearingPurchase = "05"
+	clearingCredit   = "06"
+
+	clearingMatched     = "matched"
+	clearingForcePosted = "force_posted"
+	clearingUnmatched   = "unmatched"
+	clearingDuplicate   = "duplicate"
+	clearingInvalid     = "invalid"
+
+	clearingColumns  = 10
+	clearingMaxBytes = 32 << 20
+)
+
+var errClearingUnmatched = errors.New("no matching authorization")
+
+// ClearingFile is one imported file and its totals.
+type ClearingFile struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Name        string    `json:"name"`
+	Records     int       `json:"records"`
+	Matched     int       `json:"matched"`
+	ForcePosted int       `json:"force_posted"`
+	Unmatched   int       `json:"unmatched"`
+	Duplicates  int       `json:"duplicates"`
+	Invalid     int       `json:"invalid"`
+	ImportedAt  time.Time `json:"imported_at"`
+}
+
+// ClearingRecord is one line of a clearing file and how it was applied.
+type ClearingRecord struct {
+	ID              uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	FileID          uuid.UUID  `json:"file_id" gorm:"type:uuid;index"`
+	Line            int        `json:"line"`
+	Type            string     `json:"type"`
+	MaskedPAN       string     `json:"masked_pan"`
+	CardID          *uuid.UUID `json:"card_id,omitempty" gorm:"type:uuid"`
+	AuthorizationID *uuid.UUID `json:"authorization_id,omitempty" gorm:"type:uuid"`
+	Amount          int64      `json:"amount"`
+	ApprovalCode    string     `json:"approval_code,omitempty"`
+	RetrievalRef    string     `json:"retrieval_reference,omitempty"`
+	ARN             string     `json:"arn" gorm:"index"`
+	MerchantID      string     `json:"merchant_id"`
+	MCC             string     `json:"mcc,omitempty"`
+	TransactionDate string     `json:"transaction_date"`
+	Description     string     `json:"description,omitempty"`
+	Status          string     `json:"status" gorm:"index"`
+	Reason          string     `json:"reason,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type clearingLine struct {
+	typ, pan, approvalCode, rrn, arn, merchantID, mcc, description string
+	amount                                                         int64
+	date                                                           time.Time
+}
+
+func parseClearingLine(fields []string) (*clearingLine, error) {
+	if len(fields) != clearingColumns {
+		return nil, fmt.Errorf("expected %d columns, got %d", clearingColumns, len(fields))
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	l := &clearingLine{
+		typ:          fields[0],
+		pan:          fields[1],
+		approvalCode: fields[3],
+		rrn:          fields[4],
+		arn:          fields[5],
+		merchantID:   fields[6],
+		mcc:          fields[7],
+		description:  fields[9],
+	}
+	if l.typ != clearingPurchase && l.typ != clearingCredit {
+		return nil, fmt.Errorf("unknown record type %q", l.typ)
+	}
+	if l.pan == "" || l.arn == "" {
+		return nil, errors.New("pan and arn are required")
+	}
+	amount, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || amount <= 0 {
+		return nil, errors.New("invalid amount")
+	}
+	l.amount = amount
+	date, err := time.Parse("2006-01-02", fields[8])
+	if err != nil {
+		return nil, errors.New("invalid transaction_date")
+	}
+	l.date = date
+	return l, nil
+}
+
+func clearingMatchDays() int {
+	days, err := strconv.Atoi(getEnv("CLEARING_MATCH_DAYS", "7"))
+	if err != nil || days <= 0 {
+		return 7
+	}
+	return days
+}
+
+func clearingTolerancePct() int64 {
+	pct, err := strconv.ParseInt(getEnv("CLEARING_AMOUNT_TOLERANCE_PCT", "20"), 10, 64)
+	if err != nil || pct < 0 {
+		return 20
+	}
+	return pct
+}
+
+// presentable is how much of the authorization a presentment may still
+// capture: what is open, or what an expired authorization released.
+func (a *CardAuthorization) presentable() int64 {
+	switch {
+	case a.open():
+		return a.remaining()
+	case a.Status == authStatusExpired:
+		return a.ReleasedAmount
+	}
+	return 0
+}
+
+// findClearingMatch looks for the authorization a presentment settles.
+// Purchases match open or expired authorizations within the amount
+// tolerance; credits match authorizations with captured amount to refund.
+func findClearingMatch(card *Card, l *clearingLine) (*CardAuthorization, error) {
+	query := db.Where("card_id = ?", card.ID)
+	switch {
+	case l.approvalCode != "" && l.rrn != "":
+		query = query.Where("approval_code = ? OR retrieval_ref = ?", l.approvalCode, l.rrn)
+	case l.approvalCode != "":
+		query = query.Where("approval_code = ?", l.approvalCode)
+	default:
+		query = query.Where("retrieval_ref = ?", l.rrn)
+	}
+
+	from := l.date.AddDate(0, 0, -clearingMatchDays())
+	to := l.date.AddDate(0, 0, 2)
+	query = query.Where("created_at >= ? AND created_at < ?", from, to)
+
+	var candidates []CardAuthorization
+	if err := query.Order("created_at").Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	tolerance := clearingTolerancePct()
+	for i := range candidates {
+		auth := &candidates[i]
+		if l.typ == clearingCredit {
+			if auth.CapturedAmount-auth.RefundedAmount >= l.amount {
+				return auth, nil
+			}
+			continue
+		}
+		if presentable := auth.presentable(); presentable > 0 && l.amount*100 <= presentable*(100+tolerance) {
+			return auth, nil
+		}
+	}
+	return nil, errClearingUnmatched
+}
+
+// settleAuthorization captures amount and closes the authorization,
+// extending it first when the presented amount is over what is open. An
+// expired authorization is reopened, consuming the card limit it released
+// again. Clearing is not an authorization request, so the card's status
+// and limits are not checked again.
+func settleAuthorization(id uuid.UUID, amount int64) (*CardAuthorization, error) {
+	accept := func(auth *CardAuthorization) bool {
+		return auth.open() || auth.Status == authStatusExpired
+	}
+	return lockAuthorization(id, accept, func(tx *gorm.DB, card *Card, auth *CardAuthorization) error {
+		now := time.Now()
+		if auth.Status == authStatusExpired {
+			reopened := min(amount, auth.ReleasedAmount)
+			auth.ReleasedAmount -= reopened
+			card.SpentAmount += reopened
+			auth.Status = authStatusPartiallyCaptured
+			auth.ClosedAt = nil
+			if _, err := recordAuthorizationEvent(tx, auth, txnIncrement, reopened, now); err != nil {
+				return err
+			}
+		}
+		if over := amount - auth.remaining(); over > 0 {
+			auth.Amount += over
+			card.SpentAmount += over
+			if _, err := recordAuthorizationEvent(tx, auth, txnIncrement, over, now); err != nil {
+				return err
+			}
+		}
+		return postCapture(tx, card, auth, amount, true, now)
+	})
+}
+
+// forcePost books a presentment that was never authorized. It becomes a
+// captured authorization so it shows in the card's history and limit
+// like any other purchase.
+func forcePost(cardID uuid.UUID, l *clearingLine) (*CardAuthorization, error) {
+	var auth CardAuthorization
+	debit := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var card Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, cardID).Error; err != nil {
+			return errCardNotFound
+		}
+
+		now := time.Now()
+		auth = CardAuthorization{
+			ID:           uuid.New(),
+			CardID:       card.ID,
+			MerchantID:   l.merchantID,
+			MCC:          l.mcc,
+			Description:  l.description,
+			RetrievalRef: l.rrn,
+			Amount:       l.amount,
+			Status:       authStatusAuthorized,
+			ExpiresAt:    now,
+			CreatedAt:    now,
+		}
+		if err := tx.Create(&auth).Error; err != nil {
+			return err
+		}
+		card.SpentAmount += l.amount
+		if err := postCapture(tx, &card, &auth, l.amount, true, now); err != nil {
+			return err
+		}
+		if err := tx.Save(&card).Error; err != nil {
+			return err
+		}
+		debit = card.Funding == fundingDebit
+		return tx.Save(&auth).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if debit {
+		kickAccountSync()
+	}
+	return &auth, nil
+}
+
+// applyClearingLine matches one presentment and books it, filling in the
+// record's outcome.
+func applyClearingLine(record *ClearingRecord, l *clearingLine) {
+	var prior int64
+	db.Model(&ClearingRecord{}).
+		Where("arn = ? AND status IN ?", l.arn, []string{clearingMatched, clearingForcePosted}).
+		Count(&prior)
+	if prior > 0 {
+		record.Status = clearingDuplicate
+		record.Reason = "ARN already cleared"
+		return
+	}
+
+	card, err := findCardByPAN(db, l.pan)
+	if err != nil {
+		record.Status = clearingUnmatched
+		record.Reason = "card not found"
+		return
+	}
+	record.CardID = &card.ID
+
+	if l.approvalCode == "" && l.rrn == "" {
+		if l.typ == clearingCredit {
+			record.Status = clearingUnmatched
+			record.Reason = "credit without approval code or RRN"
+			return
+		}
+		auth, err := forcePost(card.ID, l)
+		if err != nil {
+			record.Status = clearingUnmatched
+			record.Reason = err.Error()
+			return
+		}
+		record.AuthorizationID = &auth.ID
+		record.Status = clearingForcePosted
+		return
+	}
+
+	auth, err := findClearingMatch(card, l)
+	if err != nil {
+		record.Status = clearingUnmatched
+		record.Reason = err.Error()
+		return
+	}
+	record.AuthorizationID = &auth.ID
+
+	if l.typ == clearingCredit {
+		_, err = refundAuthorization(auth.ID, l.amount)
+	} else {
+		_, err = settleAuthorization(auth.ID, l.amount)
+	}
+	if err != nil {
+		record.Status = clearingUnmatched
+		record.Reason = err.Error()
+		return
+	}
+	record.Status = clearingMatched
+}
+
+// importClearingFile takes a clearing file as the request body and
+// applies it line by line. Each presentment is booked on its own, so a
+// bad line doesn't hold back the rest of the file.
+func importClearingFile(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	reader := csv.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, clearingMaxBytes))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	now := time.Now()
+	file := ClearingFile{ID: uuid.New(), Name: name, ImportedAt: now}
+	if err := db.Create(&file).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import file"})
+		return
+	}
+
+	unmatched := []ClearingRecord{}
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				db.Save(&file)
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file", "file": file})
+				return
+			}
+		}
+		if line == 1 && len(fields) > 0 && strings.EqualFold(strings.TrimSpace(fields[0]), "type") {
+			continue
+		}
+		if len(fields) == 1 && strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+
+		record := ClearingRecord{ID: uuid.New(), FileID: file.ID, Line: line, CreatedAt: time.Now()}
+		l, parseErr := parseClearingLine(fields)
+		if err != nil || parseErr != nil {
+			record.Status = clearingInvalid
+			record.Reason = "malformed line"
+			if parseErr != nil {
+				record.Reason = parseErr.Error()
+			}
+		} else {
+			record.Type = l.typ
+			record.MaskedPAN = maskPAN(l.pan)
+			record.Amount = l.amount
+			record.ApprovalCode = l.approvalCode
+			record.RetrievalRef = l.rrn
+			record.ARN = l.arn
+			record.MerchantID = l.merchantID
+			record.MCC = l.mcc
+			record.TransactionDate = l.date.Format("2006-01-02")
+			record.Description = l.description
+			applyClearingLine(&record, l)
+		}
+		db.Create(&record)
+
+		file.Records++
+		switch record.Status {
+		case clearingMatched:
+			file.Matched++
+		case clearingForcePosted:
+			file.ForcePosted++
+		case clearingDuplicate:
+			file.Duplicates++
+		case clearingInvalid:
+			file.Invalid++
+			unmatched = append(unmatched, record)
+		default:
+			file.Unmatched++
+			unmatched = append(unmatched, record)
+		}
+	}
+	db.Save(&file)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"file":      file,
+		"unmatched": unmatched,
+	})
+}
+
+func getClearingFiles(c *gin.Context) {
+	var files []ClearingFile
+	db.Order("imported_at DESC").Limit(100).Find(&files)
+
+	c.JSON(http.StatusOK, files)
+}
+
+func getClearingRecords(c *gin.Context) {
+	fileID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	var file ClearingFile
+	if err := db.First(&file, fileID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Clearing file not found"})
+		return
+	}
+
+	query := db.Where("file_id = ?", file.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var records []ClearingRecord
+	query.Order("line").Find(&records)
+
+	c.JSON(http.StatusOK, gin.H{
+		"file":    file,
+		"records": records,
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseClearingLine(t *testing.T) {
+	l, err := parseClearingLine(strings.Split("05, 4111111111111111 ,1500,A1B2C3,123456789012,ARN1,M1,5411,2026-03-01,Groceries", ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.typ != clearingPurchase || l.pan != "4111111111111111" || l.amount != 1500 || l.approvalCode != "A1B2C3" {
+		t.Errorf("parsed %+v", l)
+	}
+	if l.date.Format("2006-01-02") != "2026-03-01" {
+		t.Errorf("date %v", l.date)
+	}
+
+	bad := []string{
+		"05,4111111111111111,1500,,,ARN1,M1,5411,2026-03-01",
+		"07,4111111111111111,1500,,,ARN1,M1,5411,2026-03-01,x",
+		"05,,1500,,,ARN1,M1,5411,2026-03-01,x",
+		"05,4111111111111111,1500,,,,M1,5411,2026-03-01,x",
+		"05,4111111111111111,-1,,,ARN1,M1,5411,2026-03-01,x",
+		"05,4111111111111111,15.00,,,ARN1,M1,5411,2026-03-01,x",
+		"05,4111111111111111,1500,,,ARN1,M1,5411,01/03/2026,x",
+	}
+	for _, line := range bad {
+		if _, err := parseClearingLine(strings.Split(line, ",")); err == nil {
+			t.Errorf("%q was accepted", line)
+		}
+	}
+}
+
+func TestPresentable(t *testing.T) {
+	cases := []struct {
+		name string
+		auth CardAuthorization
+		want int64
+	}{
+		{"open", CardAuthorization{Status: authStatusAuthorized, Amount: 1000}, 1000},
+		{"partially captured", CardAuthorization{Status: authStatusPartiallyCaptured, Amount: 1000, CapturedAmount: 400}, 600},
+		{"expired", CardAuthorization{Status: authStatusExpired, Amount: 1000, CapturedAmount: 400, ReleasedAmount: 600}, 600},
+		{"captured", CardAuthorization{Status: authStatusCaptured, Amount: 1000, CapturedAmount: 1000}, 0},
+		{"voided", CardAuthorization{Status: authStatusVoided, Amount: 1000, ReleasedAmount: 1000}, 0},
+	}
+	for _, tc := range cases {
+		if got := tc.auth.presentable(); got != tc.want {
+			t.Errorf("%s: presentable = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
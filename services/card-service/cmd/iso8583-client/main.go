@@ -0,0 +1,220 @@
+// Command iso8583-client sends ISO 8583 messages to card-service's
+// listener, for driving it locally:
+//
+//	iso8583-client -pan 5199001234567890 -expiry 3012 -amount 1500 -cvv 123
+//	iso8583-client -pan 5199001234567890 -amount 1500 -reverse
+//	iso8583-client -type echo
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"card-service/iso8583"
+	"card-service/pinblock"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8583", "listener address")
+	versionFlag := flag.String("version", "1987", "ISO 8583 version: 1987 or 1993")
+	msgType := flag.String("type", "auth", "message to send: auth, reversal or echo")
+	pan := flag.String("pan", "", "card number")
+	expiry := flag.String("expiry", "", "card expiry as YYMM")
+	amount := flag.Int64("amount", 0, "amount in cents")
+	cvv := flag.String("cvv", "", "CVV2, sent in field 48 subelement 92")
+	pin := flag.String("pin", "", "PIN, sent as a format 0 PIN block in field 52")
+	zpk := flag.String("zpk", "", "base64 TDES zone PIN key the PIN block is enciphered under")
+	cavv := flag.String("cavv", "", "3-D Secure authentication value, sent in field 48 subelement 43")
+	mcc := flag.String("mcc", "5999", "merchant category code")
+	merchant := flag.String("merchant", "MERCHANT000001", "card acceptor ID")
+	terminal := flag.String("terminal", "TERM0001", "terminal ID")
+	location := flag.String("location", "LOJA TESTE             SAO PAULO    SPBR", "card acceptor name/location")
+	entry := flag.String("entry", "", "POS entry mode (1987) or POS data code (1993)")
+	acquirer := flag.String("acquirer", "12345678", "acquiring institution ID")
+	stan := flag.String("stan", "", "system trace audit number (random if empty)")
+	rrn := flag.String("rrn", "", "retrieval reference number (random if empty)")
+	origSTAN := flag.String("orig-stan", "", "reversal: STAN of the original authorization")
+	origTime := flag.String("orig-time", "", "reversal: field 7 (1987) or field 12 (1993) of the original")
+	completed := flag.Int64("completed", 0, "reversal: amount actually completed, for a partial reversal")
+	reverse := flag.Bool("reverse", false, "auth: reverse the authorization once approved")
+	flag.Parse()
+
+	version, err := iso8583.ParseVersion(*versionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec := iso8583.NewSpec(version)
+
+	conn, err := net.DialTimeout("tcp", *addr, 5*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	now := time.Now()
+	if *stan == "" {
+		*stan = fmt.Sprintf("%06d", rand.Intn(1000000))
+	}
+	if *rrn == "" {
+		*rrn = fmt.Sprintf("%012d", rand.Int63n(1000000000000))
+	}
+
+	switch *msgType {
+	case "echo":
+		msg := iso8583.NewMessage(spec.MTI(iso8583.NetworkRequest))
+		msg.Set(7, now.UTC().Format("0102150405"))
+		msg.Set(11, *stan)
+		if version == iso8583.Version1993 {
+			msg.Set(24, "831")
+		} else {
+			msg.Set(70, "301")
+		}
+		exchange(conn, spec, msg)
+
+	case "auth":
+		msg := iso8583.NewMessage(spec.MTI(iso8583.AuthorizationRequest))
+		setCommon(msg, version, now, *pan, *amount, *stan, *rrn, *acquirer, *terminal, *merchant)
+		msg.Set(3, "000000")
+		msg.Set(18, *mcc)
+		msg.Set(43, *location)
+		if *expiry != "" {
+			msg.Set(14, *expiry)
+		}
+		if *entry != "" {
+			msg.Set(22, *entry)
+		}
+		if *pin != "" {
+			key, err := base64.StdEncoding.DecodeString(*zpk)
+			if err != nil || len(key) == 0 {
+				log.Fatal("-pin needs the zone PIN key in -zpk")
+			}
+			block, err := pinblock.Encode(*pin, pinblock.Format0, *pan, key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			msg.Set(52, block)
+		}
+		if version == iso8583.Version1993 {
+			msg.Set(24, "100")
+		}
+		private := map[string]string{}
+		if *cvv != "" {
+			private["92"] = *cvv
+		}
+		if *cavv != "" {
+			private["43"] = *cavv
+		}
+		if len(private) > 0 {
+			msg.Set(48, iso8583.FormatSubelements([]string{"43", "92"}, private))
+		}
+		resp := exchange(conn, spec, msg)
+
+		if *reverse && (resp.Get(39) == "00" || resp.Get(39) == "000") {
+			origTime := msg.Get(7)
+			if version == iso8583.Version1993 {
+				origTime = msg.Get(12)
+			}
+			rev := reversal(spec, version, msg.MTI, *pan, *amount, 0, *acquirer, *rrn, *terminal, *merchant, *stan, origTime)
+			exchange(conn, spec, rev)
+		}
+
+	case "reversal":
+		if *origSTAN == "" || *origTime == "" {
+			log.Fatal("reversal needs -orig-stan and -orig-time")
+		}
+		rev := reversal(spec, version, spec.MTI(iso8583.AuthorizationRequest), *pan, *amount, *completed,
+			*acquirer, *rrn, *terminal, *merchant, *origSTAN, *origTime)
+		exchange(conn, spec, rev)
+
+	default:
+		log.Fatalf("unknown message type %q", *msgType)
+	}
+}
+
+func setCommon(msg *iso8583.Message, version iso8583.Version, now time.Time, pan string, amount int64, stan, rrn, acquirer, terminal, merchant string) {
+	msg.Set(2, pan)
+	msg.Set(4, fmt.Sprintf("%012d", amount))
+	msg.Set(7, now.UTC().Format("0102150405"))
+	msg.Set(11, stan)
+	if version == iso8583.Version1993 {
+		msg.Set(12, now.Format("060102150405"))
+	} else {
+		msg.Set(12, now.Format("150405"))
+		msg.Set(13, now.Format("0102"))
+	}
+	msg.Set(32, acquirer)
+	msg.Set(37, rrn)
+	msg.Set(41, terminal)
+	msg.Set(42, merchant)
+	msg.Set(49, "986")
+}
+
+func reversal(spec *iso8583.Spec, version iso8583.Version, origMTI, pan string, amount, completed int64, acquirer, rrn, terminal, merchant, origSTAN, origTime string) *iso8583.Message {
+	now := time.Now()
+	msg := iso8583.NewMessage(spec.MTI(iso8583.ReversalRequest))
+	setCommon(msg, version, now, pan, amount, fmt.Sprintf("%06d", rand.Intn(1000000)), rrn, acquirer, terminal, merchant)
+	msg.Set(3, "000000")
+
+	if version == iso8583.Version1993 {
+		msg.Set(24, "400")
+		if completed > 0 {
+			msg.Set(24, "401")
+			msg.Set(4, fmt.Sprintf("%012d", completed))
+		}
+		msg.Set(56, origMTI+origSTAN+origTime+acquirer)
+		return msg
+	}
+
+	msg.Set(90, fmt.Sprintf("%s%s%s%011s%011d", origMTI, origSTAN, origTime, zeroPad(acquirer, 11), 0))
+	if completed > 0 {
+		msg.Set(95, fmt.Sprintf("%012d%012d%018d", completed, completed, 0))
+	}
+	return msg
+}
+
+func exchange(conn net.Conn, spec *iso8583.Spec, msg *iso8583.Message) *iso8583.Message {
+	packed, err := spec.Pack(msg)
+	if err != nil {
+		log.Fatalf("pack: %v", err)
+	}
+	printMessage(">>", msg)
+	if err := iso8583.WriteFrame(conn, packed); err != nil {
+		log.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	data, err := iso8583.ReadFrame(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := spec.Unpack(data)
+	if err != nil {
+		log.Fatalf("unpack: %v", err)
+	}
+	printMessage("<<", resp)
+	return resp
+}
+
+func printMessage(direction string, msg *iso8583.Message) {
+	fmt.Fprintf(os.Stdout, "%s MTI %s\n", direction, msg.MTI)
+	for _, f := range msg.Fields() {
+		value := msg.Get(f)
+		if f == 2 && len(value) > 10 {
+			value = value[:6] + "******" + value[len(value)-4:]
+		}
+		fmt.Fprintf(os.Stdout, "   %3d: %q\n", f, value)
+	}
+}
+
+func zeroPad(s string, n int) string {
+	for len(s) < n {
+		s = "0" + s
+	}
+	return s
+}
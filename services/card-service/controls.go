@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CardControls are the cardholder's spending rules for a card. Cards
+// without a row have no controls beyond their status and limit.
+type CardControls struct {
+	CardID             uuid.UUID `json:"card_id" gorm:"type:uuid;primary_key"`
+	AllowedMCCs        []string  `json:"allowed_mccs" gorm:"serializer:json"`
+	BlockedMCCs        []string  `json:"blocked_mccs" gorm:"serializer:json"`
+	AllowedCountries   []string  `json:"allowed_countries" gorm:"serializer:json"`
+	ECommerceEnabled   bool      `json:"ecommerce_enabled"`
+	ContactlessEnabled bool      `json:"contactless_enabled"`
+	ATMEnabled         bool      `json:"atm_enabled"`
+	MagstripeEnabled   bool      `json:"magstripe_enabled"`
+	WindowStart        string    `json:"window_start,omitempty"`
+	WindowEnd          string    `json:"window_end,omitempty"`
+	Timezone           string    `json:"timezone,omitempty"`
+	MaxPerTransaction  int64     `json:"max_per_transaction"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func getCardControls(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	controls := defaultCardControls(card.ID)
+	db.Where("card_id = ?", card.ID).Limit(1).Find(&controls)
+
+	c.JSON(http.StatusOK, controls)
+}
+
+// updateCardControls replaces the card's controls. Channel toggles left
+// out of the request stay enabled.
+func updateCardControls(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var req struct {
+		AllowedMCCs        []string `json:"allowed_mccs" binding:"dive,numeric,len=4"`
+		BlockedMCCs        []string `json:"blocked_mccs" binding:"dive,numeric,len=4"`
+		AllowedCountries   []string `json:"allowed_countries" binding:"dive,alpha,len=2"`
+		ECommerceEnabled   *bool    `json:"ecommerce_enabled"`
+		ContactlessEnabled *bool    `json:"contactless_enabled"`
+		ATMEnabled         *bool    `json:"atm_enabled"`
+		MagstripeEnabled   *bool    `json:"magstripe_enabled"`
+		WindowStart        string   `json:"window_start"`
+		WindowEnd          string   `json:"window_end"`
+		Timezone           string   `json:"timezone"`
+		MaxPerTransaction  int64    `json:"max_per_transaction" binding:"gte=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (req.WindowStart == "") != (req.WindowEnd == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window_start and window_end must be set together"})
+		return
+	}
+	if req.WindowStart != "" {
+		if _, err := time.Parse("15:04", req.WindowStart); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "window_start must be HH:MM"})
+			return
+		}
+		if _, err := time.Parse("15:04", req.WindowEnd); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "window_end must be HH:MM"})
+			return
+		}
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+			return
+		}
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	controls := defaultCardControls(card.ID)
+	if req.AllowedMCCs != nil {
+		controls.AllowedMCCs = req.AllowedMCCs
+	}
+	if req.BlockedMCCs != nil {
+		controls.BlockedMCCs = req.BlockedMCCs
+	}
+	controls.AllowedCountries = upperAll(req.AllowedCountries)
+	controls.WindowStart = req.WindowStart
+	controls.WindowEnd = req.WindowEnd
+	controls.Timezone = req.Timezone
+	controls.MaxPerTransaction = req.MaxPerTransaction
+	if req.ECommerceEnabled != nil {
+		controls.ECommerceEnabled = *req.ECommerceEnabled
+	}
+	if req.ContactlessEnabled != nil {
+		controls.ContactlessEnabled = *req.ContactlessEnabled
+	}
+	if req.ATMEnabled != nil {
+		controls.ATMEnabled = *req.ATMEnabled
+	}
+	if req.MagstripeEnabled != nil {
+		controls.MagstripeEnabled = *req.MagstripeEnabled
+	}
+
+	if err := db.Save(&controls).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update controls"})
+		return
+	}
+
+	c.JSON(http.StatusOK, controls)
+}
+
+func defaultCardControls(cardID uuid.UUID) CardControls {
+	return CardControls{
+		CardID:             cardID,
+		AllowedMCCs:        []string{},
+		BlockedMCCs:        []string{},
+		AllowedCountries:   []string{},
+		ECommerceEnabled:   true,
+		ContactlessEnabled: true,
+		ATMEnabled:         true,
+		MagstripeEnabled:   true,
+		UpdatedAt:          time.Now(),
+	}
+}
+
+// evaluateControls checks an authorization against the card's controls.
+// When a control is set, requests that omit the field it restricts on are
+// declined rather than let through.
+func evaluateControls(controls *CardControls, req authorizationRequest, now time.Time) *declineError {
+	if controls.MaxPerTransaction > 0 && req.Amount > controls.MaxPerTransaction {
+		return decline(declineTransactionMaxLimit, "Transaction exceeds the per-transaction maximum")
+	}
+
+	if req.MCC != "" && containsFold(controls.BlockedMCCs, req.MCC) {
+		return decline(declineMCCBlocked, "Merchant category is blocked for this card")
+	}
+	if len(controls.AllowedMCCs) > 0 && !containsFold(controls.AllowedMCCs, req.MCC) {
+		return decline(declineMCCNotAllowed, "Merchant category is not allowed for this card")
+	}
+
+	if len(controls.AllowedCountries) > 0 && !containsFold(controls.AllowedCountries, req.Country) {
+		return decline(declineCountryNotAllowed, "Country is not allowed for this card")
+	}
+
+	if !channelEnabled(controls, req.Channel) {
+		return decline(declineChannelDisabled, "Channel is disabled for this card")
+	}
+
+	if controls.WindowStart != "" && !withinWindow(controls, now) {
+		return decline(declineOutsideTimeWindow, "Card cannot be used at this time")
+	}
+
+	return nil
+}
+
+// channelEnabled reports whether the card may be used on channel. Chip
+// has no toggle. A missing or unknown channel could be any of them, so it
+// is refused once any channel is turned off.
+func channelEnabled(controls *CardControls, channel string) bool {
+	switch channel {
+	case "ecommerce":
+		return controls.ECommerceEnabled
+	case "contactless":
+		return controls.ContactlessEnabled
+	case "atm":
+		return controls.ATMEnabled
+	case "magstripe":
+		return controls.MagstripeEnabled
+	case "chip":
+		return true
+	}
+	return controls.ECommerceEnabled && controls.ContactlessEnabled && controls.ATMEnabled && controls.MagstripeEnabled
+}
+
+// withinWindow reports whether now falls in the card's usage window, read
+// in the card's timezone. A window whose end is before its start spans
+// midnight.
+func withinWindow(controls *CardControls, now time.Time) bool {
+	loc := time.UTC
+	if controls.Timezone != "" {
+		if l, err := time.LoadLocation(controls.Timezone); err == nil {
+			loc = l
+		}
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	start := clockMinutes(controls.WindowStart)
+	end := clockMinutes(controls.WindowEnd)
+
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+func clockMinutes(hhmm string) int {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+func upperAll(values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = strings.ToUpper(v)
+	}
+	return out
+}
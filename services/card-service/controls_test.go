@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEvaluateControls(t *testing.T) {
+	// Wednesday 2026-10-14 15:00 UTC, 12:00 in São Paulo.
+	now := time.Date(2026, 10, 14, 15, 0, 0, 0, time.UTC)
+	base := authorizationRequest{Amount: 5000, MerchantID: "m1", MCC: "5411", Country: "BR", Channel: "chip"}
+
+	cases := []struct {
+		name    string
+		control func(*CardControls)
+		req     func(*authorizationRequest)
+		want    string
+	}{
+		{"no controls", nil, nil, ""},
+
+		{"below per-transaction max", func(c *CardControls) { c.MaxPerTransaction = 5000 }, nil, ""},
+		{"above per-transaction max", func(c *CardControls) { c.MaxPerTransaction = 4999 }, nil, declineTransactionMaxLimit},
+
+		{"blocked MCC", func(c *CardControls) { c.BlockedMCCs = []string{"5411"} }, nil, declineMCCBlocked},
+		{"other MCC blocked", func(c *CardControls) { c.BlockedMCCs = []string{"7995"} }, nil, ""},
+		{"allowed MCC", func(c *CardControls) { c.AllowedMCCs = []string{"5411", "5812"} }, nil, ""},
+		{"MCC not allowed", func(c *CardControls) { c.AllowedMCCs = []string{"5812"} }, nil, declineMCCNotAllowed},
+		{"MCC missing with allow list", func(c *CardControls) { c.AllowedMCCs = []string{"5411"} },
+			func(r *authorizationRequest) { r.MCC = "" }, declineMCCNotAllowed},
+
+		{"allowed country", func(c *CardControls) { c.AllowedCountries = []string{"BR", "AR"} }, nil, ""},
+		{"allowed country in lower case", func(c *CardControls) { c.AllowedCountries = []string{"BR"} },
+			func(r *authorizationRequest) { r.Country = "br" }, ""},
+		{"country not allowed", func(c *CardControls) { c.AllowedCountries = []string{"AR"} }, nil, declineCountryNotAllowed},
+		{"country missing with allow list", func(c *CardControls) { c.AllowedCountries = []string{"BR"} },
+			func(r *authorizationRequest) { r.Country = "" }, declineCountryNotAllowed},
+
+		{"ecommerce disabled", func(c *CardControls) { c.ECommerceEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "ecommerce" }, declineChannelDisabled},
+		{"contactless disabled", func(c *CardControls) { c.ContactlessEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "contactless" }, declineChannelDisabled},
+		{"ATM disabled", func(c *CardControls) { c.ATMEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "atm" }, declineChannelDisabled},
+		{"magstripe disabled", func(c *CardControls) { c.MagstripeEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "magstripe" }, declineChannelDisabled},
+		{"other channel disabled", func(c *CardControls) { c.ATMEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "ecommerce" }, ""},
+		{"chip with a channel disabled", func(c *CardControls) { c.ECommerceEnabled = false }, nil, ""},
+		{"channel missing with a channel disabled", func(c *CardControls) { c.ECommerceEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "" }, declineChannelDisabled},
+		{"unknown channel with a channel disabled", func(c *CardControls) { c.ATMEnabled = false },
+			func(r *authorizationRequest) { r.Channel = "moto" }, declineChannelDisabled},
+		{"channel missing without controls", nil, func(r *authorizationRequest) { r.Channel = "" }, ""},
+
+		{"inside window", func(c *CardControls) { c.WindowStart, c.WindowEnd = "09:00", "18:00" }, nil, ""},
+		{"outside window", func(c *CardControls) { c.WindowStart, c.WindowEnd = "08:00", "14:00" }, nil, declineOutsideTimeWindow},
+		{"window in the card's timezone", func(c *CardControls) {
+			c.WindowStart, c.WindowEnd, c.Timezone = "08:00", "14:00", "America/Sao_Paulo"
+		}, nil, ""},
+		{"window spanning midnight", func(c *CardControls) { c.WindowStart, c.WindowEnd = "22:00", "16:00" }, nil, ""},
+		{"outside window spanning midnight", func(c *CardControls) { c.WindowStart, c.WindowEnd = "22:00", "06:00" }, nil, declineOutsideTimeWindow},
+	}
+	for _, tc := range cases {
+		controls := defaultCardControls(uuid.New())
+		if tc.control != nil {
+			tc.control(&controls)
+		}
+		req := base
+		if tc.req != nil {
+			tc.req(&req)
+		}
+
+		got := ""
+		if d := evaluateControls(&controls, req, now); d != nil {
+			got = d.Code
+		}
+		if got != tc.want {
+			t.Errorf("%s: decline %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
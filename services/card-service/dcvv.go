@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	cvvModeStatic  = "static"
+	cvvModeDynamic = "dynamic"
+)
+
+// dcvvToleranceSteps is how many past periods an authorization may still
+// present a dynamic CVV from, to cover checkout forms filled in just before
+// a rotation.
+const dcvvToleranceSteps = 1
+
+// CardDCVVCounter counts consecutive wrong dynamic CVVs presented for a
+// card. Three digits are quickly guessed, so once the tries run out the
+// dynamic CVV is refused until the cardholder fetches a new one.
+type CardDCVVCounter struct {
+	CardID         uuid.UUID `json:"card_id" gorm:"type:uuid;primary_key"`
+	FailedAttempts int       `json:"failed_attempts"`
+	Blocked        bool      `json:"blocked"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func maxDCVVTries() int {
+	tries, err := strconv.Atoi(getEnv("DCVV_MAX_TRIES", "5"))
+	if err != nil || tries <= 0 {
+		return 5
+	}
+	return tries
+}
+
+func defaultDCVVPeriod() int {
+	minutes, err := strconv.Atoi(getEnv("DCVV_PERIOD_MINUTES", "10"))
+	if err != nil || minutes <= 0 {
+		return 10
+	}
+	return minutes
+}
+
+// enableDynamicCVV gives the card a fresh secret the dynamic CVV is derived
+// from. The secret is stored encrypted under the card data key.
+func enableDynamicCVV(card *Card, periodMinutes int) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	encrypted, err := encryptPAN(base64.StdEncoding.EncodeToString(secret))
+	if err != nil {
+		return err
+	}
+
+	card.CVVMode = cvvModeDynamic
+	card.DCVVSecret = encrypted
+	card.DCVVPeriodMinutes = periodMinutes
+	return nil
+}
+
+func dcvvSecret(card *Card) ([]byte, error) {
+	encoded, err := decryptPAN(card.DCVVSecret)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// dynamicCVVAt computes the CVV for the period containing t, TOTP style:
+// HMAC over the period counter with dynamic truncation to three digits.
+func dynamicCVVAt(secret []byte, periodMinutes int, t time.Time) string {
+	counter := uint64(t.Unix()) / uint64(periodMinutes*60)
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%03d", code%1000)
+}
+
+// validDynamicCVV checks a dynamic CVV, counting wrong ones and blocking
+// the card's dynamic CVV when the tries run out. Like verifyPIN it commits
+// on its own so a wrong try counts even when the authorization rolls back.
+func validDynamicCVV(card *Card, cvv string, now time.Time) bool {
+	matches := dynamicCVVMatches(card, cvv, now)
+
+	valid := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var counter CardDCVVCounter
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("card_id = ?", card.ID).
+			Limit(1).Find(&counter).Error; err != nil {
+			return err
+		}
+		if counter.Blocked {
+			return nil
+		}
+		if matches {
+			valid = true
+			if counter.FailedAttempts == 0 {
+				return nil
+			}
+			counter.FailedAttempts = 0
+		} else {
+			counter.CardID = card.ID
+			counter.FailedAttempts++
+			counter.Blocked = counter.FailedAttempts >= maxDCVVTries()
+		}
+		counter.UpdatedAt = now
+		return tx.Save(&counter).Error
+	})
+	if err != nil {
+		log.Printf("counting dynamic CVV tries of card %s failed: %v", card.ID, err)
+		return false
+	}
+	return valid
+}
+
+// dynamicCVVMatches reports whether cvv is the card's dynamic CVV for now
+// or one of the tolerated past periods.
+func dynamicCVVMatches(card *Card, cvv string, now time.Time) bool {
+	secret, err := dcvvSecret(card)
+	if err != nil {
+		return false
+	}
+
+	period := time.Duration(card.DCVVPeriodMinutes) * time.Minute
+	for step := 0; step <= dcvvToleranceSteps; step++ {
+		expected := dynamicCVVAt(secret, card.DCVVPeriodMinutes, now.Add(-time.Duration(step)*period))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(cvv)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// getDynamicCVV returns the card's current dynamic CVV. Like the reveal
+// flow it is only served to the app backend after it has authenticated
+// the cardholder, so it also clears the count of wrong tries.
+func getDynamicCVV(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	actor := c.GetHeader("X-Cardholder-ID")
+	if !revealAuthorized(c) {
+		logCardAccess(c, cardID, "dynamic_cvv", actor, "unauthorized")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authorized to read card details"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	if card.CVVMode != cvvModeDynamic {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Card does not use a dynamic CVV"})
+		return
+	}
+
+	secret, err := dcvvSecret(&card)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read card details"})
+		return
+	}
+
+	now := time.Now()
+	periodSeconds := int64(card.DCVVPeriodMinutes * 60)
+	validUntil := time.Unix((now.Unix()/periodSeconds+1)*periodSeconds, 0)
+
+	if err := db.Where("card_id = ?", card.ID).Delete(&CardDCVVCounter{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read card details"})
+		return
+	}
+
+	logCardAccess(c, card.ID, "dynamic_cvv", actor, "revealed")
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"card_id":        card.ID,
+		"cvv":            dynamicCVVAt(secret, card.DCVVPeriodMinutes, now),
+		"valid_until":    validUntil,
+		"period_minutes": card.DCVVPeriodMinutes,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func dcvvTestCard(t *testing.T, periodMinutes int) *Card {
+	t.Helper()
+	saved := panKey
+	panKey = bytes.Repeat([]byte{7}, 32)
+	t.Cleanup(func() { panKey = saved })
+
+	encrypted, err := encryptPAN(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{42}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Card{CVVMode: cvvModeDynamic, DCVVSecret: encrypted, DCVVPeriodMinutes: periodMinutes}
+}
+
+func TestDynamicCVVDerivation(t *testing.T) {
+	secret := bytes.Repeat([]byte{42}, 32)
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	code := dynamicCVVAt(secret, 10, start)
+	if len(code) != 3 || code != dynamicCVVAt(secret, 10, start.Add(9*time.Minute+59*time.Second)) {
+		t.Fatalf("code %q is not one three digit value over its period", code)
+	}
+	if dynamicCVVAt(bytes.Repeat([]byte{43}, 32), 10, start) == code &&
+		dynamicCVVAt(bytes.Repeat([]byte{44}, 32), 10, start) == code {
+		t.Error("code does not depend on the secret")
+	}
+
+	changed := false
+	for i := 1; i <= 5; i++ {
+		changed = changed || dynamicCVVAt(secret, 10, start.Add(time.Duration(i)*10*time.Minute)) != code
+	}
+	if !changed {
+		t.Error("code does not rotate between periods")
+	}
+}
+
+func TestDynamicCVVTolerance(t *testing.T) {
+	card := dcvvTestCard(t, 10)
+	secret, err := dcvvSecret(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 12, 5, 0, 0, time.UTC)
+	current := dynamicCVVAt(secret, 10, now)
+	previous := dynamicCVVAt(secret, 10, now.Add(-10*time.Minute))
+	stale := dynamicCVVAt(secret, 10, now.Add(-20*time.Minute))
+
+	if !dynamicCVVMatches(card, current, now) {
+		t.Error("current code refused")
+	}
+	if !dynamicCVVMatches(card, previous, now) {
+		t.Error("code of the previous period refused")
+	}
+	if stale != current && stale != previous && dynamicCVVMatches(card, stale, now) {
+		t.Error("code from two periods ago accepted")
+	}
+	if dynamicCVVMatches(card, "1000", now) {
+		t.Error("malformed code accepted")
+	}
+}
+
+func TestRevealAuthorized(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(key string) { revealAPIKey = key }(revealAPIKey)
+
+	request := func(header string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/cards/x/dynamic-cvv", nil)
+		if header != "" {
+			c.Request.Header.Set("X-Reveal-Authorization", header)
+		}
+		return c
+	}
+
+	revealAPIKey = ""
+	if revealAuthorized(request("")) {
+		t.Error("authorized without a configured key")
+	}
+
+	revealAPIKey = "backend-key"
+	if revealAuthorized(request("")) || revealAuthorized(request("other-key")) {
+		t.Error("authorized without the right key")
+	}
+	if !revealAuthorized(request("backend-key")) {
+		t.Error("right key refused")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// The directory server emulation stands in for the card network's DS when
+// testing 3-D Secure locally: merchants send their authentication request
+// here, it checks the card range is enrolled and routes it to our ACS.
+
+// dsAuthenticate is the DS entry point for a merchant's 3DS server.
+func dsAuthenticate(c *gin.Context) {
+	var req authenticationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.DSTransID = uuid.New().String()
+
+	if !cardRangeEnrolled(req.PAN) {
+		c.JSON(http.StatusOK, gin.H{
+			"ds_trans_id":  req.DSTransID,
+			"trans_status": "U",
+			"reason":       "Card range not enrolled",
+		})
+		return
+	}
+
+	txn, err := acsAuthenticate(req)
+	switch {
+	case err == nil:
+	case errors.Is(err, errCardNotFound):
+		c.JSON(http.StatusOK, gin.H{
+			"ds_trans_id":  req.DSTransID,
+			"trans_status": threeDSNotAuthentic,
+			"reason":       "Card not enrolled",
+		})
+		return
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "ACS unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, threeDSResult(txn))
+}
+
+// dsGetResult lets the 3DS server fetch the final result of a challenged
+// authentication, in place of the RReq a real DS would relay.
+func dsGetResult(c *gin.Context) {
+	var txn ThreeDSTransaction
+	if err := db.Where("ds_trans_id = ?", c.Param("ds_trans_id")).First(&txn).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, threeDSResult(&txn))
+}
+
+// cardRangeEnrolled reports whether the PAN falls in an active card
+// program, the ranges our ACS serves.
+func cardRangeEnrolled(pan string) bool {
+	var programs []CardProgram
+	db.Where("status = ?", "active").Find(&programs)
+	for _, p := range programs {
+		if strings.HasPrefix(pan, p.IIN) && len(pan) == p.PANLength {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	disputeOpened         = "opened"
+	disputeRepresentment  = "representment"
+	disputePreArbitration = "pre_arbitration"
+	disputeWon            = "won"
+	disputeLost           = "lost"
+
+	txnDisputeCredit = "dispute_credit"
+	txnDisputeDebit  = "dispute_debit"
+
+	maxEvidenceBytes = 5 << 20
+)
+
+var (
+	errIllegalDisputeTransition = errors.New("illegal dispute status transition")
+	errTransactionNotDisputable = errors.New("only captures can be disputed")
+	errDisputeAmount            = errors.New("amount exceeds what can still be disputed")
+	errDisputeOpen              = errors.New("transaction already has an open dispute")
+)
+
+// disputeReasons are the chargeback reason codes accepted, after the
+// network's fraud, authorization, processing error and consumer groups.
+var disputeReasons = map[string]string{
+	"10.4": "Fraud - card absent environment",
+	"10.5": "Fraud - card present environment",
+	"11.3": "No authorization",
+	"12.5": "Incorrect amount",
+	"12.6": "Duplicate processing",
+	"13.1": "Merchandise or services not received",
+	"13.2": "Cancelled recurring transaction",
+	"13.3": "Not as described or defective",
+	"13.6": "Credit not processed",
+}
+
+// disputeTransitions lists the statuses each dispute status may move to.
+// The merchant may accept or represent a chargeback; the issuer may
+// accept a representment or escalate it to pre-arbitration, which ends
+// the dispute either way.
+var disputeTransitions = map[string][]string{
+	disputeOpened:         {disputeRepresentment, disputeWon},
+	disputeRepresentment:  {disputePreArbitration, disputeWon, disputeLost},
+	disputePreArbitration: {disputeWon, disputeLost},
+	disputeWon:            {},
+	disputeLost:           {},
+}
+
+// disputeDeadlineOutcome is what a dispute becomes when the party it
+// waits on lets the deadline pass.
+var disputeDeadlineOutcome = map[string]string{
+	disputeOpened:         disputeWon,
+	disputeRepresentment:  disputeLost,
+	disputePreArbitration: disputeWon,
+}
+
+// Dispute is a cardholder's contest of a captured purchase. The disputed
+// amount is credited provisionally when it is opened, and losing the
+// dispute takes the credit back; without provisional credit the amount is
+// credited when the dispute is won.
+type Dispute struct {
+	ID                uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	CardID            uuid.UUID  `json:"card_id" gorm:"type:uuid;index"`
+	AuthorizationID   uuid.UUID  `json:"authorization_id" gorm:"type:uuid;index"`
+	TransactionID     uuid.UUID  `json:"transaction_id" gorm:"type:uuid;index"`
+	Amount            int64      `json:"amount"`
+	ReasonCode        string     `json:"reason_code"`
+	Description       string     `json:"description"`
+	Status            string     `json:"status" gorm:"index"`
+	ProvisionalCredit int64      `json:"provisional_credit"`
+	Deadline          *time.Time `json:"deadline,omitempty" gorm:"index"`
+	OpenedBy          string     `json:"opened_by"`
+	ResolvedAt        *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// DisputeEvidence is a document attached to a dispute by either side.
+type DisputeEvidence struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	DisputeID   uuid.UUID `json:"dispute_id" gorm:"type:uuid;index"`
+	SubmittedBy string    `json:"submitted_by"`
+	Kind        string    `json:"kind"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	Content     []byte    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DisputeStatusChange records every transition of Dispute.Status.
+type DisputeStatusChange struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	DisputeID  uuid.UUID `json:"dispute_id" gorm:"type:uuid;index"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  string    `json:"changed_by"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func disputeStageDays() int {
+	days, err := strconv.Atoi(getEnv("DISPUTE_STAGE_DAYS", "30"))
+	if err != nil || days <= 0 {
+		return 30
+	}
+	return days
+}
+
+func canTransitionDispute(from, to string) bool {
+	for _, s := range disputeTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// adjustForDispute credits or debits the cardholder for a dispute: the
+// card's limit is given back or taken, the movement is added to the
+// card's history, where credit card invoices pick it up, and debit card
+// accounts are credited or debited through account sync. It reports
+// whether an account sync was queued. label describes the movement on the
+// account statement.
+func adjustForDispute(tx *gorm.DB, card *Card, auth *CardAuthorization, kind, label string, amount int64, now time.Time) (bool, error) {
+	if kind == txnDisputeCredit {
+		card.SpentAmount -= amount
+	} else {
+		card.SpentAmount += amount
+	}
+	if err := tx.Save(card).Error; err != nil {
+		return false, err
+	}
+
+	event, err := recordAuthorizationEvent(tx, auth, kind, amount, now)
+	if err != nil {
+		return false, err
+	}
+	if card.Funding != fundingDebit {
+		return false, nil
+	}
+
+	op := AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationCredit,
+		CaptureID:       event.ID,
+		Amount:          amount,
+		Description:     label + " - " + auth.MerchantID,
+		Status:          "pending",
+		NextAttemptAt:   now,
+		CreatedAt:       now,
+	}
+	if kind == txnDisputeDebit {
+		op.Kind = accountSyncOperationDebit
+	}
+	return true, tx.Create(&op).Error
+}
+
+// moveDispute applies a transition, settling the cardholder's balance
+// once the dispute is resolved: a lost dispute takes back the provisional
+// credit, and a won dispute credits the cardholder if none was given and
+// reverses the points the purchase earned.
+func moveDispute(id uuid.UUID, status, actor, note string) (*Dispute, error) {
+	var dispute Dispute
+	synced := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&dispute, id).Error; err != nil {
+			return err
+		}
+
+		var card Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, dispute.CardID).Error; err != nil {
+			return errCardNotFound
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&dispute, id).Error; err != nil {
+			return err
+		}
+		if !canTransitionDispute(dispute.Status, status) {
+			return errIllegalDisputeTransition
+		}
+
+		now := time.Now()
+		change := DisputeStatusChange{
+			ID:         uuid.New(),
+			DisputeID:  dispute.ID,
+			FromStatus: dispute.Status,
+			ToStatus:   status,
+			ChangedBy:  actor,
+			Note:       note,
+			CreatedAt:  now,
+		}
+		if err := tx.Create(&change).Error; err != nil {
+			return err
+		}
+
+		dispute.Status = status
+		dispute.UpdatedAt = now
+		switch status {
+		case disputeWon, disputeLost:
+			dispute.Deadline = nil
+			dispute.ResolvedAt = &now
+		default:
+			deadline := now.AddDate(0, 0, disputeStageDays())
+			dispute.Deadline = &deadline
+		}
+
+		var kind, label string
+		amount := dispute.ProvisionalCredit
+		switch {
+		case status == disputeLost && dispute.ProvisionalCredit > 0:
+			kind, label = txnDisputeDebit, "Dispute lost"
+		case status == disputeWon && dispute.ProvisionalCredit == 0:
+			kind, label, amount = txnDisputeCredit, "Dispute won", dispute.Amount
+		}
+		if (kind != "" && amount > 0) || status == disputeWon {
+			var auth CardAuthorization
+			if err := tx.First(&auth, dispute.AuthorizationID).Error; err != nil {
+				return err
+			}
+			if kind != "" && amount > 0 {
+				queued, err := adjustForDispute(tx, &card, &auth, kind, label, amount, now)
+				if err != nil {
+					return err
+				}
+				synced = queued
+			}
+			// The purchase was charged back, so its points go too.
+			if status == disputeWon {
+				if err := enqueueRewardsReversal(tx, &card, &auth, dispute.ID, dispute.Amount, now); err != nil {
+					return err
+				}
+				synced = true
+			}
+		}
+		return tx.Save(&dispute).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if synced {
+		kickAccountSync()
+	}
+	return &dispute, nil
+}
+
+func openDispute(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var req struct {
+		TransactionID string `json:"transaction_id" binding:"required"`
+		ReasonCode    string `json:"reason_code" binding:"required"`
+		Amount        int64  `json:"amount" binding:"gte=0"`
+		Description   string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	transactionID, err := uuid.Parse(req.TransactionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+	if _, ok := disputeReasons[req.ReasonCode]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown reason code"})
+		return
+	}
+
+	var dispute Dispute
+	synced := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var card Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, cardID).Error; err != nil {
+			return errCardNotFound
+		}
+
+		var txn CardTransaction
+		if err := tx.Where("id = ? AND card_id = ?", transactionID, card.ID).First(&txn).Error; err != nil {
+			return err
+		}
+		if txn.Type != txnCapture || txn.AuthorizationID == nil {
+			return errTransactionNotDisputable
+		}
+
+		var auth CardAuthorization
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&auth, *txn.AuthorizationID).Error; err != nil {
+			return err
+		}
+
+		var open int64
+		tx.Model(&Dispute{}).Where("transaction_id = ? AND status NOT IN ?", txn.ID, []string{disputeWon, disputeLost}).Count(&open)
+		if open > 0 {
+			return errDisputeOpen
+		}
+
+		// Refunds and earlier disputes already gave part of the
+		// authorization back.
+		var disputed int64
+		tx.Model(&Dispute{}).Select("COALESCE(SUM(amount), 0)").
+			Where("authorization_id = ? AND status <> ?", auth.ID, disputeLost).Scan(&disputed)
+		amount := req.Amount
+		if amount == 0 {
+			amount = txn.Amount
+		}
+		if amount > txn.Amount || amount > auth.CapturedAmount-auth.RefundedAmount-disputed {
+			return errDisputeAmount
+		}
+
+		now := time.Now()
+		deadline := now.AddDate(0, 0, disputeStageDays())
+		dispute = Dispute{
+			ID:              uuid.New(),
+			CardID:          card.ID,
+			AuthorizationID: auth.ID,
+			TransactionID:   txn.ID,
+			Amount:          amount,
+			ReasonCode:      req.ReasonCode,
+			Description:     req.Description,
+			Status:          disputeOpened,
+			Deadline:        &deadline,
+			OpenedBy:        c.GetHeader("X-Cardholder-ID"),
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		if getEnv("DISPUTE_PROVISIONAL_CREDIT", "true") == "true" {
+			dispute.ProvisionalCredit = amount
+			queued, err := adjustForDispute(tx, &card, &auth, txnDisputeCredit, "Dispute provisional credit", amount, now)
+			if err != nil {
+				return err
+			}
+			synced = queued
+		}
+		if err := tx.Create(&dispute).Error; err != nil {
+			return err
+		}
+		return tx.Create(&DisputeStatusChange{
+			ID:        uuid.New(),
+			DisputeID: dispute.ID,
+			ToStatus:  disputeOpened,
+			ChangedBy: dispute.OpenedBy,
+			Note:      disputeReasons[req.ReasonCode],
+			CreatedAt: now,
+		}).Error
+	})
+
+	switch {
+	case err == nil:
+	case errors.Is(err, errCardNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	case errors.Is(err, errTransactionNotDisputable), errors.Is(err, errDisputeAmount):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errDisputeOpen):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open dispute"})
+		return
+	}
+	if synced {
+		kickAccountSync()
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"dispute": dispute,
+		"message": "Dispute opened",
+	})
+}
+
+func updateDisputeStatus(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dispute ID"})
+		return
+	}
+
+	if !revealAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authorized to update disputes"})
+		return
+	}
+
+	var req struct {
+		Status string `json:"status" binding:"required,oneof=representment pre_arbitration won lost"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dispute, err := moveDispute(id, req.Status, c.GetHeader("X-Cardholder-ID"), req.Note)
+	switch {
+	case err == nil:
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, errCardNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+		return
+	case errors.Is(err, errIllegalDisputeTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update dispute"})
+		return
+	}
+
+	c.JSON(http.StatusOK, dispute)
+}
+
+// addDisputeEvidence attaches a document, sent base64 encoded, to a
+// dispute that is still open.
+func addDisputeEvidence(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dispute ID"})
+		return
+	}
+
+	var req struct {
+		SubmittedBy string `json:"submitted_by" binding:"required,oneof=cardholder merchant issuer"`
+		Kind        string `json:"kind" binding:"required"`
+		FileName    string `json:"file_name" binding:"required"`
+		ContentType string `json:"content_type" binding:"required"`
+		Content     string `json:"content" binding:"required,base64"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	content, err := base64.StdEncoding.DecodeString(req.Content)
+	if err != nil || len(content) > maxEvidenceBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Content must be base64 and at most 5 MB"})
+		return
+	}
+
+	var dispute Dispute
+	if err := db.First(&dispute, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+		return
+	}
+	if dispute.ResolvedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Dispute is resolved"})
+		return
+	}
+
+	evidence := DisputeEvidence{
+		ID:          uuid.New(),
+		DisputeID:   dispute.ID,
+		SubmittedBy: req.SubmittedBy,
+		Kind:        req.Kind,
+		FileName:    req.FileName,
+		ContentType: req.ContentType,
+		Size:        len(content),
+		Content:     content,
+		CreatedAt:   time.Now(),
+	}
+	if err := db.Create(&evidence).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store evidence"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, evidence)
+}
+
+func getDisputeEvidence(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dispute ID"})
+		return
+	}
+	evidenceID, err := uuid.Parse(c.Param("evidence_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid evidence ID"})
+		return
+	}
+
+	var evidence DisputeEvidence
+	if err := db.Where("id = ? AND dispute_id = ?", evidenceID, id).First(&evidence).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Evidence not found"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+evidence.FileName+"\"")
+	c.Data(http.StatusOK, evidence.ContentType, evidence.Content)
+}
+
+func getDispute(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dispute ID"})
+		return
+	}
+
+	var dispute Dispute
+	if err := db.First(&dispute, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dispute not found"})
+		return
+	}
+
+	var evidence []DisputeEvidence
+	db.Omit("content").Where("dispute_id = ?", dispute.ID).Order("created_at").Find(&evidence)
+
+	var history []DisputeStatusChange
+	db.Where("dispute_id = ?", dispute.ID).Order("created_at").Find(&history)
+
+	c.JSON(http.StatusOK, gin.H{
+		"dispute":  dispute,
+		"reason":   disputeReasons[dispute.ReasonCode],
+		"evidence": evidence,
+		"history":  history,
+	})
+}
+
+func getCardDisputes(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	query := db.Where("card_id = ?", cardID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var disputes []Dispute
+	query.Order("created_at DESC").Find(&disputes)
+
+	c.JSON(http.StatusOK, disputes)
+}
+
+// expireDisputeDeadlines resolves disputes whose deadline passed against
+// the party that failed to respond.
+func expireDisputeDeadlines(now time.Time) {
+	var due []Dispute
+	db.Where("deadline <= ? AND status IN ?", now,
+		[]string{disputeOpened, disputeRepresentment, disputePreArbitration}).Find(&due)
+
+	for _, dispute := range due {
+		status := disputeDeadlineOutcome[dispute.Status]
+		if _, err := moveDispute(dispute.ID, status, "system", "deadline passed"); err != nil {
+			log.Printf("resolving dispute %s after deadline failed: %v", dispute.ID, err)
+		}
+	}
+}
+
+func startDisputeDeadlines(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			expireDisputeDeadlines(time.Now())
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestDisputeTransitions(t *testing.T) {
+	allowed := []struct{ from, to string }{
+		{disputeOpened, disputeRepresentment},
+		{disputeOpened, disputeWon},
+		{disputeRepresentment, disputePreArbitration},
+		{disputeRepresentment, disputeLost},
+		{disputePreArbitration, disputeWon},
+	}
+	for _, tc := range allowed {
+		if !canTransitionDispute(tc.from, tc.to) {
+			t.Errorf("%s -> %s refused", tc.from, tc.to)
+		}
+	}
+
+	refused := []struct{ from, to string }{
+		{disputeOpened, disputeLost},
+		{disputeOpened, disputePreArbitration},
+		{disputeWon, disputeLost},
+		{disputeLost, disputeWon},
+		{disputePreArbitration, disputeRepresentment},
+	}
+	for _, tc := range refused {
+		if canTransitionDispute(tc.from, tc.to) {
+			t.Errorf("%s -> %s allowed", tc.from, tc.to)
+		}
+	}
+}
+
+func TestDisputeDeadlineOutcomes(t *testing.T) {
+	for from, to := range disputeDeadlineOutcome {
+		if !canTransitionDispute(from, to) {
+			t.Errorf("deadline outcome %s -> %s is not a legal transition", from, to)
+		}
+	}
+}
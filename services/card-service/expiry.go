@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const renewalReason = "renewal"
+
+// expiryEnd is the first instant a card printed with the MM/YY expiry is
+// no longer valid: cards are good through the last day of their month.
+func expiryEnd(mmyy string) (time.Time, bool) {
+	t, err := time.ParseInLocation("01/06", mmyy, time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.AddDate(0, 1, 0), true
+}
+
+// cardExpired reports whether the card is past its printed expiry or the
+// custom expiry of a single purpose card.
+func cardExpired(card *Card, now time.Time) bool {
+	if card.ExpiresAt != nil && !now.Before(*card.ExpiresAt) {
+		return true
+	}
+	end, ok := expiryEnd(card.ExpiryDate)
+	return ok && !now.Before(end)
+}
+
+func renewalLeadDays() int {
+	days, err := strconv.Atoi(getEnv("RENEWAL_LEAD_DAYS", "30"))
+	if err != nil || days < 0 {
+		return 30
+	}
+	return days
+}
+
+// renewalMonths lists the printed expiries of cards that expire within
+// the lead time, the current month included.
+func renewalMonths(now time.Time, leadDays int) []string {
+	now = now.UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	last := now.AddDate(0, 0, leadDays)
+
+	var months []string
+	for !month.After(last) {
+		months = append(months, month.Format("01/06"))
+		month = month.AddDate(0, 1, 0)
+	}
+	return months
+}
+
+// renewCards reissues cards about to expire. Only active multi-use cards
+// that were not already replaced and whose product is still offered are
+// renewed; single purpose cards run out with their expiry.
+func renewCards(now time.Time) {
+	leadDays := renewalLeadDays()
+	var due []Card
+	db.Where("status = ? AND usage = ? AND replaced_by_id IS NULL AND expires_at IS NULL AND expiry_date IN ?",
+		cardStatusActive, usageMulti, renewalMonths(now, leadDays)).Find(&due)
+
+	for i := range due {
+		card := &due[i]
+		end, ok := expiryEnd(card.ExpiryDate)
+		if !ok || end.After(now.AddDate(0, 0, leadDays)) {
+			continue
+		}
+		product, err := cardProduct(db, card)
+		if err != nil {
+			log.Printf("loading product of card %s for renewal failed: %v", card.ID, err)
+			continue
+		}
+		if product != nil && product.Status != "active" {
+			continue
+		}
+
+		replacement, err := reissue(card.ID, renewalReason, "system")
+		if err != nil {
+			log.Printf("renewing card %s failed: %v", card.ID, err)
+			continue
+		}
+
+		message := fmt.Sprintf("Your card ending in %s expires on %s. A new card ending in %s, valid until %s, has been issued.",
+			card.Last4, card.ExpiryDate, replacement.Last4, replacement.ExpiryDate)
+		if replacement.Status == cardStatusInactive {
+			message += " Activate it as soon as you receive it."
+		}
+		if err := notifyCardholder(card, "card_renewal", "push", "Your card was renewed", message); err != nil {
+			log.Printf("notifying renewal of card %s failed: %v", card.ID, err)
+		}
+	}
+}
+
+// expireCards marks cards past their expiry as expired.
+func expireCards(now time.Time) {
+	var expired, batch []Card
+	db.Where("status IN ?", []string{cardStatusInactive, cardStatusActive, cardStatusBlocked}).
+		FindInBatches(&batch, 500, func(*gorm.DB, int) error {
+			for i := range batch {
+				if cardExpired(&batch[i], now) {
+					expired = append(expired, batch[i])
+				}
+			}
+			return nil
+		})
+
+	for i := range expired {
+		card := &expired[i]
+		changed, err := expireCard(card.ID, now)
+		if err != nil {
+			log.Printf("expiring card %s failed: %v", card.ID, err)
+			continue
+		}
+		if !changed || card.Usage != usageMulti {
+			continue
+		}
+
+		message := fmt.Sprintf("Your card ending in %s has expired and can no longer be used.", card.Last4)
+		if card.ReplacedByID != nil {
+			message += " Use the new card issued to you."
+		}
+		if err := notifyCardholder(card, "card_expired", "push", "Card expired", message); err != nil {
+			log.Printf("notifying expiry of card %s failed: %v", card.ID, err)
+		}
+	}
+}
+
+// expireCard reports whether the card was moved to expired; a card whose
+// status changed since it was selected is left alone.
+func expireCard(cardID uuid.UUID, now time.Time) (bool, error) {
+	changed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var card Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, cardID).Error; err != nil {
+			return err
+		}
+		if !cardExpired(&card, now) || !canTransition(card.Status, cardStatusExpired) {
+			return nil
+		}
+		changed = true
+		return changeCardStatus(tx, &card, cardStatusExpired, "system", "expiry date reached")
+	})
+	return changed, err
+}
+
+// startCardExpiry renews cards ahead of their expiry and expires the ones
+// that reached it.
+func startCardExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			renewCards(now)
+			expireCards(now)
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const txnFee = "fee"
+
+// chargeCardFee charges one of the product's fees to the locked card.
+// Credit cards bill it on the next invoice without using limit, prepaid
+// cards pay it from their balance and debit cards have the account
+// debited through account sync. auth is the purchase the fee is on, if
+// any. It reports whether an account sync was queued.
+func chargeCardFee(tx *gorm.DB, card *Card, auth *CardAuthorization, description string, amount int64, now time.Time) (bool, error) {
+	if amount <= 0 {
+		return false, nil
+	}
+
+	event := CardTransaction{
+		ID:          uuid.New(),
+		CardID:      card.ID,
+		Type:        txnFee,
+		Amount:      amount,
+		Description: description,
+		CreatedAt:   now,
+	}
+	if auth != nil {
+		event = authorizationEvent(auth, txnFee, amount, now)
+		event.Description = description
+	}
+	if err := tx.Create(&event).Error; err != nil {
+		return false, err
+	}
+
+	switch card.Funding {
+	case fundingPrepaid:
+		card.SpentAmount += amount
+		return false, tx.Save(card).Error
+	case fundingDebit:
+		// A fee on a purchase is debited after the purchase; any other fee
+		// is ordered on its own.
+		chain := event.ID
+		if auth != nil {
+			chain = auth.ID
+		}
+		return true, tx.Create(&AccountSyncOperation{
+			ID:              uuid.New(),
+			AuthorizationID: chain,
+			AccountID:       card.AccountID,
+			Kind:            accountSyncOperationFee,
+			CaptureID:       event.ID,
+			Amount:          amount,
+			Description:     description,
+			Status:          "pending",
+			NextAttemptAt:   now,
+			CreatedAt:       now,
+		}).Error
+	}
+	return false, nil
+}
+
+// internationalFee is the product's fee on a capture abroad.
+func internationalFee(product *CardProduct, auth *CardAuthorization, amount int64) int64 {
+	if product == nil || !international(auth) {
+		return 0
+	}
+	return amount * product.InternationalFeeBPS / 10000
+}
+
+// annualFeeDue is when a card issued now first pays the product's annual
+// fee: at once, and then on each anniversary.
+func annualFeeDue(product *CardProduct, issued time.Time) *time.Time {
+	if product == nil || product.AnnualFee == 0 {
+		return nil
+	}
+	return &issued
+}
+
+// chargeAnnualFees charges the annual fee of cards whose anniversary came.
+// Replaced cards stop paying it; their replacement carries the date on.
+func chargeAnnualFees(now time.Time) {
+	var due []Card
+	db.Where("annual_fee_due_at <= ? AND status IN ? AND replaced_by_id IS NULL",
+		now, []string{cardStatusActive, cardStatusBlocked}).Find(&due)
+
+	synced := false
+	for i := range due {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var card Card
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, due[i].ID).Error; err != nil {
+				return err
+			}
+			if card.AnnualFeeDueAt == nil || card.AnnualFeeDueAt.After(now) {
+				return nil
+			}
+			product, err := cardProduct(tx, &card)
+			if err != nil {
+				return err
+			}
+			if product == nil || product.AnnualFee == 0 {
+				card.AnnualFeeDueAt = nil
+				return tx.Save(&card).Error
+			}
+
+			queued, err := chargeCardFee(tx, &card, nil, "Annual fee", product.AnnualFee, now)
+			if err != nil {
+				return err
+			}
+			synced = synced || queued
+			next := card.AnnualFeeDueAt.AddDate(1, 0, 0)
+			card.AnnualFeeDueAt = &next
+			return tx.Save(&card).Error
+		})
+		if err != nil {
+			log.Printf("charging the annual fee of card %s failed: %v", due[i].ID, err)
+		}
+	}
+	if synced {
+		kickAccountSync()
+	}
+}
+
+func startAnnualFees(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			chargeAnnualFees(time.Now())
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInternationalFee(t *testing.T) {
+	product := &CardProduct{InternationalFeeBPS: 400}
+	abroad := &CardAuthorization{Country: "US"}
+
+	if got := internationalFee(product, abroad, 10000); got != 400 {
+		t.Errorf("fee abroad = %d, want 400", got)
+	}
+	if got := internationalFee(product, &CardAuthorization{Country: "BR"}, 10000); got != 0 {
+		t.Errorf("fee at home = %d, want 0", got)
+	}
+	if got := internationalFee(nil, abroad, 10000); got != 0 {
+		t.Errorf("fee without a product = %d, want 0", got)
+	}
+}
+
+func TestAnnualFeeDue(t *testing.T) {
+	issued := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	if due := annualFeeDue(&CardProduct{AnnualFee: 0}, issued); due != nil {
+		t.Errorf("product without an annual fee is due at %v", due)
+	}
+	if due := annualFeeDue(nil, issued); due != nil {
+		t.Errorf("card without a product is due at %v", due)
+	}
+	due := annualFeeDue(&CardProduct{AnnualFee: 12000}, issued)
+	if due == nil || !due.Equal(issued) {
+		t.Errorf("annual fee due at %v, want %v", due, issued)
+	}
+}
+
+func TestChargeCardFeeSkipsFreeFees(t *testing.T) {
+	// No fee touches neither the card nor the database.
+	queued, err := chargeCardFee(nil, &Card{Funding: fundingDebit}, nil, "Card issuance fee", 0, time.Now())
+	if err != nil || queued {
+		t.Errorf("chargeCardFee(0) = %v, %v", queued, err)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	fraudApprove = "approve"
+	fraudReview  = "review"
+	fraudDecline = "decline"
+
+	declineSuspectedFraud = "suspected_fraud"
+)
+
+// FraudRule is a configured instance of a rule type. Rules are read on
+// every authorization, so edits apply at once. A triggered rule adds its
+// score; a rule whose action is decline or review forces that decision.
+type FraudRule struct {
+	ID        uuid.UUID          `json:"id" gorm:"type:uuid;primary_key"`
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Params    map[string]float64 `json:"params" gorm:"serializer:json"`
+	Score     int                `json:"score"`
+	Action    string             `json:"action"`
+	Enabled   bool               `json:"enabled"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// FraudDecision logs every evaluation with the rules that fired and what
+// finally happened to the authorization, for tuning the rules.
+type FraudDecision struct {
+	ID              uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	CardID          uuid.UUID  `json:"card_id" gorm:"type:uuid;index"`
+	AuthorizationID *uuid.UUID `json:"authorization_id,omitempty" gorm:"type:uuid"`
+	Amount          int64      `json:"amount"`
+	MerchantID      string     `json:"merchant_id"`
+	Country         string     `json:"country"`
+	Decision        string     `json:"decision" gorm:"index"`
+	Score           int        `json:"score"`
+	Hits            []fraudHit `json:"hits" gorm:"serializer:json"`
+	Outcome         string     `json:"outcome"`
+	CreatedAt       time.Time  `json:"created_at" gorm:"index"`
+}
+
+type fraudHit struct {
+	RuleID uuid.UUID `json:"rule_id"`
+	Name   string    `json:"name"`
+	Score  int       `json:"score"`
+	Detail string    `json:"detail"`
+}
+
+// fraudRuleFunc evaluates one rule type against an authorization,
+// reporting whether it fired and why.
+type fraudRuleFunc func(tx *gorm.DB, rule *FraudRule, card *Card, req authorizationRequest, now time.Time) (bool, string)
+
+// fraudRuleTypes is the registry of rule types. Adding a type here makes
+// it available to rules created through the API.
+var fraudRuleTypes = map[string]fraudRuleFunc{
+	"velocity_card":     velocityCardRule,
+	"velocity_merchant": velocityMerchantRule,
+	"unusual_amount":    unusualAmountRule,
+	"impossible_travel": impossibleTravelRule,
+	"card_testing":      cardTestingRule,
+}
+
+func fraudThreshold(env string, def int) int {
+	v, err := strconv.Atoi(getEnv(env, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// evaluateFraud runs the enabled rules and decides from their actions and
+// total score.
+func evaluateFraud(tx *gorm.DB, card *Card, req authorizationRequest, now time.Time) *FraudDecision {
+	var rules []FraudRule
+	tx.Where("enabled = ?", true).Order("created_at").Find(&rules)
+
+	decision := &FraudDecision{
+		ID:         uuid.New(),
+		CardID:     card.ID,
+		Amount:     req.Amount,
+		MerchantID: req.MerchantID,
+		Country:    req.Country,
+		Decision:   fraudApprove,
+		Hits:       []fraudHit{},
+		CreatedAt:  now,
+	}
+
+	forced := ""
+	for i := range rules {
+		rule := &rules[i]
+		eval, ok := fraudRuleTypes[rule.Type]
+		if !ok {
+			continue
+		}
+		hit, detail := eval(tx, rule, card, req, now)
+		if !hit {
+			continue
+		}
+		decision.Score += rule.Score
+		decision.Hits = append(decision.Hits, fraudHit{RuleID: rule.ID, Name: rule.Name, Score: rule.Score, Detail: detail})
+		if rule.Action == fraudDecline || (rule.Action == fraudReview && forced == "") {
+			forced = rule.Action
+		}
+	}
+
+	switch {
+	case forced == fraudDecline || decision.Score >= fraudThreshold("FRAUD_DECLINE_SCORE", 80):
+		decision.Decision = fraudDecline
+	case forced == fraudReview || decision.Score >= fraudThreshold("FRAUD_REVIEW_SCORE", 50):
+		decision.Decision = fraudReview
+	}
+	return decision
+}
+
+// logFraudDecision records the decision once the authorization's outcome
+// is known. It is written outside the authorization's transaction so
+// declined attempts are kept.
+func logFraudDecision(decision *FraudDecision, auth *CardAuthorization, err error) {
+	if decision == nil {
+		return
+	}
+	var d *declineError
+	switch {
+	case err == nil:
+		decision.Outcome = "authorized"
+		decision.AuthorizationID = &auth.ID
+	case errors.As(err, &d):
+		decision.Outcome = "declined: " + d.Code
+	default:
+		decision.Outcome = "error"
+	}
+	db.Create(decision)
+}
+
+func param(rule *FraudRule, name string, def float64) float64 {
+	if v, ok := rule.Params[name]; ok {
+		return v
+	}
+	return def
+}
+
+func window(rule *FraudRule, now time.Time, defMinutes float64) time.Time {
+	return now.Add(-time.Duration(param(rule, "window_minutes", defMinutes)) * time.Minute)
+}
+
+// velocityCardRule fires when the card already had max_count
+// authorization attempts within window_minutes, declined ones included.
+func velocityCardRule(tx *gorm.DB, rule *FraudRule, card *Card, req authorizationRequest, now time.Time) (bool, string) {
+	var count int64
+	tx.Model(&FraudDecision{}).Where("card_id = ? AND created_at > ?", card.ID, window(rule, now, 60)).Count(&count)
+	max := int64(param(rule, "max_count", 10))
+	return count >= max, fmt.Sprintf("%d attempts in window", count)
+}
+
+// velocityMerchantRule is velocityCardRule restricted to the merchant of
+// the authorization.
+func velocityMerchantRule(tx *gorm.DB, rule *FraudRule, card *Card, req authorizationRequest, now time.Time) (bool, string) {
+	var count int64
+	tx.Model(&FraudDecision{}).
+		Where("card_id = ? AND merchant_id = ? AND created_at > ?", card.ID, req.MerchantID, window(rule, now, 60)).
+		Count(&count)
+	max := int64(param(rule, "max_count", 3))
+	return count >= max, fmt.Sprintf("%d attempts at merchant in window", count)
+}
+
+// unusualAmountRule fires when the amount exceeds multiplier times the
+// card's average over lookback_days, once it has min_history
+// authorizations to compare with.
+func unusualAmountRule(tx *gorm.DB, rule *FraudRule, card *Card, req authorizationRequest, now time.Time) (bool, string) {
+	var stats struct {
+		Count   int64
+		Average float64
+	}
+	since := now.AddDate(0, 0, -int(param(rule, "lookback_days", 90)))
+	tx.Model(&CardAuthorization{}).
+		Select("COUNT(*) AS count, COALESCE(AVG(amount), 0) AS average").
+		Where("card_id = ? AND created_at > ?", card.ID, since).
+		Scan(&stats)
+
+	if stats.Count < int64(param(rule, "min_history", 5)) {
+		return false, ""
+	}
+	limit := stats.Average * param(rule, "multiplier", 5)
+	return float64(req.Amount) > limit, fmt.Sprintf("amount %d vs average %.0f", req.Amount, stats.Average)
+}
+
+// impossibleTravelRule fires when the card was used in another country
+// less than window_minutes ago.
+func impossibleTravelRule(tx *gorm.DB, rule *FraudRule, card *Card, req authorizationRequest, now time.Time) (bool, string) {
+	if req.Country == "" {
+		return false, ""
+	}
+	var last CardAuthorization
+	tx.Where("card_id = ? AND country <> '' AND created_at > ?", card.ID, window(rule, now, 120)).
+		Order("created_at DESC").Limit(1).Find(&last)
+	if last.ID == uuid.Nil || last.Country == req.Country {
+		return false, ""
+	}
+	return true, fmt.Sprintf("%s at %s, now %s", last.Country, last.CreatedAt.Format(time.RFC3339), req.Country)
+}
+
+// cardTestingRule fires on a burst of small attempts: max_count attempts
+// of at most small_amount within window_minutes, declined ones included.
+func cardTestingRule(tx *gorm.DB, rule *FraudRule, card *Card, req authorizationRequest, now time.Time) (bool, string) {
+	small := int64(param(rule, "small_amount", 500))
+	if req.Amount > small {
+		return false, ""
+	}
+	var count int64
+	tx.Model(&FraudDecision{}).
+		Where("card_id = ? AND amount <= ? AND created_at > ?", card.ID, small, window(rule, now, 10)).
+		Count(&count)
+	return count >= int64(param(rule, "max_count", 3)), fmt.Sprintf("%d small attempts in window", count)
+}
+
+// seedFraudRules installs a default rule set on first start.
+func seedFraudRules() {
+	var count int64
+	db.Model(&FraudRule{}).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	now := time.Now()
+	defaults := []FraudRule{
+		{Name: "Card velocity", Type: "velocity_card", Params: map[string]float64{"window_minutes": 60, "max_count": 10}, Score: 30, Action: "score"},
+		{Name: "Merchant velocity", Type: "velocity_merchant", Params: map[string]float64{"window_minutes": 60, "max_count": 3}, Score: 30, Action: "score"},
+		{Name: "Unusual amount", Type: "unusual_amount", Params: map[string]float64{"lookback_days": 90, "min_history": 5, "multiplier": 5}, Score: 50, Action: "score"},
+		{Name: "Impossible travel", Type: "impossible_travel", Params: map[string]float64{"window_minutes": 120}, Score: 60, Action: fraudReview},
+		{Name: "Card testing", Type: "card_testing", Params: map[string]float64{"window_minutes": 10, "small_amount": 500, "max_count": 3}, Score: 80, Action: fraudDecline},
+	}
+	for _, rule := range defaults {
+		rule.ID = uuid.New()
+		rule.Enabled = true
+		rule.CreatedAt = now
+		rule.UpdatedAt = now
+		db.Create(&rule)
+	}
+}
+
+func getFraudRules(c *gin.Context) {
+	var rules []FraudRule
+	db.Order("created_at").Find(&rules)
+
+	c.JSON(http.StatusOK, rules)
+}
+
+type fraudRuleRequest struct {
+	Name    string             `json:"name" binding:"required"`
+	Type    string             `json:"type" binding:"required"`
+	Params  map[string]float64 `json:"params"`
+	Score   int                `json:"score" binding:"gte=0,lte=100"`
+	Action  string             `json:"action" binding:"required,oneof=score review decline"`
+	Enabled *bool              `json:"enabled"`
+}
+
+func createFraudRule(c *gin.Context) {
+	var req fraudRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := fraudRuleTypes[req.Type]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown rule type"})
+		return
+	}
+
+	now := time.Now()
+	rule := FraudRule{
+		ID:        uuid.New(),
+		CreatedAt: now,
+	}
+	applyFraudRuleRequest(&rule, req, now)
+
+	if err := db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+func updateFraudRule(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return
+	}
+
+	var req fraudRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := fraudRuleTypes[req.Type]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown rule type"})
+		return
+	}
+
+	var rule FraudRule
+	if err := db.First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	applyFraudRuleRequest(&rule, req, time.Now())
+
+	if err := db.Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func applyFraudRuleRequest(rule *FraudRule, req fraudRuleRequest, now time.Time) {
+	rule.Name = req.Name
+	rule.Type = req.Type
+	rule.Params = req.Params
+	if rule.Params == nil {
+		rule.Params = map[string]float64{}
+	}
+	rule.Score = req.Score
+	rule.Action = req.Action
+	rule.Enabled = req.Enabled == nil || *req.Enabled
+	rule.UpdatedAt = now
+}
+
+func getFraudDecisions(c *gin.Context) {
+	query := db.Model(&FraudDecision{})
+	if v := c.Query("card_id"); v != "" {
+		cardID, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+			return
+		}
+		query = query.Where("card_id = ?", cardID)
+	}
+	if v := c.Query("decision"); v != "" {
+		query = query.Where("decision = ?", v)
+	}
+
+	var decisions []FraudDecision
+	query.Order("created_at DESC").Limit(200).Find(&decisions)
+
+	c.JSON(http.StatusOK, decisions)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	txnInstallment = "installment"
+
+	// Merchant plans (parcelado lojista) are interest free for the
+	// cardholder; issuer plans (parcelado emissor) carry the issuer's rate.
+	installmentMerchant = "merchant"
+	installmentIssuer   = "issuer"
+
+	planPending     = "pending"
+	planActive      = "active"
+	planCompleted   = "completed"
+	planAnticipated = "anticipated"
+
+	installmentScheduled   = "scheduled"
+	installmentPosted      = "posted"
+	installmentAnticipated = "anticipated"
+
+	declineInstallmentsNotAllowed = "installments_not_allowed"
+)
+
+var errPlanNotActive = errors.New("installment plan is not active")
+
+// InstallmentPlan splits a credit card purchase over several invoices.
+// The whole principal uses card limit from authorization on; each
+// installment is billed on its own invoice and its principal is released
+// as that invoice is paid. A plan is pending until its purchase is
+// captured, which fixes the principal.
+type InstallmentPlan struct {
+	ID              uuid.UUID     `json:"id" gorm:"type:uuid;primary_key"`
+	AuthorizationID uuid.UUID     `json:"authorization_id" gorm:"type:uuid;uniqueIndex"`
+	CardID          uuid.UUID     `json:"card_id" gorm:"type:uuid;index"`
+	AccountID       uuid.UUID     `json:"account_id" gorm:"type:uuid;index"`
+	Type            string        `json:"type"`
+	Count           int           `json:"count"`
+	InterestRateBPS int64         `json:"interest_rate_bps"`
+	Principal       int64         `json:"principal"`
+	Total           int64         `json:"total"`
+	PrincipalPosted int64         `json:"principal_posted"`
+	Status          string        `json:"status" gorm:"index"`
+	Installments    []Installment `json:"installments,omitempty" gorm:"foreignKey:PlanID"`
+	ActivatedAt     *time.Time    `json:"activated_at,omitempty"`
+	CreatedAt       time.Time     `json:"created_at"`
+	UpdatedAt       time.Time     `json:"updated_at"`
+}
+
+// Installment is one scheduled part of a plan.
+type Installment struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	PlanID    uuid.UUID  `json:"plan_id" gorm:"type:uuid;index"`
+	Number    int        `json:"number"`
+	Amount    int64      `json:"amount"`
+	Principal int64      `json:"principal"`
+	Interest  int64      `json:"interest"`
+	Status    string     `json:"status"`
+	InvoiceID *uuid.UUID `json:"invoice_id,omitempty" gorm:"type:uuid"`
+	PostedAt  *time.Time `json:"posted_at,omitempty"`
+}
+
+// installmentSchedule splits principal into count installments. Without
+// interest the cents left over go on the first one; with interest the
+// installments are level (Price table) and the last absorbs rounding.
+func installmentSchedule(principal int64, count int, rateBPS int64) []Installment {
+	schedule := make([]Installment, count)
+	if rateBPS == 0 {
+		base := principal / int64(count)
+		for i := range schedule {
+			schedule[i].Principal = base
+		}
+		schedule[0].Principal += principal - base*int64(count)
+	} else {
+		rate := float64(rateBPS) / 10000
+		payment := int64(math.Round(float64(principal) * rate / (1 - math.Pow(1+rate, -float64(count)))))
+		balance := principal
+		for i := range schedule {
+			interest := int64(math.Round(float64(balance) * rate))
+			part := payment - interest
+			if i == count-1 {
+				part = balance
+			}
+			schedule[i].Principal = part
+			schedule[i].Interest = interest
+			balance -= part
+		}
+	}
+
+	for i := range schedule {
+		schedule[i].Number = i + 1
+		schedule[i].Amount = schedule[i].Principal + schedule[i].Interest
+		schedule[i].Status = installmentScheduled
+	}
+	return schedule
+}
+
+// createInstallmentPlan records the plan requested with an authorization.
+func createInstallmentPlan(tx *gorm.DB, card *Card, auth *CardAuthorization, req authorizationRequest) error {
+	if card.Funding != fundingCredit {
+		return decline(declineInstallmentsNotAllowed, "Installments are only available on credit cards")
+	}
+
+	plan := InstallmentPlan{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		CardID:          card.ID,
+		AccountID:       card.AccountID,
+		Type:            req.InstallmentType,
+		Count:           req.Installments,
+		Principal:       auth.Amount,
+		Status:          planPending,
+		CreatedAt:       auth.CreatedAt,
+		UpdatedAt:       auth.CreatedAt,
+	}
+	if plan.Type == "" {
+		plan.Type = installmentMerchant
+	}
+	if plan.Type == installmentIssuer {
+		plan.InterestRateBPS = billingSetting("INSTALLMENT_INTEREST_RATE_BPS", 299)
+	}
+	return tx.Create(&plan).Error
+}
+
+// activateInstallmentPlan starts the plan of a purchase once it is fully
+// captured, scheduling installments on the captured amount.
+func activateInstallmentPlan(tx *gorm.DB, auth *CardAuthorization, now time.Time) error {
+	var plan InstallmentPlan
+	if err := tx.Where("authorization_id = ? AND status = ?", auth.ID, planPending).Limit(1).Find(&plan).Error; err != nil {
+		return err
+	}
+	if plan.ID == uuid.Nil || auth.CapturedAmount == 0 {
+		return nil
+	}
+
+	plan.Principal = auth.CapturedAmount
+	plan.Status = planActive
+	plan.ActivatedAt = &now
+	plan.UpdatedAt = now
+	schedule := installmentSchedule(plan.Principal, plan.Count, plan.InterestRateBPS)
+	plan.Total = 0
+	for i := range schedule {
+		schedule[i].ID = uuid.New()
+		schedule[i].PlanID = plan.ID
+		plan.Total += schedule[i].Amount
+	}
+	if err := tx.Create(&schedule).Error; err != nil {
+		return err
+	}
+	return tx.Save(&plan).Error
+}
+
+// settleInstallmentPlan brings the plan of a purchase in line with its
+// final capture. A pending plan is activated; a plan already active, as
+// after a late presentment of an expired authorization, takes the extra
+// amount spread over the installments still scheduled, or billed at once
+// when none are left.
+func settleInstallmentPlan(tx *gorm.DB, auth *CardAuthorization, amount int64, now time.Time) error {
+	var plan InstallmentPlan
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("authorization_id = ?", auth.ID).Limit(1).Find(&plan).Error; err != nil {
+		return err
+	}
+	switch {
+	case plan.ID == uuid.Nil:
+		return nil
+	case plan.Status == planPending:
+		return activateInstallmentPlan(tx, auth, now)
+	}
+
+	var remaining []Installment
+	if err := tx.Where("plan_id = ? AND status = ?", plan.ID, installmentScheduled).
+		Order("number").Find(&remaining).Error; err != nil {
+		return err
+	}
+
+	plan.Principal += amount
+	plan.UpdatedAt = now
+	if len(remaining) == 0 {
+		event, err := recordAuthorizationEvent(tx, auth, txnInstallment, amount, now)
+		if err != nil {
+			return err
+		}
+		event.Description = auth.Description + " additional"
+		if err := tx.Save(event).Error; err != nil {
+			return err
+		}
+		plan.Total += amount
+		plan.PrincipalPosted += amount
+		return tx.Save(&plan).Error
+	}
+
+	extra := installmentSchedule(amount, len(remaining), plan.InterestRateBPS)
+	for i := range remaining {
+		remaining[i].Principal += extra[i].Principal
+		remaining[i].Interest += extra[i].Interest
+		remaining[i].Amount += extra[i].Amount
+		plan.Total += extra[i].Amount
+		if err := tx.Save(&remaining[i]).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Save(&plan).Error
+}
+
+// postInstallments bills the next installment of each of the account's
+// active plans on the invoice being closed, returning their total and
+// adding their interest to the invoice's installment interest.
+func postInstallments(tx *gorm.DB, accountID uuid.UUID, invoice *Invoice, now time.Time) (int64, error) {
+	var plans []InstallmentPlan
+	if err := tx.Where("account_id = ? AND status = ? AND activated_at < ?", accountID, planActive, invoice.PeriodEnd).
+		Find(&plans).Error; err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for i := range plans {
+		plan := &plans[i]
+		var next Installment
+		if err := tx.Where("plan_id = ? AND status = ?", plan.ID, installmentScheduled).
+			Order("number").Limit(1).Find(&next).Error; err != nil {
+			return 0, err
+		}
+		if next.ID == uuid.Nil {
+			continue
+		}
+
+		var auth CardAuthorization
+		if err := tx.First(&auth, plan.AuthorizationID).Error; err != nil {
+			return 0, err
+		}
+		event, err := recordAuthorizationEvent(tx, &auth, txnInstallment, next.Amount, now)
+		if err != nil {
+			return 0, err
+		}
+		event.Description = fmt.Sprintf("%s %d/%d", auth.Description, next.Number, plan.Count)
+		event.InvoiceID = &invoice.ID
+		if err := tx.Save(event).Error; err != nil {
+			return 0, err
+		}
+
+		next.Status = installmentPosted
+		next.InvoiceID = &invoice.ID
+		next.PostedAt = &now
+		if err := tx.Save(&next).Error; err != nil {
+			return 0, err
+		}
+
+		invoice.InstallmentInterest += next.Interest
+		plan.PrincipalPosted += next.Principal
+		if next.Number == plan.Count {
+			plan.Status = planCompleted
+		}
+		if err := tx.Model(plan).Updates(map[string]interface{}{
+			"principal_posted": plan.PrincipalPosted,
+			"status":           plan.Status,
+		}).Error; err != nil {
+			return 0, err
+		}
+		total += next.Amount
+	}
+	return total, nil
+}
+
+// anticipateInstallments brings every remaining installment into the
+// current cycle, without the interest they would have carried.
+func anticipateInstallments(id uuid.UUID) (*InstallmentPlan, error) {
+	var plan InstallmentPlan
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&plan, id).Error; err != nil {
+			return err
+		}
+		if plan.Status != planActive {
+			return errPlanNotActive
+		}
+
+		var remaining []Installment
+		if err := tx.Where("plan_id = ? AND status = ?", plan.ID, installmentScheduled).Find(&remaining).Error; err != nil {
+			return err
+		}
+		var principal int64
+		for _, inst := range remaining {
+			principal += inst.Principal
+		}
+
+		var auth CardAuthorization
+		if err := tx.First(&auth, plan.AuthorizationID).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		event, err := recordAuthorizationEvent(tx, &auth, txnInstallment, principal, now)
+		if err != nil {
+			return err
+		}
+		event.Description = fmt.Sprintf("%s anticipated %d/%d", auth.Description, len(remaining), plan.Count)
+		if err := tx.Save(event).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&Installment{}).Where("plan_id = ? AND status = ?", plan.ID, installmentScheduled).
+			Updates(map[string]interface{}{"status": installmentAnticipated, "posted_at": now}).Error; err != nil {
+			return err
+		}
+
+		plan.PrincipalPosted = plan.Principal
+		plan.Status = planAnticipated
+		return tx.Model(&plan).Updates(map[string]interface{}{
+			"principal_posted": plan.PrincipalPosted,
+			"status":           plan.Status,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// unpostedPrincipal is the principal of the card's plans not yet billed,
+// which keeps using limit until it is.
+func unpostedPrincipal(tx *gorm.DB, cardID uuid.UUID) (int64, error) {
+	var amount int64
+	err := tx.Model(&InstallmentPlan{}).
+		Select("COALESCE(SUM(principal - principal_posted), 0)").
+		Where("card_id = ? AND status = ?", cardID, planActive).
+		Scan(&amount).Error
+	return amount, err
+}
+
+func getCardInstallmentPlans(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var plans []InstallmentPlan
+	db.Where("card_id = ?", cardID).Order("created_at DESC").Find(&plans)
+
+	c.JSON(http.StatusOK, plans)
+}
+
+func getInstallmentPlan(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+
+	var plan InstallmentPlan
+	if err := db.Preload("Installments", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("number")
+	}).First(&plan, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Installment plan not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+func anticipateInstallmentPlan(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+
+	plan, err := anticipateInstallments(id)
+	switch {
+	case err == nil:
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Installment plan not found"})
+		return
+	case errors.Is(err, errPlanNotActive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to anticipate installments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plan":    plan,
+		"message": "Remaining installments will be billed on the current invoice",
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestInstallmentScheduleWithoutInterest(t *testing.T) {
+	schedule := installmentSchedule(10000, 3, 0)
+	want := []int64{3334, 3333, 3333}
+	for i, inst := range schedule {
+		if inst.Number != i+1 || inst.Principal != want[i] || inst.Interest != 0 || inst.Amount != want[i] {
+			t.Errorf("installment %d = %+v, want principal %d", i+1, inst, want[i])
+		}
+		if inst.Status != installmentScheduled {
+			t.Errorf("installment %d status = %s", i+1, inst.Status)
+		}
+	}
+}
+
+func TestInstallmentScheduleWithInterest(t *testing.T) {
+	const principal = 120000
+	schedule := installmentSchedule(principal, 12, 299)
+	if len(schedule) != 12 {
+		t.Fatalf("got %d installments", len(schedule))
+	}
+
+	var sumPrincipal int64
+	for i, inst := range schedule {
+		sumPrincipal += inst.Principal
+		if inst.Amount != inst.Principal+inst.Interest {
+			t.Errorf("installment %d amount %d != principal + interest", i+1, inst.Amount)
+		}
+		if i > 0 && inst.Interest >= schedule[i-1].Interest {
+			t.Errorf("interest should decrease as the balance is paid down: %d then %d", schedule[i-1].Interest, inst.Interest)
+		}
+		// Price table installments are level, the last absorbing rounding.
+		if d := inst.Amount - schedule[0].Amount; d < -2 || d > 2 {
+			t.Errorf("installment %d amount %d is not level with %d", i+1, inst.Amount, schedule[0].Amount)
+		}
+	}
+	if sumPrincipal != principal {
+		t.Errorf("principal sums to %d, want %d", sumPrincipal, principal)
+	}
+	// 2.99% a month: the first installment's interest is on the whole principal.
+	if schedule[0].Interest != 3588 {
+		t.Errorf("first interest = %d, want 3588", schedule[0].Interest)
+	}
+}
+
+func TestInstallmentScheduleSingle(t *testing.T) {
+	schedule := installmentSchedule(999, 1, 0)
+	if len(schedule) != 1 || schedule[0].Principal != 999 {
+		t.Errorf("got %+v", schedule)
+	}
+}
@@ -0,0 +1,263 @@
+package iso8583
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxMessageSize is the largest message a two byte length header frames.
+const MaxMessageSize = 0xffff
+
+var errTruncated = errors.New("message truncated")
+
+// Pack encodes m. Values are validated against the field definitions;
+// fixed numeric values are zero padded and fixed text values space padded.
+func (s *Spec) Pack(m *Message) ([]byte, error) {
+	if len(m.MTI) != 4 || !isNumeric(m.MTI) {
+		return nil, fmt.Errorf("invalid MTI %q", m.MTI)
+	}
+
+	fields := m.Fields()
+	if len(fields) > 0 && (fields[0] < 2 || fields[len(fields)-1] > 128) {
+		return nil, errors.New("fields must be numbered 2 to 128")
+	}
+	bitmap := make([]byte, 8)
+	if len(fields) > 0 && fields[len(fields)-1] > 64 {
+		bitmap = make([]byte, 16)
+		bitmap[0] |= 0x80
+	}
+
+	out := []byte(m.MTI)
+	var body []byte
+	for _, n := range fields {
+		f, ok := s.fields[n]
+		if !ok {
+			return nil, fmt.Errorf("field %d is not defined in ISO 8583:%d", n, s.Version)
+		}
+		encoded, err := packField(f, m.Get(n))
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", n, err)
+		}
+		bitmap[(n-1)/8] |= 0x80 >> uint((n-1)%8)
+		body = append(body, encoded...)
+	}
+
+	out = append(out, bitmap...)
+	return append(out, body...), nil
+}
+
+// Unpack decodes a message packed by Pack or by a peer using the same
+// version.
+func (s *Spec) Unpack(data []byte) (*Message, error) {
+	if len(data) < 12 {
+		return nil, errTruncated
+	}
+	m := NewMessage(string(data[:4]))
+	if !isNumeric(m.MTI) {
+		return nil, fmt.Errorf("invalid MTI %q", m.MTI)
+	}
+
+	bitmap := data[4:12]
+	pos := 12
+	if bitmap[0]&0x80 != 0 {
+		if len(data) < 20 {
+			return nil, errTruncated
+		}
+		bitmap = data[4:20]
+		pos = 20
+	}
+
+	for n := 2; n <= len(bitmap)*8; n++ {
+		if bitmap[(n-1)/8]&(0x80>>uint((n-1)%8)) == 0 {
+			continue
+		}
+		f, ok := s.fields[n]
+		if !ok {
+			return nil, fmt.Errorf("field %d is not defined in ISO 8583:%d", n, s.Version)
+		}
+		value, size, err := unpackField(f, data[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", n, err)
+		}
+		m.Set(n, value)
+		pos += size
+	}
+
+	if pos != len(data) {
+		return nil, fmt.Errorf("%d trailing bytes", len(data)-pos)
+	}
+	return m, nil
+}
+
+func packField(f Field, value string) ([]byte, error) {
+	var raw []byte
+	if f.Kind == Binary {
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, errors.New("binary value must be hex")
+		}
+		raw = b
+	} else {
+		if !validChars(f.Kind, value) {
+			return nil, fmt.Errorf("invalid characters for %s", f.Name)
+		}
+		raw = []byte(value)
+	}
+
+	if len(raw) > f.Length {
+		return nil, fmt.Errorf("value longer than %d", f.Length)
+	}
+
+	if f.Prefix == 0 {
+		if len(raw) < f.Length {
+			raw = pad(f, raw)
+		}
+		return raw, nil
+	}
+
+	prefix := fmt.Sprintf("%0*d", f.Prefix, len(raw))
+	return append([]byte(prefix), raw...), nil
+}
+
+func unpackField(f Field, data []byte) (string, int, error) {
+	length, pos := f.Length, 0
+	if f.Prefix > 0 {
+		if len(data) < f.Prefix {
+			return "", 0, errTruncated
+		}
+		n, ok := parseLength(string(data[:f.Prefix]))
+		if !ok || n > f.Length {
+			return "", 0, fmt.Errorf("invalid length %q", data[:f.Prefix])
+		}
+		length, pos = n, f.Prefix
+	}
+
+	if len(data) < pos+length {
+		return "", 0, errTruncated
+	}
+	raw := data[pos : pos+length]
+
+	if f.Kind == Binary {
+		return strings.ToUpper(hex.EncodeToString(raw)), pos + length, nil
+	}
+	if !validChars(f.Kind, string(raw)) {
+		return "", 0, fmt.Errorf("invalid characters for %s", f.Name)
+	}
+	return string(raw), pos + length, nil
+}
+
+func pad(f Field, raw []byte) []byte {
+	padding := f.Length - len(raw)
+	switch f.Kind {
+	case Numeric:
+		return append([]byte(strings.Repeat("0", padding)), raw...)
+	case Binary:
+		return append(raw, make([]byte, padding)...)
+	}
+	return append(raw, []byte(strings.Repeat(" ", padding))...)
+}
+
+func validChars(kind Kind, value string) bool {
+	for _, r := range value {
+		switch kind {
+		case Numeric:
+			if r < '0' || r > '9' {
+				return false
+			}
+		case Alpha:
+			if !isLetter(r) && r != ' ' {
+				return false
+			}
+		case AlphaNumeric:
+			if !isLetter(r) && (r < '0' || r > '9') && r != ' ' {
+				return false
+			}
+		default:
+			if r < 0x20 || r > 0x7e {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isLetter(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z')
+}
+
+func isNumeric(s string) bool {
+	return validChars(Numeric, s)
+}
+
+// parseLength reads a length prefix, which is digits only: strconv.Atoi
+// alone would also take a sign.
+func parseLength(s string) (int, bool) {
+	if s == "" || !isNumeric(s) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// ReadFrame reads one message framed by a two byte big-endian length.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFrame writes data preceded by its two byte big-endian length.
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes too large to frame", len(data))
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ParseSubelements splits tag-length-value private data, such as field 48,
+// into its subelements: a two character tag, a two digit length and the
+// value.
+func ParseSubelements(data string) (map[string]string, error) {
+	out := map[string]string{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errTruncated
+		}
+		n, ok := parseLength(data[2:4])
+		if !ok || len(data) < 4+n {
+			return nil, fmt.Errorf("invalid subelement %q", data)
+		}
+		out[data[:2]] = data[4 : 4+n]
+		data = data[4+n:]
+	}
+	return out, nil
+}
+
+// FormatSubelements is the inverse of ParseSubelements, writing tags in
+// the order given.
+func FormatSubelements(tags []string, values map[string]string) string {
+	var b strings.Builder
+	for _, tag := range tags {
+		v, ok := values[tag]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "%s%02d%s", tag, len(v), v)
+	}
+	return b.String()
+}
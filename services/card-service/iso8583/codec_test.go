@@ -0,0 +1,116 @@
+package iso8583
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPackUnpackRoundTrip(t *testing.T) {
+	for _, version := range []Version{Version1987, Version1993} {
+		spec := NewSpec(version)
+		m := NewMessage(spec.MTI(AuthorizationRequest))
+		m.Set(2, "4111111111111111")
+		m.Set(3, "000000")
+		m.Set(4, "1500")
+		m.Set(11, "123456")
+		m.Set(48, FormatSubelements([]string{"92"}, map[string]string{"92": "123"}))
+
+		packed, err := spec.Pack(m)
+		if err != nil {
+			t.Fatalf("%d: pack: %v", version, err)
+		}
+		got, err := spec.Unpack(packed)
+		if err != nil {
+			t.Fatalf("%d: unpack: %v", version, err)
+		}
+		if got.MTI != m.MTI {
+			t.Errorf("%d: MTI = %q, want %q", version, got.MTI, m.MTI)
+		}
+		if got.Get(2) != "4111111111111111" {
+			t.Errorf("%d: field 2 = %q", version, got.Get(2))
+		}
+		if got.Get(4) != "000000001500" {
+			t.Errorf("%d: field 4 = %q, want zero padded amount", version, got.Get(4))
+		}
+		sub, err := ParseSubelements(got.Get(48))
+		if err != nil || sub["92"] != "123" {
+			t.Errorf("%d: field 48 = %v, %v", version, sub, err)
+		}
+	}
+}
+
+func TestUnpackRejectsBadLengths(t *testing.T) {
+	spec := NewSpec(Version1987)
+	m := NewMessage("0100")
+	m.Set(2, "4111111111111111")
+	packed, err := spec.Pack(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"-5", "+5", " 5", "99"} {
+		data := append([]byte(nil), packed...)
+		copy(data[12:14], prefix)
+		if _, err := spec.Unpack(data); err == nil {
+			t.Errorf("length %q was accepted", prefix)
+		}
+	}
+}
+
+func TestUnpackTruncated(t *testing.T) {
+	spec := NewSpec(Version1987)
+	m := NewMessage("0100")
+	m.Set(2, "4111111111111111")
+	packed, err := spec.Pack(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(packed); n++ {
+		if _, err := spec.Unpack(packed[:n]); err == nil {
+			t.Errorf("message truncated to %d bytes was accepted", n)
+		}
+	}
+}
+
+func TestParseSubelements(t *testing.T) {
+	got, err := ParseSubelements("9203123" + "4302AB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["92"] != "123" || got["43"] != "AB" {
+		t.Errorf("got %v", got)
+	}
+
+	for _, data := range []string{"92", "92-1x", "92+1x", "9205abc", "92ab123"} {
+		if _, err := ParseSubelements(data); err == nil {
+			t.Errorf("%q was accepted", data)
+		}
+	}
+}
+
+func TestResponseMTI(t *testing.T) {
+	cases := map[string]string{
+		"0100": "0110",
+		"0400": "0410",
+		"0401": "0410",
+		"1420": "1430",
+		"1421": "1430",
+		"0800": "0810",
+	}
+	for req, want := range cases {
+		if got := ResponseMTI(req); got != want {
+			t.Errorf("ResponseMTI(%q) = %q, want %q", req, got, want)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, []byte("0800")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFrame(&buf)
+	if err != nil || string(got) != "0800" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,51 @@
+// Package iso8583 encodes and decodes the ISO 8583 messages card-service
+// exchanges with processors. Messages are ASCII: a four digit MTI, a binary
+// primary bitmap, an optional secondary bitmap and the data elements, with
+// LL and LLL lengths written as ASCII digits. Binary data elements are held
+// as hex strings in a Message.
+package iso8583
+
+import "sort"
+
+// Message is an ISO 8583 message: its MTI and the data elements present.
+type Message struct {
+	MTI    string
+	fields map[int]string
+}
+
+func NewMessage(mti string) *Message {
+	return &Message{MTI: mti, fields: map[int]string{}}
+}
+
+func (m *Message) Set(field int, value string) {
+	m.fields[field] = value
+}
+
+func (m *Message) Get(field int) string {
+	return m.fields[field]
+}
+
+func (m *Message) Has(field int) bool {
+	_, ok := m.fields[field]
+	return ok
+}
+
+// Fields returns the numbers of the data elements present, in order.
+func (m *Message) Fields() []int {
+	fields := make([]int, 0, len(m.fields))
+	for f := range m.fields {
+		fields = append(fields, f)
+	}
+	sort.Ints(fields)
+	return fields
+}
+
+// Copy sets the given fields on m to their values in from, skipping those
+// from does not have. Responses use it to echo request fields.
+func (m *Message) Copy(from *Message, fields ...int) {
+	for _, f := range fields {
+		if from.Has(f) {
+			m.Set(f, from.Get(f))
+		}
+	}
+}
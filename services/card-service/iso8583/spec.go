@@ -0,0 +1,157 @@
+package iso8583
+
+import "fmt"
+
+// Version is the edition of ISO 8583 messages are exchanged in.
+type Version int
+
+const (
+	Version1987 Version = 1987
+	Version1993 Version = 1993
+)
+
+func ParseVersion(s string) (Version, error) {
+	switch s {
+	case "1987":
+		return Version1987, nil
+	case "1993":
+		return Version1993, nil
+	}
+	return 0, fmt.Errorf("unsupported ISO 8583 version %q", s)
+}
+
+// Kind is the character set of a data element.
+type Kind int
+
+const (
+	Numeric Kind = iota
+	Alpha
+	AlphaNumeric
+	AlphaNumericSpecial
+	Binary
+)
+
+// Field describes a data element. Length is the exact length of a fixed
+// element or the maximum of a variable one; Prefix is 0 for fixed elements
+// and 2 or 3 for LLVAR and LLLVAR. Binary lengths count bytes.
+type Field struct {
+	Name   string
+	Kind   Kind
+	Length int
+	Prefix int
+}
+
+// Message classes, independent of version.
+const (
+	AuthorizationRequest = iota
+	AuthorizationResponse
+	ReversalRequest
+	ReversalResponse
+	NetworkRequest
+	NetworkResponse
+)
+
+// Spec is the set of data elements and message types of one version.
+type Spec struct {
+	Version Version
+	fields  map[int]Field
+}
+
+func NewSpec(version Version) *Spec {
+	fields := make(map[int]Field, len(fields1987))
+	for n, f := range fields1987 {
+		fields[n] = f
+	}
+	if version == Version1993 {
+		for n, f := range overrides1993 {
+			fields[n] = f
+		}
+		delete(fields, 70)
+		delete(fields, 90)
+	}
+	return &Spec{Version: version, fields: fields}
+}
+
+// Field returns the definition of data element n.
+func (s *Spec) Field(n int) (Field, bool) {
+	f, ok := s.fields[n]
+	return f, ok
+}
+
+// MTI returns the message type of a message class in this version.
+func (s *Spec) MTI(class int) string {
+	mtis := map[int][2]string{
+		AuthorizationRequest:  {"0100", "1100"},
+		AuthorizationResponse: {"0110", "1110"},
+		ReversalRequest:       {"0400", "1420"},
+		ReversalResponse:      {"0410", "1430"},
+		NetworkRequest:        {"0800", "1804"},
+		NetworkResponse:       {"0810", "1814"},
+	}[class]
+	if s.Version == Version1993 {
+		return mtis[1]
+	}
+	return mtis[0]
+}
+
+// ResponseMTI returns the response type for a request type. The origin
+// digit is kept, except that repeats (0401, 1421) are answered like the
+// original message.
+func ResponseMTI(mti string) string {
+	if len(mti) != 4 {
+		return mti
+	}
+	b := []byte(mti)
+	b[2]++
+	b[3] = '0' + (b[3]-'0')&^1
+	return string(b)
+}
+
+var fields1987 = map[int]Field{
+	2:   {"Primary account number", Numeric, 19, 2},
+	3:   {"Processing code", Numeric, 6, 0},
+	4:   {"Amount, transaction", Numeric, 12, 0},
+	5:   {"Amount, settlement", Numeric, 12, 0},
+	6:   {"Amount, cardholder billing", Numeric, 12, 0},
+	7:   {"Transmission date and time", Numeric, 10, 0},
+	11:  {"System trace audit number", Numeric, 6, 0},
+	12:  {"Time, local transaction", Numeric, 6, 0},
+	13:  {"Date, local transaction", Numeric, 4, 0},
+	14:  {"Date, expiration", Numeric, 4, 0},
+	15:  {"Date, settlement", Numeric, 4, 0},
+	18:  {"Merchant type", Numeric, 4, 0},
+	19:  {"Acquiring institution country code", Numeric, 3, 0},
+	22:  {"Point of service entry mode", Numeric, 3, 0},
+	23:  {"Card sequence number", Numeric, 3, 0},
+	24:  {"Network international identifier", Numeric, 3, 0},
+	25:  {"Point of service condition code", Numeric, 2, 0},
+	32:  {"Acquiring institution identification code", Numeric, 11, 2},
+	33:  {"Forwarding institution identification code", Numeric, 11, 2},
+	35:  {"Track 2 data", AlphaNumericSpecial, 37, 2},
+	37:  {"Retrieval reference number", AlphaNumeric, 12, 0},
+	38:  {"Authorization identification response", AlphaNumeric, 6, 0},
+	39:  {"Response code", AlphaNumeric, 2, 0},
+	41:  {"Card acceptor terminal identification", AlphaNumericSpecial, 8, 0},
+	42:  {"Card acceptor identification code", AlphaNumericSpecial, 15, 0},
+	43:  {"Card acceptor name/location", AlphaNumericSpecial, 40, 0},
+	48:  {"Additional data, private", AlphaNumericSpecial, 999, 3},
+	49:  {"Currency code, transaction", AlphaNumeric, 3, 0},
+	52:  {"Personal identification number data", Binary, 8, 0},
+	53:  {"Security related control information", Numeric, 16, 0},
+	54:  {"Additional amounts", AlphaNumeric, 120, 3},
+	55:  {"ICC data", Binary, 255, 3},
+	70:  {"Network management information code", Numeric, 3, 0},
+	90:  {"Original data elements", Numeric, 42, 0},
+	95:  {"Replacement amounts", AlphaNumeric, 42, 0},
+	102: {"Account identification 1", AlphaNumericSpecial, 28, 2},
+}
+
+var overrides1993 = map[int]Field{
+	12: {"Date and time, local transaction", Numeric, 12, 0},
+	22: {"Point of service data code", AlphaNumeric, 12, 0},
+	24: {"Function code", Numeric, 3, 0},
+	25: {"Message reason code", Numeric, 4, 0},
+	39: {"Action code", Numeric, 3, 0},
+	43: {"Card acceptor name/location", AlphaNumericSpecial, 99, 2},
+	56: {"Original data elements", Numeric, 35, 2},
+}
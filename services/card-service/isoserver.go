@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"card-service/iso8583"
+
+	"github.com/google/uuid"
+)
+
+// Response codes for each outcome, as {1987 response code, 1993 action
+// code}.
+var isoResponseCodes = map[string][2]string{
+	"approved":                 {"00", "000"},
+	"reversal_accepted":        {"00", "400"},
+	"network_accepted":         {"00", "800"},
+	"format_error":             {"30", "904"},
+	"system_error":             {"96", "909"},
+	"do_not_honour":            {"05", "100"},
+	"card_not_found":           {"14", "111"},
+	declineCardInactive:        {"62", "104"},
+	declineCardExpired:         {"54", "101"},
+	declineInvalidExpiry:       {"05", "100"},
+	declineCardLost:            {"41", "208"},
+	declineCardStolen:          {"43", "209"},
+	declineCVVRequired:         {"82", "100"},
+	declineInvalidCVV:          {"82", "100"},
+	declineMerchantLocked:      {"57", "119"},
+	declineLimitExceeded:       {"61", "121"},
+	declineMCCBlocked:          {"57", "119"},
+	declineMCCNotAllowed:       {"57", "119"},
+	declineCountryNotAllowed:   {"57", "119"},
+	declineChannelDisabled:     {"57", "119"},
+	declineOutsideTimeWindow:   {"57", "119"},
+	declineTransactionMaxLimit: {"61", "121"},
+	declinePeriodLimitExceeded: {"61", "121"},
+	declineInsufficientFunds:   {"51", "116"},
+	declineIssuerUnavailable:   {"91", "912"},
+	declineAuthFailed:          {"05", "100"},
+	declineAuthRequired:        {"05", "100"},
+	declinePINRequired:         {"55", "117"},
+	declinePINInvalid:          {"55", "117"},
+	declinePINNotSet:           {"55", "117"},
+	declinePINBlocked:          {"75", "106"},
+	declineSuspectedFraud:      {"59", "102"},
+}
+
+// Network management codes: field 70 in 1987, the function code in field
+// 24 in 1993.
+var isoNetworkCodes = map[string]bool{
+	"001": true, "002": true, "301": true,
+	"801": true, "802": true, "831": true,
+}
+
+var isoSpec *iso8583.Spec
+
+// startISO8583Listener accepts processor connections on ISO8583_ADDR.
+// Each message is framed by a two byte length and handled concurrently;
+// responses are written back on the same connection as they complete.
+func startISO8583Listener() {
+	version, err := iso8583.ParseVersion(getEnv("ISO8583_VERSION", "1987"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	isoSpec = iso8583.NewSpec(version)
+
+	addr := getEnv("ISO8583_ADDR", ":8583")
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("ISO 8583 listener: %v", err)
+	}
+	log.Printf("ISO 8583:%d listener on %s", version, addr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("ISO 8583 accept: %v", err)
+				continue
+			}
+			go serveISOConnection(conn)
+		}
+	}()
+}
+
+func serveISOConnection(conn net.Conn) {
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	for {
+		data, err := iso8583.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			resp := handleISOFrameSafely(data)
+			if resp == nil {
+				return
+			}
+			packed, err := isoSpec.Pack(resp)
+			if err != nil {
+				log.Printf("ISO 8583 pack %s: %v", resp.MTI, err)
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if err := iso8583.WriteFrame(conn, packed); err != nil {
+				log.Printf("ISO 8583 write: %v", err)
+			}
+		}()
+	}
+}
+
+// handleISOFrameSafely answers a frame whose handling panicked with a
+// format error, so that one bad message cannot bring the service down.
+func handleISOFrameSafely(data []byte) (resp *iso8583.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ISO 8583 handler panic: %v", r)
+			resp = isoFormatError(data)
+		}
+	}()
+	return handleISOFrame(data)
+}
+
+func handleISOFrame(data []byte) *iso8583.Message {
+	req, err := isoSpec.Unpack(data)
+	if err != nil {
+		log.Printf("ISO 8583 unpack: %v", err)
+		return isoFormatError(data)
+	}
+
+	switch req.MTI[1:3] {
+	case "10":
+		return handleISOAuthorization(req)
+	case "40", "42":
+		return handleISOReversal(req)
+	case "80":
+		return handleISONetwork(req)
+	}
+
+	resp := isoResponse(req, 7, 11)
+	resp.Set(39, isoResponseCode("format_error"))
+	return resp
+}
+
+func handleISOAuthorization(req *iso8583.Message) *iso8583.Message {
+	resp := isoResponse(req, 2, 3, 4, 7, 11, 12, 13, 32, 37, 41, 42, 49)
+
+	amount, err := strconv.ParseInt(req.Get(4), 10, 64)
+	if err != nil || amount <= 0 || !req.Has(2) {
+		resp.Set(39, isoResponseCode("format_error"))
+		return resp
+	}
+
+	pinFormat, ok := isoPINFormat(req.Get(53))
+	if !ok {
+		resp.Set(39, isoResponseCode("format_error"))
+		return resp
+	}
+
+	card, err := findCardByPAN(db, req.Get(2))
+	if err != nil {
+		resp.Set(39, isoResponseCode("card_not_found"))
+		return resp
+	}
+
+	// Field 14 is YYMM, the card stores MM/YY.
+	expiry := isoExpiry(req.Get(14))
+	if req.Has(14) && expiry == "" {
+		resp.Set(39, isoResponseCode("format_error"))
+		return resp
+	}
+
+	private, err := iso8583.ParseSubelements(req.Get(48))
+	if err != nil {
+		resp.Set(39, isoResponseCode("format_error"))
+		return resp
+	}
+
+	merchantID := strings.TrimSpace(req.Get(42))
+	if merchantID == "" {
+		merchantID = strings.TrimSpace(req.Get(41))
+	}
+
+	result, err := processAuthorization(authorizationRequest{
+		CardID:       card.ID,
+		Amount:       amount,
+		MerchantID:   merchantID,
+		MCC:          req.Get(18),
+		Country:      isoCountry(req.Get(43)),
+		Channel:      isoChannel(req),
+		Description:  strings.TrimSpace(req.Get(43)),
+		CVV:          private["92"],
+		CAVV:         private["43"],
+		PINBlock:     req.Get(52),
+		PINFormat:    pinFormat,
+		Expiry:       expiry,
+		RetrievalRef: req.Get(37),
+		NetworkRef:   isoNetworkRef(req.Get(32), req.Get(11), isoTraceTime(req)),
+	})
+	if err != nil {
+		resp.Set(39, isoDeclineCode(err))
+		return resp
+	}
+
+	resp.Set(38, result.Authorization.ApprovalCode)
+	resp.Set(39, isoResponseCode("approved"))
+	return resp
+}
+
+// handleISOReversal reverses the authorization named by the original data
+// elements, or failing those by retrieval reference. Reversals for unknown
+// or already closed authorizations are acknowledged, so acquirers stop
+// repeating them. A partial reversal gives the amount actually completed:
+// in field 95 in 1987, in field 4 with function code 401 in 1993.
+func handleISOReversal(req *iso8583.Message) *iso8583.Message {
+	resp := isoResponse(req, 2, 3, 4, 7, 11, 32, 37, 41, 42, 49, 56, 90)
+	resp.Set(39, isoResponseCode("reversal_accepted"))
+
+	auth, ok := findReversedAuthorization(req)
+	if !ok {
+		log.Printf("ISO 8583 reversal STAN %s: original not found", req.Get(11))
+		return resp
+	}
+
+	completed := int64(0)
+	switch {
+	case isoSpec.Version == iso8583.Version1987 && len(req.Get(95)) >= 12:
+		completed, _ = strconv.ParseInt(req.Get(95)[:12], 10, 64)
+	case isoSpec.Version == iso8583.Version1993 && req.Get(24) == "401":
+		completed, _ = strconv.ParseInt(req.Get(4), 10, 64)
+	}
+
+	amount := int64(0)
+	if completed > 0 {
+		amount = auth.remaining() - completed
+		if amount <= 0 {
+			return resp
+		}
+	}
+
+	_, err := reverseAuthorization(auth.ID, amount)
+	if err != nil && !errors.Is(err, errAuthorizationNotOpen) {
+		log.Printf("ISO 8583 reversal of %s: %v", auth.ID, err)
+		resp.Set(39, isoResponseCode("system_error"))
+	}
+	return resp
+}
+
+func findReversedAuthorization(req *iso8583.Message) (*CardAuthorization, bool) {
+	var auth CardAuthorization
+
+	if ref := isoOriginalRef(req); ref != "" {
+		if db.Where("network_ref = ?", ref).Limit(1).Find(&auth); auth.ID != uuid.Nil {
+			return &auth, true
+		}
+	}
+
+	if rrn := req.Get(37); rrn != "" && req.Has(2) {
+		card, err := findCardByPAN(db, req.Get(2))
+		if err != nil {
+			return nil, false
+		}
+		db.Where("card_id = ? AND retrieval_ref = ?", card.ID, rrn).
+			Order("created_at DESC").Limit(1).Find(&auth)
+		if auth.ID != uuid.Nil {
+			return &auth, true
+		}
+	}
+	return nil, false
+}
+
+func handleISONetwork(req *iso8583.Message) *iso8583.Message {
+	resp := isoResponse(req, 7, 11, 24, 70)
+
+	code := req.Get(70)
+	if isoSpec.Version == iso8583.Version1993 {
+		code = req.Get(24)
+	}
+	if !isoNetworkCodes[code] {
+		resp.Set(39, isoResponseCode("format_error"))
+		return resp
+	}
+	resp.Set(39, isoResponseCode("network_accepted"))
+	return resp
+}
+
+// isoFormatError answers a frame that could not be handled, echoing its
+// MTI when it has one.
+func isoFormatError(data []byte) *iso8583.Message {
+	if len(data) < 4 {
+		return nil
+	}
+	resp := iso8583.NewMessage(iso8583.ResponseMTI(string(data[:4])))
+	resp.Set(39, isoResponseCode("format_error"))
+	return resp
+}
+
+func isoResponse(req *iso8583.Message, echo ...int) *iso8583.Message {
+	resp := iso8583.NewMessage(iso8583.ResponseMTI(req.MTI))
+	for _, f := range echo {
+		if _, ok := isoSpec.Field(f); ok {
+			resp.Copy(req, f)
+		}
+	}
+	return resp
+}
+
+func isoResponseCode(outcome string) string {
+	codes, ok := isoResponseCodes[outcome]
+	if !ok {
+		codes = isoResponseCodes["do_not_honour"]
+	}
+	if isoSpec.Version == iso8583.Version1993 {
+		return codes[1]
+	}
+	return codes[0]
+}
+
+func isoDeclineCode(err error) string {
+	var d *declineError
+	switch {
+	case errors.As(err, &d):
+		return isoResponseCode(d.Code)
+	case errors.Is(err, errCardNotFound):
+		return isoResponseCode("card_not_found")
+	}
+	log.Printf("ISO 8583 authorization: %v", err)
+	return isoResponseCode("system_error")
+}
+
+// isoTraceTime is the date and time that, with the STAN and acquirer,
+// identifies a message: transmission time (field 7) in 1987 and local
+// transaction time (field 12) in 1993, matching what each version carries
+// in its original data elements.
+func isoTraceTime(req *iso8583.Message) string {
+	if isoSpec.Version == iso8583.Version1993 {
+		return req.Get(12)
+	}
+	return req.Get(7)
+}
+
+func isoNetworkRef(acquirer, stan, at string) string {
+	if stan == "" || at == "" {
+		return ""
+	}
+	return strings.TrimLeft(acquirer, "0") + ":" + stan + ":" + at
+}
+
+// isoOriginalRef reads the original data elements of a reversal: field 90
+// (MTI, STAN, transmission time, acquirer, forwarder) in 1987 and field 56
+// (MTI, STAN, local time, LL acquirer) in 1993.
+func isoOriginalRef(req *iso8583.Message) string {
+	if isoSpec.Version == iso8583.Version1993 {
+		orig := req.Get(56)
+		if len(orig) < 24 {
+			return ""
+		}
+		acquirer := ""
+		if len(orig) > 24 {
+			acquirer = orig[24:]
+		}
+		return isoNetworkRef(acquirer, orig[4:10], orig[10:22])
+	}
+
+	orig := req.Get(90)
+	if len(orig) != 42 {
+		return ""
+	}
+	return isoNetworkRef(orig[20:31], orig[4:10], orig[10:20])
+}
+
+// isoExpiry turns the YYMM of field 14 into the MM/YY cards store, or
+// returns "" when it is malformed.
+func isoExpiry(yymm string) string {
+	if len(yymm) != 4 {
+		return ""
+	}
+	return yymm[2:4] + "/" + yymm[0:2]
+}
+
+// isoPINFormat reads the ISO 9564 format of the PIN block in field 52
+// from positions 5-6 of field 53. Without field 53 the block is taken to
+// be format 0. Field 52 is eight bytes in both editions, too short for a
+// 16 byte format 4 block, so format 4 (04) is refused like any unknown
+// format; it is only accepted through the JSON API.
+func isoPINFormat(control string) (int, bool) {
+	if control == "" {
+		return pinFormat0, true
+	}
+	if len(control) < 6 || control[4:6] != "00" {
+		return 0, false
+	}
+	return pinFormat0, true
+}
+
+// isoCountry takes the country from the last two characters of the card
+// acceptor name/location.
+func isoCountry(location string) string {
+	location = strings.TrimSpace(location)
+	if len(location) < 2 {
+		return ""
+	}
+	country := strings.ToUpper(location[len(location)-2:])
+	for _, r := range country {
+		if r < 'A' || r > 'Z' {
+			return ""
+		}
+	}
+	return country
+}
+
+// isoChannel derives the channel controls apply to from the processing
+// code and the POS entry mode (1987) or POS data code (1993).
+func isoChannel(req *iso8583.Message) string {
+	if strings.HasPrefix(req.Get(3), "01") {
+		return "atm"
+	}
+
+	entry := req.Get(22)
+	if isoSpec.Version == iso8583.Version1993 {
+		if len(entry) < 7 {
+			return ""
+		}
+		switch entry[6] {
+		case '2':
+			return "magstripe"
+		case '5':
+			return "chip"
+		case 'M':
+			return "contactless"
+		case 'S':
+			return "ecommerce"
+		}
+		return ""
+	}
+
+	if len(entry) < 2 {
+		return ""
+	}
+	switch entry[:2] {
+	case "02", "90":
+		return "magstripe"
+	case "05":
+		return "chip"
+	case "07", "91":
+		return "contactless"
+	case "81":
+		return "ecommerce"
+	}
+	return ""
+}
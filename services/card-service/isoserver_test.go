@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"card-service/iso8583"
+	"card-service/pinblock"
+)
+
+// TestISOAuthorizationRefusesFormat4PINBlocks sends a format 4 PIN
+// authorization through the frame handler: the 16 byte block does not fit
+// field 52, and naming format 4 in field 53 is answered with a format
+// error before the card is looked up.
+func TestISOAuthorizationRefusesFormat4PINBlocks(t *testing.T) {
+	defer func(spec *iso8583.Spec) { isoSpec = spec }(isoSpec)
+
+	const pan = "4111111111111111"
+	block, err := pinblock.Encode("2580", pinblock.Format4, pan, bytes.Repeat([]byte{0x2b}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []iso8583.Version{iso8583.Version1987, iso8583.Version1993} {
+		isoSpec = iso8583.NewSpec(version)
+
+		req := iso8583.NewMessage(isoSpec.MTI(iso8583.AuthorizationRequest))
+		req.Set(2, pan)
+		req.Set(3, "000000")
+		req.Set(4, "2500")
+		req.Set(11, "000042")
+		req.Set(53, "2001040000000000")
+
+		req.Set(52, block)
+		if _, err := isoSpec.Pack(req); err == nil {
+			t.Fatalf("%d: a 16 byte PIN block was packed into field 52", version)
+		}
+
+		req.Set(52, block[:16])
+		packed, err := isoSpec.Pack(req)
+		if err != nil {
+			t.Fatalf("%d: pack: %v", version, err)
+		}
+		resp := handleISOFrameSafely(packed)
+		if resp == nil {
+			t.Fatalf("%d: no response", version)
+		}
+		if got, want := resp.Get(39), isoResponseCode("format_error"); got != want {
+			t.Errorf("%d: response code %q, want format error %q", version, got, want)
+		}
+		if _, err := isoSpec.Pack(resp); err != nil {
+			t.Errorf("%d: packing the response: %v", version, err)
+		}
+	}
+}
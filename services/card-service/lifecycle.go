@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	cardStatusInactive = "inactive"
+	cardStatusActive   = "active"
+	cardStatusBlocked  = "blocked"
+	cardStatusLost     = "lost"
+	cardStatusStolen   = "stolen"
+	cardStatusExpired  = "expired"
+	cardStatusClosed   = "closed"
+)
+
+const (
+	declineCardLost   = "card_lost"
+	declineCardStolen = "card_stolen"
+)
+
+var (
+	errIllegalTransition = errors.New("illegal card status transition")
+	errCardNotReissuable = errors.New("card cannot be reissued")
+)
+
+// cardTransitions lists the statuses each status may move to. Lost,
+// stolen, expired and closed are permanent: such a card can only be
+// closed, never used again.
+var cardTransitions = map[string][]string{
+	cardStatusInactive: {cardStatusActive, cardStatusLost, cardStatusStolen, cardStatusExpired, cardStatusClosed},
+	cardStatusActive:   {cardStatusBlocked, cardStatusLost, cardStatusStolen, cardStatusExpired, cardStatusClosed},
+	cardStatusBlocked:  {cardStatusActive, cardStatusLost, cardStatusStolen, cardStatusExpired, cardStatusClosed},
+	cardStatusLost:     {cardStatusClosed},
+	cardStatusStolen:   {cardStatusClosed},
+	cardStatusExpired:  {cardStatusClosed},
+	cardStatusClosed:   {},
+}
+
+// CardStatusChange records every transition of Card.Status.
+type CardStatusChange struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	CardID     uuid.UUID `json:"card_id" gorm:"type:uuid;index"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  string    `json:"changed_by"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range cardTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func changeCardStatus(tx *gorm.DB, card *Card, status, changedBy, reason string) error {
+	if !canTransition(card.Status, status) {
+		return errIllegalTransition
+	}
+	return recordCardStatus(tx, card, status, changedBy, reason)
+}
+
+// recordCardStatus sets and records the status without checking the
+// transition.
+func recordCardStatus(tx *gorm.DB, card *Card, status, changedBy, reason string) error {
+	change := CardStatusChange{
+		ID:         uuid.New(),
+		CardID:     card.ID,
+		FromStatus: card.Status,
+		ToStatus:   status,
+		ChangedBy:  changedBy,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	}
+
+	card.Status = status
+	if err := tx.Save(card).Error; err != nil {
+		return err
+	}
+	return tx.Create(&change).Error
+}
+
+// transitionCard moves the card identified in the path to status and
+// writes the response. When from is given, the card must currently be in
+// one of those statuses, so that endpoints meant for one step, such as
+// unblocking, cannot be used for another. Activating a replacement card
+// closes the card it replaces.
+func transitionCard(c *gin.Context, status, reason, message string, from ...string) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+	actor := c.GetHeader("X-Cardholder-ID")
+
+	var card Card
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, cardID).Error; err != nil {
+			return errCardNotFound
+		}
+		if len(from) > 0 && !containsString(from, card.Status) {
+			return errIllegalTransition
+		}
+		activating := card.Status == cardStatusInactive && status == cardStatusActive
+		if err := changeCardStatus(tx, &card, status, actor, reason); err != nil {
+			return err
+		}
+		if activating && card.ReplacesID != nil {
+			return closeReplacedCard(tx, *card.ReplacesID, actor)
+		}
+		return nil
+	})
+
+	switch err {
+	case nil:
+	case errCardNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	case errIllegalTransition:
+		c.JSON(http.StatusConflict, gin.H{"error": "Card cannot move from " + card.Status + " to " + status})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update card status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"card":    card,
+		"message": message,
+	})
+}
+
+func closeReplacedCard(tx *gorm.DB, cardID uuid.UUID, actor string) error {
+	var old Card
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&old, cardID).Error; err != nil {
+		return err
+	}
+	if old.Status == cardStatusClosed {
+		return nil
+	}
+	return changeCardStatus(tx, &old, cardStatusClosed, actor, "replacement activated")
+}
+
+func updateCardStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required,oneof=active blocked lost stolen expired closed"`
+		Reason string `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transitionCard(c, req.Status, req.Reason, "Card status updated")
+}
+
+func activateCard(c *gin.Context) {
+	transitionCard(c, cardStatusActive, "activated by cardholder", "Card activated", cardStatusInactive)
+}
+
+func getCardStatusHistory(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var changes []CardStatusChange
+	db.Where("card_id = ?", cardID).Order("created_at").Find(&changes)
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// reissueCard creates a replacement with a new number, carrying over the
+// limit, limit consumption, controls and CVV mode. A lost or stolen card is
+// marked so at once; for damage or renewal the old card keeps working
+// until the replacement is activated. Physical replacements start inactive
+// until the cardholder receives them.
+func reissueCard(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason" binding:"required,oneof=lost stolen damaged renewal"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	replacement, err := reissue(cardID, req.Reason, c.GetHeader("X-Cardholder-ID"))
+	switch {
+	case err == nil:
+	case errors.Is(err, errCardNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	case errors.Is(err, errIllegalTransition), errors.Is(err, errCardNotReissuable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reissue card"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"card":    replacement,
+		"message": "Replacement card issued",
+	})
+}
+
+func reissue(cardID uuid.UUID, reason, actor string) (*Card, error) {
+	var replacement Card
+	synced := false
+	issue := func(tx *gorm.DB) error {
+		var old Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&old, cardID).Error; err != nil {
+			return errCardNotFound
+		}
+		if old.Status == cardStatusClosed || old.ReplacedByID != nil || old.Usage != usageMulti {
+			return errCardNotReissuable
+		}
+
+		var program CardProgram
+		if err := tx.First(&program, old.ProgramID).Error; err != nil {
+			return err
+		}
+		pan, err := issuePAN(&program)
+		if err != nil {
+			return err
+		}
+		validityMonths := defaultValidityMonths
+		product, err := cardProduct(tx, &old)
+		if err != nil {
+			return err
+		}
+		if product != nil {
+			validityMonths = product.ValidityMonths
+		}
+
+		now := time.Now()
+		replacement = Card{
+			ID:             uuid.New(),
+			AccountID:      old.AccountID,
+			ProductID:      old.ProductID,
+			ProgramID:      old.ProgramID,
+			ExpiryDate:     expiryFor(validityMonths),
+			Status:         cardStatusActive,
+			Type:           old.Type,
+			Limit:          old.Limit,
+			AnnualFeeDueAt: old.AnnualFeeDueAt,
+			CVVMode:        cvvModeStatic,
+			Usage:          old.Usage,
+			Funding:        old.Funding,
+			ReplacesID:     &old.ID,
+			CreatedAt:      now,
+		}
+		if old.Type != "virtual" {
+			replacement.Status = cardStatusInactive
+		}
+		if err := setPAN(&replacement, pan); err != nil {
+			return err
+		}
+		if old.CVVMode == cvvModeDynamic {
+			if err := enableDynamicCVV(&replacement, old.DCVVPeriodMinutes); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&replacement).Error; err != nil {
+			return err
+		}
+		if product != nil && reason != renewalReason {
+			queued, err := chargeCardFee(tx, &replacement, nil, "Card replacement fee", product.ReplacementFee, now)
+			if err != nil {
+				return err
+			}
+			synced = queued
+		}
+
+		var controls CardControls
+		if err := tx.Where("card_id = ?", old.ID).Limit(1).Find(&controls).Error; err != nil {
+			return err
+		}
+		if controls.CardID != uuid.Nil {
+			controls.CardID = replacement.ID
+			controls.UpdatedAt = now
+			if err := tx.Create(&controls).Error; err != nil {
+				return err
+			}
+		}
+
+		var limits []CardLimit
+		if err := tx.Where("card_id = ?", old.ID).Find(&limits).Error; err != nil {
+			return err
+		}
+		for i := range limits {
+			limits[i].ID = uuid.New()
+			limits[i].CardID = replacement.ID
+			limits[i].CreatedAt = now
+			limits[i].UpdatedAt = now
+		}
+		if len(limits) > 0 {
+			if err := tx.Create(&limits).Error; err != nil {
+				return err
+			}
+		}
+
+		old.ReplacedByID = &replacement.ID
+		switch reason {
+		case cardStatusLost, cardStatusStolen:
+			if old.Status != reason {
+				return changeCardStatus(tx, &old, reason, actor, "reissued")
+			}
+		case "renewal", "damaged":
+			// Virtual replacements are active at once and supersede the
+			// old card immediately.
+			if replacement.Status == cardStatusActive && old.Status != cardStatusClosed {
+				return changeCardStatus(tx, &old, cardStatusClosed, actor, "reissued: "+reason)
+			}
+		}
+		return tx.Save(&old).Error
+	}
+	err := retryPANCollision(func() error {
+		synced = false
+		return db.Transaction(issue)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if synced {
+		kickAccountSync()
+	}
+	return &replacement, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	limitWindowTransaction  = "transaction"
+	limitWindowDaily        = "daily"
+	limitWindowWeekly       = "weekly"
+	limitWindowMonthly      = "monthly"
+	limitWindowBillingCycle = "billing_cycle"
+
+	limitModeCalendar = "calendar"
+	limitModeRolling  = "rolling"
+
+	declinePeriodLimitExceeded = "period_limit_exceeded"
+)
+
+var errBillingCycleLimit = errors.New("billing_cycle limits are only offered on credit cards")
+
+// CardLimit caps spending over one window, on top of the card's overall
+// Limit. Calendar windows reset at local midnight, on Mondays or on the
+// first of the month, in the limit's timezone, and billing cycle windows
+// when the credit account's invoice closes; rolling windows look back a
+// fixed span from now.
+type CardLimit struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	CardID    uuid.UUID `json:"card_id" gorm:"type:uuid;uniqueIndex:idx_card_limit_window"`
+	Window    string    `json:"window" gorm:"uniqueIndex:idx_card_limit_window"`
+	Mode      string    `json:"mode"`
+	Amount    int64     `json:"amount"`
+	Timezone  string    `json:"timezone,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// limitConsumption is a limit with what has been spent against it in the
+// current window.
+type limitConsumption struct {
+	CardLimit
+	Used        int64      `json:"used"`
+	Remaining   int64      `json:"remaining"`
+	PeriodStart *time.Time `json:"period_start,omitempty"`
+	ResetsAt    *time.Time `json:"resets_at,omitempty"`
+}
+
+func (l *CardLimit) location() *time.Location {
+	if l.Timezone != "" {
+		if loc, err := time.LoadLocation(l.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// period returns the window containing now. Calendar boundaries are
+// computed on the local date so they stay at midnight across DST changes.
+// Rolling windows have no fixed reset, so end is zero. Billing cycle
+// windows are the cycle of the card's credit account, or the calendar
+// month without one.
+func (l *CardLimit) period(now time.Time, account *CreditAccount) (start, end time.Time) {
+	local := now.In(l.location())
+
+	if l.Mode == limitModeRolling {
+		switch l.Window {
+		case limitWindowDaily:
+			return local.AddDate(0, 0, -1), time.Time{}
+		case limitWindowWeekly:
+			return local.AddDate(0, 0, -7), time.Time{}
+		default:
+			return local.AddDate(0, -1, 0), time.Time{}
+		}
+	}
+
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	switch l.Window {
+	case limitWindowDaily:
+		return midnight, midnight.AddDate(0, 0, 1)
+	case limitWindowWeekly:
+		start = midnight.AddDate(0, 0, -((int(local.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case limitWindowBillingCycle:
+		if account != nil {
+			return account.cycleAt(now)
+		}
+		fallthrough
+	default:
+		start = time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, local.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+}
+
+// cardLineage is the card and the cards it replaced, so a reissued card
+// keeps counting what its predecessors spent in the current windows.
+func cardLineage(tx *gorm.DB, card *Card) []uuid.UUID {
+	ids := []uuid.UUID{card.ID}
+	next := card.ReplacesID
+	for next != nil && len(ids) < 10 {
+		var prev Card
+		if err := tx.Select("id", "replaces_id").Where("id = ?", *next).Limit(1).Find(&prev).Error; err != nil || prev.ID == uuid.Nil {
+			break
+		}
+		ids = append(ids, prev.ID)
+		next = prev.ReplacesID
+	}
+	return ids
+}
+
+// lineageSpent is the limit the card and the cards it replaced use. Each
+// card's SpentAmount follows its own authorizations, which keep settling
+// after a reissue, so the replacement starts from zero and they are added
+// up here.
+func lineageSpent(tx *gorm.DB, card *Card) int64 {
+	ids := cardLineage(tx, card)
+	if len(ids) == 1 {
+		return card.SpentAmount
+	}
+	var spent int64
+	tx.Model(&Card{}).Select("COALESCE(SUM(spent_amount), 0)").Where("id IN ?", ids[1:]).Scan(&spent)
+	return card.SpentAmount + spent
+}
+
+// spentSince sums what the card's authorizations made since start still
+// hold or have captured; voided, reversed, expired and refunded parts
+// don't count.
+func spentSince(tx *gorm.DB, cardIDs []uuid.UUID, start time.Time) int64 {
+	var spent int64
+	tx.Model(&CardAuthorization{}).
+		Select("COALESCE(SUM(amount - released_amount - refunded_amount), 0)").
+		Where("card_id IN ? AND created_at >= ?", cardIDs, start).
+		Scan(&spent)
+	return spent
+}
+
+// limitCreditAccount is the credit account whose cycle the card's billing
+// cycle limits follow, if it has one.
+func limitCreditAccount(tx *gorm.DB, card *Card) (*CreditAccount, error) {
+	if card.Funding != fundingCredit {
+		return nil, nil
+	}
+	var account CreditAccount
+	if err := tx.Where("account_id = ?", card.AccountID).Limit(1).Find(&account).Error; err != nil {
+		return nil, err
+	}
+	if account.AccountID == uuid.Nil {
+		return nil, nil
+	}
+	return &account, nil
+}
+
+// checkPeriodicLimits declines amount if it would exceed any of the
+// card's limits in the current window.
+func checkPeriodicLimits(tx *gorm.DB, card *Card, amount int64, now time.Time) error {
+	var limits []CardLimit
+	if err := tx.Where("card_id = ?", card.ID).Find(&limits).Error; err != nil {
+		return err
+	}
+
+	var lineage []uuid.UUID
+	var account *CreditAccount
+	for _, l := range limits {
+		if l.Window == limitWindowTransaction {
+			if amount > l.Amount {
+				return decline(declineTransactionMaxLimit, "Transaction exceeds per-transaction limit")
+			}
+			continue
+		}
+		if lineage == nil {
+			lineage = cardLineage(tx, card)
+		}
+		if l.Window == limitWindowBillingCycle && account == nil {
+			var err error
+			if account, err = limitCreditAccount(tx, card); err != nil {
+				return err
+			}
+		}
+		start, _ := l.period(now, account)
+		if spentSince(tx, lineage, start)+amount > l.Amount {
+			return decline(declinePeriodLimitExceeded, "Transaction exceeds "+l.Window+" limit")
+		}
+	}
+	return nil
+}
+
+func getCardLimits(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	var limits []CardLimit
+	db.Where("card_id = ?", card.ID).Order("created_at").Find(&limits)
+
+	account, err := limitCreditAccount(db, &card)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credit account"})
+		return
+	}
+
+	now := time.Now()
+	lineage := cardLineage(db, &card)
+	result := make([]limitConsumption, 0, len(limits))
+	for _, l := range limits {
+		usage := limitConsumption{CardLimit: l, Remaining: l.Amount}
+		if l.Window != limitWindowTransaction {
+			start, end := l.period(now, account)
+			usage.PeriodStart = &start
+			if !end.IsZero() {
+				usage.ResetsAt = &end
+			}
+			usage.Used = spentSince(db, lineage, start)
+			usage.Remaining = l.Amount - usage.Used
+			if usage.Remaining < 0 {
+				usage.Remaining = 0
+			}
+		}
+		result = append(result, usage)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"card_id":         card.ID,
+		"limit":           card.Limit,
+		"spent_amount":    lineageSpent(db, &card),
+		"remaining_limit": card.Limit - lineageSpent(db, &card),
+		"limits":          result,
+	})
+}
+
+// updateCardLimits replaces the card's periodic limits with the given
+// set; an empty set removes them.
+func updateCardLimits(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var req struct {
+		Limits []struct {
+			Window   string `json:"window" binding:"required,oneof=transaction daily weekly monthly billing_cycle"`
+			Mode     string `json:"mode" binding:"omitempty,oneof=calendar rolling"`
+			Amount   int64  `json:"amount" binding:"required,gt=0"`
+			Timezone string `json:"timezone"`
+		} `json:"limits" binding:"dive"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	limits := make([]CardLimit, 0, len(req.Limits))
+	seen := map[string]bool{}
+	for _, r := range req.Limits {
+		if seen[r.Window] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate limit window: " + r.Window})
+			return
+		}
+		seen[r.Window] = true
+
+		if r.Timezone != "" {
+			if _, err := time.LoadLocation(r.Timezone); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+				return
+			}
+		}
+		limit := CardLimit{
+			ID:        uuid.New(),
+			CardID:    cardID,
+			Window:    r.Window,
+			Mode:      r.Mode,
+			Amount:    r.Amount,
+			Timezone:  r.Timezone,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		switch r.Window {
+		case limitWindowTransaction:
+			limit.Mode = ""
+			limit.Timezone = ""
+		case limitWindowBillingCycle:
+			if r.Mode == limitModeRolling {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "billing_cycle limits follow the calendar"})
+				return
+			}
+			limit.Mode = limitModeCalendar
+			limit.Timezone = ""
+		default:
+			if limit.Mode == "" {
+				limit.Mode = limitModeCalendar
+			}
+		}
+		limits = append(limits, limit)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var card Card
+		if err := tx.First(&card, cardID).Error; err != nil {
+			return errCardNotFound
+		}
+		if seen[limitWindowBillingCycle] && card.Funding != fundingCredit {
+			return errBillingCycleLimit
+		}
+		if err := tx.Where("card_id = ?", cardID).Delete(&CardLimit{}).Error; err != nil {
+			return err
+		}
+		if len(limits) == 0 {
+			return nil
+		}
+		return tx.Create(&limits).Error
+	})
+	if errors.Is(err, errCardNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+	if errors.Is(err, errBillingCycleLimit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update limits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"limits":  limits,
+		"message": "Limits updated successfully",
+	})
+}
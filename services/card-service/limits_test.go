@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendarPeriods(t *testing.T) {
+	// Wednesday 02:30 UTC, still Tuesday evening in São Paulo: the limit's
+	// timezone decides the day.
+	now := time.Date(2026, 10, 14, 2, 30, 0, 0, time.UTC)
+	sp, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+
+	cases := []struct {
+		limit      CardLimit
+		start, end time.Time
+	}{
+		{
+			CardLimit{Window: limitWindowDaily, Mode: limitModeCalendar},
+			time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			CardLimit{Window: limitWindowDaily, Mode: limitModeCalendar, Timezone: "America/Sao_Paulo"},
+			time.Date(2026, 10, 13, 0, 0, 0, 0, sp),
+			time.Date(2026, 10, 14, 0, 0, 0, 0, sp),
+		},
+		{
+			CardLimit{Window: limitWindowWeekly, Mode: limitModeCalendar},
+			time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			CardLimit{Window: limitWindowMonthly, Mode: limitModeCalendar},
+			time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			CardLimit{Window: limitWindowBillingCycle, Mode: limitModeCalendar},
+			time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range cases {
+		start, end := tc.limit.period(now, nil)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s %s in %q: period %v to %v, want %v to %v",
+				tc.limit.Mode, tc.limit.Window, tc.limit.Timezone, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestBillingCyclePeriod(t *testing.T) {
+	account := &CreditAccount{
+		ClosingDay:    10,
+		CycleStartAt:  time.Date(2026, 9, 10, 3, 0, 0, 0, time.UTC),
+		NextClosingAt: time.Date(2026, 10, 10, 3, 0, 0, 0, time.UTC),
+	}
+	limit := &CardLimit{Window: limitWindowBillingCycle, Mode: limitModeCalendar}
+
+	cases := []struct {
+		now, start, end time.Time
+	}{
+		{time.Date(2026, 9, 25, 12, 0, 0, 0, time.UTC), account.CycleStartAt, account.NextClosingAt},
+		// The statement has closed but the billing job hasn't run yet.
+		{time.Date(2026, 10, 10, 4, 0, 0, 0, time.UTC), account.NextClosingAt, account.nextClosing(account.NextClosingAt)},
+	}
+	for _, tc := range cases {
+		start, end := limit.period(tc.now, account)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("billing cycle at %v: period %v to %v, want %v to %v", tc.now, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestWeeklyPeriodOnSunday(t *testing.T) {
+	now := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	start, end := (&CardLimit{Window: limitWindowWeekly, Mode: limitModeCalendar}).period(now, nil)
+	if want := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("week of Sunday starts %v, want %v", start, want)
+	}
+	if want := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC); !end.Equal(want) {
+		t.Errorf("week of Sunday ends %v, want %v", end, want)
+	}
+}
+
+func TestRollingPeriods(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 45, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		limitWindowDaily:   time.Date(2026, 10, 13, 15, 45, 0, 0, time.UTC),
+		limitWindowWeekly:  time.Date(2026, 10, 7, 15, 45, 0, 0, time.UTC),
+		limitWindowMonthly: time.Date(2026, 9, 14, 15, 45, 0, 0, time.UTC),
+	}
+	for window, want := range cases {
+		start, end := (&CardLimit{Window: window, Mode: limitModeRolling}).period(now, nil)
+		if !start.Equal(want) || !end.IsZero() {
+			t.Errorf("rolling %s: period %v to %v, want %v with no reset", window, start, end, want)
+		}
+	}
+}
+
+func TestUnknownTimezoneFallsBackToUTC(t *testing.T) {
+	if loc := (&CardLimit{Timezone: "Mars/Olympus"}).location(); loc != time.UTC {
+		t.Errorf("location = %v, want UTC", loc)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const panGenerationAttempts = 10
+
+var errPANSpaceExhausted = errors.New("could not generate a unique PAN")
+
+// CardProgram is a BIN/IIN range cards are issued from. PANs are the IIN,
+// a cryptographically random account range and a Luhn check digit.
+type CardProgram struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Name      string    `json:"name"`
+	IIN       string    `json:"iin" gorm:"uniqueIndex"`
+	PANLength int       `json:"pan_length"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func createCardProgram(c *gin.Context) {
+	var req struct {
+		Name      string `json:"name" binding:"required"`
+		IIN       string `json:"iin" binding:"required,numeric,min=6,max=8"`
+		PANLength int    `json:"pan_length" binding:"required,min=13,max=19"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// At least six digits must remain for the account range.
+	if req.PANLength-len(req.IIN)-1 < 6 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "PAN length too short for this IIN"})
+		return
+	}
+
+	program := CardProgram{
+		ID:        uuid.New(),
+		Name:      req.Name,
+		IIN:       req.IIN,
+		PANLength: req.PANLength,
+		Status:    "active",
+		CreatedAt: time.Now(),
+	}
+
+	if err := db.Create(&program).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "IIN already in use"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, program)
+}
+
+func getCardPrograms(c *gin.Context) {
+	var programs []CardProgram
+	db.Order("name").Find(&programs)
+
+	c.JSON(http.StatusOK, programs)
+}
+
+// defaultCardProgram returns the program used when a card request does not
+// name one, creating it from DEFAULT_CARD_IIN on first use.
+func defaultCardProgram() (*CardProgram, error) {
+	iin := getEnv("DEFAULT_CARD_IIN", "519900")
+
+	var program CardProgram
+	err := db.Where("iin = ?", iin).First(&program).Error
+	if err == nil {
+		return &program, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	program = CardProgram{
+		ID:        uuid.New(),
+		Name:      "Default",
+		IIN:       iin,
+		PANLength: 16,
+		Status:    "active",
+		CreatedAt: time.Now(),
+	}
+	if err := db.Create(&program).Error; err != nil {
+		return nil, err
+	}
+	return &program, nil
+}
+
+// issuePAN generates PANs for the program until one is not yet in use.
+func issuePAN(program *CardProgram) (string, error) {
+	for i := 0; i < panGenerationAttempts; i++ {
+		pan, err := generatePAN(program.IIN, program.PANLength)
+		if err != nil {
+			return "", err
+		}
+
+		var count int64
+		db.Model(&Card{}).Where("pan_hash = ?", hashPAN(pan)).Count(&count)
+		if count == 0 {
+			return pan, nil
+		}
+	}
+	return "", errPANSpaceExhausted
+}
+
+// retryPANCollision runs issue, which draws a PAN and inserts the card
+// with it, again when the insert loses the PAN to a card issued meanwhile.
+func retryPANCollision(issue func() error) error {
+	for i := 1; ; i++ {
+		err := issue()
+		if !errors.Is(err, gorm.ErrDuplicatedKey) || i == panGenerationAttempts {
+			return err
+		}
+	}
+}
+
+func generatePAN(iin string, length int) (string, error) {
+	digits, err := randomDigits(length - len(iin) - 1)
+	if err != nil {
+		return "", err
+	}
+	body := iin + digits
+	return body + string(luhnCheckDigit(body)), nil
+}
+
+func randomDigits(n int) (string, error) {
+	var b strings.Builder
+	ten := big.NewInt(10)
+	for i := 0; i < n; i++ {
+		d, err := rand.Int(rand.Reader, ten)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(byte('0' + d.Int64()))
+	}
+	return b.String(), nil
+}
+
+// luhnCheckDigit computes the digit that makes body+digit pass the Luhn
+// (mod 10) check.
+func luhnCheckDigit(body string) byte {
+	sum := 0
+	double := true
+	for i := len(body) - 1; i >= 0; i-- {
+		d := int(body[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// maskPAN keeps the first six and last four digits, the most PCI DSS allows
+// to be displayed.
+func maskPAN(pan string) string {
+	if len(pan) < 10 {
+		return strings.Repeat("*", len(pan))
+	}
+	return pan[:6] + strings.Repeat("*", len(pan)-10) + pan[len(pan)-4:]
+}
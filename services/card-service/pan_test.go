@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func luhnValid(pan string) bool {
+	return luhnCheckDigit(pan[:len(pan)-1]) == pan[len(pan)-1]
+}
+
+func TestLuhnCheckDigit(t *testing.T) {
+	cases := map[string]byte{
+		"7992739871":      '3',
+		"411111111111111": '1',
+		"555555555555444": '4',
+		"37828224631000":  '5',
+		"0":               '0',
+	}
+	for body, want := range cases {
+		if got := luhnCheckDigit(body); got != want {
+			t.Errorf("luhnCheckDigit(%s) = %c, want %c", body, got, want)
+		}
+	}
+}
+
+func TestGeneratePAN(t *testing.T) {
+	for _, length := range []int{16, 19} {
+		for i := 0; i < 50; i++ {
+			pan, err := generatePAN("515590", length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pan) != length || !strings.HasPrefix(pan, "515590") {
+				t.Fatalf("generated %s, want %d digits starting 515590", pan, length)
+			}
+			if strings.Trim(pan, "0123456789") != "" {
+				t.Fatalf("generated %s, not all digits", pan)
+			}
+			if !luhnValid(pan) {
+				t.Fatalf("generated %s fails the Luhn check", pan)
+			}
+		}
+	}
+}
+
+func TestMaskPAN(t *testing.T) {
+	cases := map[string]string{
+		"4111111111111111":    "411111******1111",
+		"5155901234567890123": "515590*********0123",
+		"123456789":           "*********",
+	}
+	for pan, want := range cases {
+		if got := maskPAN(pan); got != want {
+			t.Errorf("maskPAN(%s) = %s, want %s", pan, got, want)
+		}
+	}
+}
+
+func TestRetryPANCollision(t *testing.T) {
+	calls := 0
+	err := retryPANCollision(func() error {
+		calls++
+		if calls < 3 {
+			return gorm.ErrDuplicatedKey
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("retry after collisions: %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	err = retryPANCollision(func() error {
+		calls++
+		return gorm.ErrDuplicatedKey
+	})
+	if !errors.Is(err, gorm.ErrDuplicatedKey) || calls != panGenerationAttempts {
+		t.Errorf("endless collisions: %v after %d calls, want to give up after %d", err, calls, panGenerationAttempts)
+	}
+
+	calls = 0
+	failure := errors.New("connection reset")
+	if err := retryPANCollision(func() error { calls++; return failure }); err != failure || calls != 1 {
+		t.Errorf("other failure: %v after %d calls, want it returned at once", err, calls)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"card-service/pinblock"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	pinFormat0 = pinblock.Format0
+	pinFormat4 = pinblock.Format4
+
+	pinStatusSet     = "set"
+	pinStatusBlocked = "blocked"
+)
+
+const (
+	declinePINRequired = "pin_required"
+	declinePINInvalid  = "pin_invalid"
+	declinePINBlocked  = "pin_blocked"
+	declinePINNotSet   = "pin_not_set"
+)
+
+var (
+	errInvalidPINBlock = errors.New("invalid PIN block")
+	errWeakPIN         = errors.New("PIN is too easy to guess")
+	errPINNotSet       = errors.New("PIN not set")
+	errPINAlreadySet   = errors.New("PIN already set")
+	errPINBlocked      = errors.New("PIN blocked")
+	errWrongPIN        = errors.New("wrong PIN")
+)
+
+// Zone PIN keys PIN blocks arrive encrypted under: double or triple length
+// TDES for format 0 and AES for format 4. pinVerificationKey turns PINs
+// into the verification values stored in their place.
+var (
+	zpkTDES            []byte
+	zpkAES             []byte
+	pinVerificationKey []byte
+)
+
+// CardPIN holds a card's PIN verification value, an HMAC of the PIN that
+// cannot be reversed, and the count of consecutive wrong tries.
+type CardPIN struct {
+	CardID            uuid.UUID `json:"card_id" gorm:"type:uuid;primary_key"`
+	VerificationValue string    `json:"-"`
+	Status            string    `json:"status"`
+	FailedAttempts    int       `json:"failed_attempts"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+func loadPINKeys() {
+	zpkTDES = loadSizedKey("CARD_ZPK_TDES", "zpk-tdes", 16, 24)
+	zpkAES = loadSizedKey("CARD_ZPK_AES", "zpk-aes", 16, 32)
+	pinVerificationKey = loadKey("CARD_PVK", "pvk")
+}
+
+// loadSizedKey reads a base64 encoded key of one of the given sizes,
+// falling back like loadKey to a development key of the largest size.
+func loadSizedKey(env, label string, sizes ...int) []byte {
+	if v := getEnv(env, ""); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err == nil {
+			for _, size := range sizes {
+				if len(key) == size {
+					return key
+				}
+			}
+		}
+		panic(fmt.Sprintf("%s must be a base64 encoded key of %v bytes", env, sizes))
+	}
+	log.Printf("WARNING: %s not set, using insecure development key", env)
+	sum := sha256.Sum256([]byte("card-service-dev-" + label))
+	return sum[:sizes[len(sizes)-1]]
+}
+
+func maxPINTries() int {
+	tries, err := strconv.Atoi(getEnv("PIN_MAX_TRIES", "3"))
+	if err != nil || tries <= 0 {
+		return 3
+	}
+	return tries
+}
+
+// decodePINBlock decrypts a hex PIN block under the zone key for its
+// format.
+func decodePINBlock(blockHex string, format int, pan string) (string, error) {
+	key := zpkTDES
+	if format == pinFormat4 {
+		key = zpkAES
+	}
+	pin, err := pinblock.Decode(blockHex, format, pan, key)
+	if err != nil {
+		return "", errInvalidPINBlock
+	}
+	return pin, nil
+}
+
+// weakPIN rejects PINs of one repeated digit and straight ascending or
+// descending runs.
+func weakPIN(pin string) bool {
+	same, up, down := true, true, true
+	for i := 1; i < len(pin); i++ {
+		d := int(pin[i]) - int(pin[i-1])
+		same = same && d == 0
+		up = up && (d == 1 || d == -9)
+		down = down && (d == -1 || d == 9)
+	}
+	return same || up || down
+}
+
+func pinVerificationValue(cardID uuid.UUID, pin string) string {
+	mac := hmac.New(sha256.New, pinVerificationKey)
+	mac.Write([]byte(cardID.String() + "|" + pin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPIN checks a PIN against the card's verification value, counting
+// wrong tries and blocking the PIN when they run out. It commits on its
+// own so a failed try is recorded even when the caller rolls back.
+func verifyPIN(cardID uuid.UUID, pin string) error {
+	var outcome error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		record, err := lockPIN(tx, cardID)
+		if err != nil {
+			return err
+		}
+		outcome = tryPIN(tx, &record, pin)
+		return uncounted(outcome)
+	})
+	if err != nil {
+		return err
+	}
+	return outcome
+}
+
+// lockPIN loads the card's PIN record for update. A card without a PIN
+// gives an empty record.
+func lockPIN(tx *gorm.DB, cardID uuid.UUID) (CardPIN, error) {
+	var record CardPIN
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("card_id = ?", cardID).
+		Limit(1).Find(&record).Error
+	return record, err
+}
+
+// tryPIN compares pin with the locked record, saving a wrong PIN as a
+// failed try. The caller must commit errWrongPIN and errPINBlocked for the
+// try to count; see uncounted.
+func tryPIN(tx *gorm.DB, record *CardPIN, pin string) error {
+	if record.CardID == uuid.Nil {
+		return errPINNotSet
+	}
+	if record.Status == pinStatusBlocked {
+		return errPINBlocked
+	}
+
+	record.UpdatedAt = time.Now()
+	if subtle.ConstantTimeCompare([]byte(pinVerificationValue(record.CardID, pin)), []byte(record.VerificationValue)) != 1 {
+		record.FailedAttempts++
+		if record.FailedAttempts >= maxPINTries() {
+			record.Status = pinStatusBlocked
+		}
+		if err := tx.Save(record).Error; err != nil {
+			return err
+		}
+		if record.Status == pinStatusBlocked {
+			return errPINBlocked
+		}
+		return errWrongPIN
+	}
+
+	if record.FailedAttempts == 0 {
+		return nil
+	}
+	record.FailedAttempts = 0
+	return tx.Save(record).Error
+}
+
+// uncounted is err unless it refuses a PIN try, which is returned as nil
+// so the transaction commits the try.
+func uncounted(err error) error {
+	if err == errWrongPIN || err == errPINBlocked {
+		return nil
+	}
+	return err
+}
+
+// checkPIN verifies the PIN of an authorization. ATM withdrawals and chip
+// purchases need one; other channels are checked when a PIN block is
+// present.
+func checkPIN(card *Card, req authorizationRequest) error {
+	if req.PINBlock == "" {
+		if req.Channel == "atm" || req.Channel == "chip" {
+			return decline(declinePINRequired, "PIN required")
+		}
+		return nil
+	}
+
+	pan, err := decryptPAN(card.PANEncrypted)
+	if err != nil {
+		return err
+	}
+	pin, err := decodePINBlock(req.PINBlock, req.PINFormat, pan)
+	if err != nil {
+		return decline(declinePINInvalid, "Incorrect PIN")
+	}
+
+	switch err := verifyPIN(card.ID, pin); err {
+	case nil:
+		return nil
+	case errWrongPIN:
+		return decline(declinePINInvalid, "Incorrect PIN")
+	case errPINBlocked:
+		return decline(declinePINBlocked, "PIN tries exceeded")
+	case errPINNotSet:
+		return decline(declinePINNotSet, "PIN not set")
+	default:
+		return err
+	}
+}
+
+type pinBlockRequest struct {
+	PINBlock string `json:"pin_block" binding:"required,hexadecimal"`
+	Format   int    `json:"format" binding:"oneof=0 4"`
+}
+
+func getPINStatus(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var record CardPIN
+	db.Where("card_id = ?", cardID).Limit(1).Find(&record)
+	if record.CardID == uuid.Nil {
+		c.JSON(http.StatusOK, gin.H{"card_id": cardID, "status": "not_set"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"card_id":         cardID,
+		"status":          record.Status,
+		"tries_remaining": maxPINTries() - record.FailedAttempts,
+		"updated_at":      record.UpdatedAt,
+	})
+}
+
+// setPIN sets the first PIN of a card.
+func setPIN(c *gin.Context) {
+	var req pinBlockRequest
+	handlePINChange(c, &req, func(tx *gorm.DB, card *Card, pan string, record *CardPIN) error {
+		if record.CardID != uuid.Nil {
+			return errPINAlreadySet
+		}
+		return storePIN(tx, card, pan, record, req)
+	})
+}
+
+// changePIN replaces the PIN after verifying the current one, which counts
+// as a try.
+func changePIN(c *gin.Context) {
+	var req struct {
+		pinBlockRequest
+		CurrentPINBlock string `json:"current_pin_block" binding:"required,hexadecimal"`
+	}
+	handlePINChange(c, &req, func(tx *gorm.DB, card *Card, pan string, record *CardPIN) error {
+		current, err := decodePINBlock(req.CurrentPINBlock, req.Format, pan)
+		if err != nil {
+			return err
+		}
+		if err := tryPIN(tx, record, current); err != nil {
+			return err
+		}
+		return storePIN(tx, card, pan, record, req.pinBlockRequest)
+	})
+}
+
+// resetPIN sets a new PIN without the current one and unblocks it. The app
+// backend calls it once the cardholder has passed step-up authentication.
+func resetPIN(c *gin.Context) {
+	var req pinBlockRequest
+	handlePINChange(c, &req, func(tx *gorm.DB, card *Card, pan string, record *CardPIN) error {
+		return storePIN(tx, card, pan, record, req)
+	})
+}
+
+// storePIN replaces the locked record with the new PIN. A first PIN is
+// inserted, so of two requests setting it at once only one succeeds.
+func storePIN(tx *gorm.DB, card *Card, pan string, record *CardPIN, req pinBlockRequest) error {
+	pin, err := decodePINBlock(req.PINBlock, req.Format, pan)
+	if err != nil {
+		return err
+	}
+	if weakPIN(pin) {
+		return errWeakPIN
+	}
+
+	first := record.CardID == uuid.Nil
+	record.CardID = card.ID
+	record.VerificationValue = pinVerificationValue(card.ID, pin)
+	record.Status = pinStatusSet
+	record.FailedAttempts = 0
+	record.UpdatedAt = time.Now()
+	if !first {
+		return tx.Save(record).Error
+	}
+	err = tx.Create(record).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return errPINAlreadySet
+	}
+	return err
+}
+
+// handlePINChange authenticates the caller with the app backend key,
+// runs fn on the card and its locked PIN record in one transaction and
+// maps the errors of fn. A wrong current PIN is committed, so it counts.
+func handlePINChange(c *gin.Context, req interface{}, fn func(tx *gorm.DB, card *Card, pan string, record *CardPIN) error) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actor := c.GetHeader("X-Cardholder-ID")
+	if !revealAuthorized(c) {
+		logCardAccess(c, cardID, "pin", actor, "unauthorized")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authorized to manage the PIN"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+	pan, err := decryptPAN(card.PANEncrypted)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read card details"})
+		return
+	}
+
+	var record CardPIN
+	var outcome error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if record, err = lockPIN(tx, card.ID); err != nil {
+			return err
+		}
+		outcome = fn(tx, &card, pan, &record)
+		return uncounted(outcome)
+	})
+	if err == nil {
+		err = outcome
+	}
+	switch err {
+	case nil:
+	case errInvalidPINBlock, errWeakPIN:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errWrongPIN:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Incorrect PIN"})
+		return
+	case errPINBlocked:
+		c.JSON(http.StatusForbidden, gin.H{"error": "PIN blocked"})
+		return
+	case errPINNotSet, errPINAlreadySet:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update PIN"})
+		return
+	}
+
+	logCardAccess(c, card.ID, "pin", actor, "updated")
+	c.JSON(http.StatusOK, gin.H{
+		"card_id": card.ID,
+		"status":  record.Status,
+		"message": "PIN updated",
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestCheckPINRequired(t *testing.T) {
+	cases := map[string]bool{
+		"atm":         true,
+		"chip":        true,
+		"contactless": false,
+		"ecommerce":   false,
+		"":            false,
+	}
+	for channel, required := range cases {
+		err := checkPIN(&Card{}, authorizationRequest{Channel: channel})
+		d, declined := err.(*declineError)
+		if declined != required || (declined && d.Code != declinePINRequired) {
+			t.Errorf("channel %q without a PIN: %v, want required %v", channel, err, required)
+		}
+	}
+}
+
+func TestWeakPIN(t *testing.T) {
+	for _, pin := range []string{"0000", "1234", "4321", "7890", "2109", "999999"} {
+		if !weakPIN(pin) {
+			t.Errorf("%s is not weak", pin)
+		}
+	}
+	for _, pin := range []string{"1357", "2468", "1243", "905172"} {
+		if weakPIN(pin) {
+			t.Errorf("%s is weak", pin)
+		}
+	}
+}
+
+func TestISOPINFormat(t *testing.T) {
+	cases := []struct {
+		control string
+		format  int
+		ok      bool
+	}{
+		{"", pinFormat0, true},
+		{"2001000000000000", pinFormat0, true},
+		{"2001040000000000", 0, false},
+		{"2001010000000000", 0, false},
+		{"20", 0, false},
+	}
+	for _, tc := range cases {
+		format, ok := isoPINFormat(tc.control)
+		if format != tc.format || ok != tc.ok {
+			t.Errorf("isoPINFormat(%q) = %d, %v, want %d, %v", tc.control, format, ok, tc.format, tc.ok)
+		}
+	}
+}
+
+func TestUncountedCommitsPINTries(t *testing.T) {
+	for _, err := range []error{errWrongPIN, errPINBlocked} {
+		if uncounted(err) != nil {
+			t.Errorf("%v rolls the try back", err)
+		}
+	}
+	for _, err := range []error{errPINNotSet, errWeakPIN, errPINAlreadySet} {
+		if uncounted(err) != err {
+			t.Errorf("%v is committed", err)
+		}
+	}
+}
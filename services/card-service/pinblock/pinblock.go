@@ -0,0 +1,186 @@
+// Package pinblock builds and reads ISO 9564-1 PIN blocks. Format 0 blocks
+// are enciphered with TDES under a double or triple length key, format 4
+// blocks with AES. Blocks are exchanged as hex strings.
+package pinblock
+
+import (
+	"crypto/aes"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	Format0 = 0
+	Format4 = 4
+)
+
+var ErrInvalid = errors.New("invalid PIN block")
+
+// Encode builds the enciphered PIN block of pin for pan.
+func Encode(pin string, format int, pan string, key []byte) (string, error) {
+	if len(pin) < 4 || len(pin) > 12 || !digits(pin) {
+		return "", errors.New("PIN must be 4 to 12 digits")
+	}
+
+	switch format {
+	case Format0:
+		if len(pan) < 13 {
+			return "", ErrInvalid
+		}
+		field, _ := hex.DecodeString(fmt.Sprintf("0%X%s", len(pin), pin) + strings.Repeat("F", 14-len(pin)))
+		xor(field, format0PANField(pan))
+		c, err := des.NewTripleDESCipher(tdesKey(key))
+		if err != nil {
+			return "", err
+		}
+		out := make([]byte, 8)
+		c.Encrypt(out, field)
+		return strings.ToUpper(hex.EncodeToString(out)), nil
+
+	case Format4:
+		if len(pan) < 12 || len(pan) > 19 {
+			return "", ErrInvalid
+		}
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		field, _ := hex.DecodeString(fmt.Sprintf("4%X%s", len(pin), pin) + strings.Repeat("A", 14-len(pin)))
+		field = append(field, random...)
+		c, err := aes.NewCipher(key)
+		if err != nil {
+			return "", err
+		}
+		out := make([]byte, 16)
+		c.Encrypt(out, field)
+		xor(out, format4PANField(pan))
+		c.Encrypt(out, out)
+		return strings.ToUpper(hex.EncodeToString(out)), nil
+	}
+	return "", ErrInvalid
+}
+
+// Decode deciphers a PIN block and extracts the PIN, checking the block
+// is well formed for the PAN it was built with.
+func Decode(blockHex string, format int, pan string, key []byte) (string, error) {
+	block, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return "", ErrInvalid
+	}
+
+	switch format {
+	case Format0:
+		return decodeFormat0(block, pan, key)
+	case Format4:
+		return decodeFormat4(block, pan, key)
+	}
+	return "", ErrInvalid
+}
+
+// decodeFormat0 reverses a format 0 block: the PIN field (0, length, PIN,
+// F fill) XORed with 0000 and the 12 rightmost PAN digits excluding the
+// check digit, enciphered with TDES.
+func decodeFormat0(block []byte, pan string, key []byte) (string, error) {
+	if len(block) != 8 || len(pan) < 13 {
+		return "", ErrInvalid
+	}
+
+	c, err := des.NewTripleDESCipher(tdesKey(key))
+	if err != nil {
+		return "", err
+	}
+	clear := make([]byte, 8)
+	c.Decrypt(clear, block)
+	xor(clear, format0PANField(pan))
+
+	field := strings.ToUpper(hex.EncodeToString(clear))
+	n := pinLength(field[1])
+	if field[0] != '0' || n < 4 || n > 12 || strings.Trim(field[2+n:], "F") != "" {
+		return "", ErrInvalid
+	}
+	return checkDigits(field[2 : 2+n])
+}
+
+// decodeFormat4 reverses a format 4 block, enciphered as AES(AES(PIN
+// field) XOR PAN field). The PIN field is 4, length, PIN, A fill to 16
+// nibbles and 16 random nibbles; the PAN field is the PAN length minus 12,
+// the PAN and zero fill.
+func decodeFormat4(block []byte, pan string, key []byte) (string, error) {
+	if len(block) != 16 || len(pan) < 12 || len(pan) > 19 {
+		return "", ErrInvalid
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	clear := make([]byte, 16)
+	c.Decrypt(clear, block)
+	xor(clear, format4PANField(pan))
+	c.Decrypt(clear, clear)
+
+	field := strings.ToUpper(hex.EncodeToString(clear))
+	n := pinLength(field[1])
+	if field[0] != '4' || n < 4 || n > 12 || strings.Trim(field[2+n:16], "A") != "" {
+		return "", ErrInvalid
+	}
+	return checkDigits(field[2 : 2+n])
+}
+
+func format0PANField(pan string) []byte {
+	field, _ := hex.DecodeString("0000" + pan[len(pan)-13:len(pan)-1])
+	return field
+}
+
+func format4PANField(pan string) []byte {
+	m := 0
+	if len(pan) > 12 {
+		m = len(pan) - 12
+	}
+	s := strconv.Itoa(m) + pan
+	field, _ := hex.DecodeString(s + strings.Repeat("0", 32-len(s)))
+	return field
+}
+
+// tdesKey expands a double length key to the K1 K2 K1 triple length form.
+func tdesKey(key []byte) []byte {
+	if len(key) == 16 {
+		return append(append([]byte{}, key...), key[:8]...)
+	}
+	return key
+}
+
+func pinLength(nibble byte) int {
+	n, err := strconv.ParseUint(string(nibble), 16, 8)
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func checkDigits(pin string) (string, error) {
+	if !digits(pin) {
+		return "", ErrInvalid
+	}
+	return pin, nil
+}
+
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
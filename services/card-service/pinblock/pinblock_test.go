@@ -0,0 +1,93 @@
+package pinblock
+
+import (
+	"bytes"
+	"testing"
+)
+
+const pan = "4111111111111111"
+
+var (
+	tdesKey16 = bytes.Repeat([]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}, 2)
+	aesKey    = bytes.Repeat([]byte{0x2b, 0x7e, 0x15, 0x16}, 4)
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		format int
+		key    []byte
+		size   int
+	}{
+		{Format0, tdesKey16, 16},
+		{Format4, aesKey, 32},
+	}
+	for _, tc := range cases {
+		for _, pin := range []string{"1234", "987654", "123456789012"} {
+			block, err := Encode(pin, tc.format, pan, tc.key)
+			if err != nil {
+				t.Fatalf("format %d: encoding %s: %v", tc.format, pin, err)
+			}
+			if len(block) != tc.size {
+				t.Errorf("format %d: block %s is %d hex digits, want %d", tc.format, block, len(block), tc.size)
+			}
+			got, err := Decode(block, tc.format, pan, tc.key)
+			if err != nil || got != pin {
+				t.Errorf("format %d: decoded %q, %v, want %q", tc.format, got, err, pin)
+			}
+		}
+	}
+}
+
+func TestFormat0PANField(t *testing.T) {
+	field := format0PANField("4000001234562")
+	if want := []byte{0x00, 0x00, 0x40, 0x00, 0x00, 0x12, 0x34, 0x56}; !bytes.Equal(field, want) {
+		t.Errorf("PAN field = %X, want %X", field, want)
+	}
+}
+
+func TestFormat4PANField(t *testing.T) {
+	field := format4PANField("1234567890123456789")
+	want := []byte{0x71, 0x23, 0x45, 0x67, 0x89, 0x01, 0x23, 0x45, 0x67, 0x89, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(field, want) {
+		t.Errorf("PAN field = %X, want %X", field, want)
+	}
+}
+
+func TestFormat4IsRandomized(t *testing.T) {
+	a, _ := Encode("1234", Format4, pan, aesKey)
+	b, _ := Encode("1234", Format4, pan, aesKey)
+	if a == b {
+		t.Error("two format 4 blocks of the same PIN are equal")
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	block, err := Encode("1234", Format0, pan, tdesKey16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decode(block, Format0, "4111111111111129", tdesKey16); err != ErrInvalid {
+		t.Errorf("block decoded with another PAN: %v", err)
+	}
+	if _, err := Decode(block, Format4, pan, aesKey); err != ErrInvalid {
+		t.Errorf("format 0 block decoded as format 4: %v", err)
+	}
+	if _, err := Decode("not hex", Format0, pan, tdesKey16); err != ErrInvalid {
+		t.Errorf("malformed block: %v", err)
+	}
+	if _, err := Decode(block, 1, pan, tdesKey16); err != ErrInvalid {
+		t.Errorf("unsupported format: %v", err)
+	}
+}
+
+func TestEncodeRejects(t *testing.T) {
+	for _, pin := range []string{"123", "1234567890123", "12a4"} {
+		if _, err := Encode(pin, Format0, pan, tdesKey16); err == nil {
+			t.Errorf("PIN %q was encoded", pin)
+		}
+	}
+	if _, err := Encode("1234", Format0, "411111111111", tdesKey16); err != ErrInvalid {
+		t.Errorf("short PAN: %v", err)
+	}
+}
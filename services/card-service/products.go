@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	cardTypeVirtual  = "virtual"
+	cardTypePhysical = "physical"
+
+	defaultValidityMonths = 60
+)
+
+// CardProduct is what a card is issued as: the program (BIN) it draws
+// PANs from, its network and funding, the limits it may carry, how long
+// it is valid, which features cardholders may use and what it costs.
+// Cards issued from a product are checked against it.
+type CardProduct struct {
+	ID                  uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Code                string    `json:"code" gorm:"uniqueIndex"`
+	Name                string    `json:"name"`
+	ProgramID           uuid.UUID `json:"program_id" gorm:"type:uuid;index"`
+	Network             string    `json:"network"`
+	Funding             string    `json:"funding"`
+	CardTypes           []string  `json:"card_types" gorm:"serializer:json"`
+	DefaultLimit        int64     `json:"default_limit"`
+	MaxLimit            int64     `json:"max_limit"`
+	ValidityMonths      int       `json:"validity_months"`
+	AllowedUsages       []string  `json:"allowed_usages" gorm:"serializer:json"`
+	AllowedChannels     []string  `json:"allowed_channels" gorm:"serializer:json"`
+	DynamicCVV          bool      `json:"dynamic_cvv"`
+	MaxInstallments     int       `json:"max_installments"`
+	IssuanceFee         int64     `json:"issuance_fee"`
+	AnnualFee           int64     `json:"annual_fee"`
+	ReplacementFee      int64     `json:"replacement_fee"`
+	InternationalFeeBPS int64     `json:"international_fee_bps"`
+	Status              string    `json:"status"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+type cardProductRequest struct {
+	Code                string   `json:"code" binding:"required,alphanum,max=32"`
+	Name                string   `json:"name" binding:"required"`
+	ProgramID           string   `json:"program_id" binding:"required"`
+	Network             string   `json:"network" binding:"required,oneof=visa mastercard elo amex"`
+	Funding             string   `json:"funding" binding:"required,oneof=prepaid debit credit"`
+	CardTypes           []string `json:"card_types" binding:"required,min=1,dive,oneof=virtual physical"`
+	DefaultLimit        int64    `json:"default_limit" binding:"required,gt=0"`
+	MaxLimit            int64    `json:"max_limit" binding:"required,gtefield=DefaultLimit"`
+	ValidityMonths      int      `json:"validity_months" binding:"required,min=1,max=120"`
+	AllowedUsages       []string `json:"allowed_usages" binding:"dive,oneof=multi single_use merchant_locked"`
+	AllowedChannels     []string `json:"allowed_channels" binding:"dive,oneof=ecommerce contactless chip atm magstripe"`
+	DynamicCVV          bool     `json:"dynamic_cvv"`
+	MaxInstallments     int      `json:"max_installments" binding:"gte=0,lte=24"`
+	IssuanceFee         int64    `json:"issuance_fee" binding:"gte=0"`
+	AnnualFee           int64    `json:"annual_fee" binding:"gte=0"`
+	ReplacementFee      int64    `json:"replacement_fee" binding:"gte=0"`
+	InternationalFeeBPS int64    `json:"international_fee_bps" binding:"gte=0"`
+	Status              string   `json:"status" binding:"omitempty,oneof=active inactive"`
+}
+
+func (p *CardProduct) allowsType(cardType string) bool {
+	return containsString(p.CardTypes, cardType)
+}
+
+// allowsUsage and allowsChannel treat an empty list as no restriction.
+func (p *CardProduct) allowsUsage(usage string) bool {
+	return len(p.AllowedUsages) == 0 || containsString(p.AllowedUsages, usage)
+}
+
+func (p *CardProduct) allowsChannel(channel string) bool {
+	return channel == "" || len(p.AllowedChannels) == 0 || containsString(p.AllowedChannels, channel)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// cardProduct loads the card's product; cards issued before products
+// existed have none.
+func cardProduct(tx *gorm.DB, card *Card) (*CardProduct, error) {
+	if card.ProductID == nil {
+		return nil, nil
+	}
+	var product CardProduct
+	if err := tx.First(&product, *card.ProductID).Error; err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// checkProduct declines what the card's product does not allow.
+func checkProduct(tx *gorm.DB, card *Card, req authorizationRequest) error {
+	product, err := cardProduct(tx, card)
+	if err != nil || product == nil {
+		return err
+	}
+	if !product.allowsChannel(req.Channel) {
+		return decline(declineChannelDisabled, "Channel not available for this card")
+	}
+	if req.Installments > 1 && req.Installments > product.MaxInstallments {
+		return decline(declineInstallmentsNotAllowed, "Installments not available for this card")
+	}
+	return nil
+}
+
+// expiryFor is the expiry of a card issued now that stays valid for
+// months, as the MM/YY printed on it. Cards are valid through the last
+// day of that month.
+func expiryFor(months int) string {
+	return time.Now().AddDate(0, months, 0).Format("01/06")
+}
+
+func applyCardProductRequest(product *CardProduct, req cardProductRequest, programID uuid.UUID, now time.Time) {
+	product.Code = req.Code
+	product.Name = req.Name
+	product.ProgramID = programID
+	product.Network = req.Network
+	product.Funding = req.Funding
+	product.CardTypes = req.CardTypes
+	product.DefaultLimit = req.DefaultLimit
+	product.MaxLimit = req.MaxLimit
+	product.ValidityMonths = req.ValidityMonths
+	product.AllowedUsages = req.AllowedUsages
+	product.AllowedChannels = req.AllowedChannels
+	product.DynamicCVV = req.DynamicCVV
+	product.MaxInstallments = req.MaxInstallments
+	product.IssuanceFee = req.IssuanceFee
+	product.AnnualFee = req.AnnualFee
+	product.ReplacementFee = req.ReplacementFee
+	product.InternationalFeeBPS = req.InternationalFeeBPS
+	product.Status = req.Status
+	if product.Status == "" {
+		product.Status = "active"
+	}
+	product.UpdatedAt = now
+}
+
+// bindCardProduct binds and validates a product request, returning the
+// program it refers to.
+func bindCardProduct(c *gin.Context, req *cardProductRequest) (uuid.UUID, bool) {
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return uuid.Nil, false
+	}
+	programID, err := uuid.Parse(req.ProgramID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid program ID"})
+		return uuid.Nil, false
+	}
+	var program CardProgram
+	if err := db.Where("status = ?", "active").First(&program, programID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card program not found"})
+		return uuid.Nil, false
+	}
+	if req.MaxInstallments > 1 && req.Funding != fundingCredit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Installments are only available on credit products"})
+		return uuid.Nil, false
+	}
+	if req.DynamicCVV && !containsString(req.CardTypes, cardTypeVirtual) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Dynamic CVV is only available for virtual cards"})
+		return uuid.Nil, false
+	}
+	return program.ID, true
+}
+
+func createCardProduct(c *gin.Context) {
+	var req cardProductRequest
+	programID, ok := bindCardProduct(c, &req)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	product := CardProduct{ID: uuid.New(), CreatedAt: now}
+	applyCardProductRequest(&product, req, programID, now)
+
+	if err := db.Create(&product).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Product code already in use"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, product)
+}
+
+// updateCardProduct replaces the product's configuration. Cards already
+// issued keep their limit and expiry; the new terms apply to later
+// issuance and to authorizations.
+func updateCardProduct(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req cardProductRequest
+	programID, ok := bindCardProduct(c, &req)
+	if !ok {
+		return
+	}
+
+	var product CardProduct
+	if err := db.First(&product, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card product not found"})
+		return
+	}
+	if product.Funding != req.Funding {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Funding of a product cannot change"})
+		return
+	}
+	applyCardProductRequest(&product, req, programID, time.Now())
+
+	if err := db.Save(&product).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Product code already in use"})
+		return
+	}
+
+	c.JSON(http.StatusOK, product)
+}
+
+func getCardProducts(c *gin.Context) {
+	query := db.Order("name")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var products []CardProduct
+	query.Find(&products)
+
+	c.JSON(http.StatusOK, products)
+}
+
+func getCardProduct(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var product CardProduct
+	if err := db.First(&product, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card product not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, product)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	accountSyncOperationRewardsAccrual  = "rewards_accrual"
+	accountSyncOperationRewardsReversal = "rewards_reversal"
+)
+
+var accountServiceURL string
+var internalToken string
+
+var internalClient = &http.Client{Timeout: 3 * time.Second}
+
+// enqueueRewardsAccrual queues the notice to account-service of an
+// approved authorization, so active loyalty campaigns can credit points.
+// It goes through account sync with the authorization, which keeps it
+// ahead of any reversal of the same purchase; a failure never affects the
+// authorization itself.
+func enqueueRewardsAccrual(tx *gorm.DB, card *Card, auth *CardAuthorization, now time.Time) error {
+	return tx.Create(&AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationRewardsAccrual,
+		Amount:          auth.Amount,
+		Status:          "pending",
+		NextAttemptAt:   now,
+		CreatedAt:       now,
+	}).Error
+}
+
+// enqueueRewardsReversal queues taking back the points of amount of a
+// purchase that was returned to the cardholder. reference is the event
+// that returned it, so account-service reverses each event once.
+func enqueueRewardsReversal(tx *gorm.DB, card *Card, auth *CardAuthorization, reference uuid.UUID, amount int64, now time.Time) error {
+	if amount <= 0 {
+		return nil
+	}
+	return tx.Create(&AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationRewardsReversal,
+		CaptureID:       reference,
+		Amount:          amount,
+		Status:          "pending",
+		NextAttemptAt:   now,
+		CreatedAt:       now,
+	}).Error
+}
+
+func deliverRewards(op *AccountSyncOperation) error {
+	path := "/internal/rewards/reversals"
+	body := map[string]interface{}{
+		"source":    "card",
+		"source_id": op.AuthorizationID.String(),
+		"reference": op.CaptureID.String(),
+		"amount":    op.Amount,
+	}
+	if op.Kind == accountSyncOperationRewardsAccrual {
+		var auth CardAuthorization
+		if err := db.First(&auth, op.AuthorizationID).Error; err != nil {
+			return err
+		}
+		path = "/internal/rewards/accruals"
+		body = map[string]interface{}{
+			"account_id":  op.AccountID.String(),
+			"source":      "card",
+			"source_id":   op.AuthorizationID.String(),
+			"amount":      op.Amount,
+			"category":    auth.Category,
+			"merchant_id": auth.MerchantID,
+		}
+	}
+
+	status, err := callAccountService(internalClient, http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return fmt.Errorf("%s returned %d", op.Kind, status)
+	}
+	return nil
+}
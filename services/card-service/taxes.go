@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	txnIOF = "iof"
+
+	// iofOperationType is the rate table account-service applies to
+	// purchases abroad.
+	iofOperationType = "fx_card"
+)
+
+// international reports whether the purchase was made outside the
+// issuer's country, which makes it subject to IOF.
+func international(auth *CardAuthorization) bool {
+	return auth.Country != "" && auth.Country != getEnv("ISSUER_COUNTRY", "BR")
+}
+
+// enqueueIOF queues the IOF due on a capture of an international purchase.
+// The tax is computed by account-service, which holds the rate tables,
+// once the capture is committed.
+func enqueueIOF(tx *gorm.DB, card *Card, auth *CardAuthorization, capture *CardCapture) error {
+	return tx.Create(&AccountSyncOperation{
+		ID:              uuid.New(),
+		AuthorizationID: auth.ID,
+		AccountID:       card.AccountID,
+		Kind:            accountSyncOperationIOF,
+		CaptureID:       capture.ID,
+		Amount:          capture.Amount,
+		Description:     "IOF - " + auth.MerchantID,
+		Status:          "pending",
+		NextAttemptAt:   capture.CreatedAt,
+		CreatedAt:       capture.CreatedAt,
+	}).Error
+}
+
+// deliverIOF collects the IOF on a capture. Debit card accounts have it
+// withheld straight away; credit and prepaid cards are charged it as a
+// card transaction, which credit card invoices bill as taxes. The charge
+// reuses the operation's ID, so a retry does not charge twice.
+func deliverIOF(op *AccountSyncOperation) error {
+	var auth CardAuthorization
+	if err := db.First(&auth, op.AuthorizationID).Error; err != nil {
+		return err
+	}
+	var card Card
+	if err := db.First(&card, auth.CardID).Error; err != nil {
+		return err
+	}
+
+	if card.Funding == fundingDebit {
+		status, err := callAccountService(internalClient, http.MethodPost, "/internal/taxes/withholdings", map[string]interface{}{
+			"account_id":     op.AccountID.String(),
+			"operation_type": iofOperationType,
+			"amount":         op.Amount,
+			"reference":      "card capture " + op.CaptureID.String(),
+		})
+		if err != nil {
+			return err
+		}
+		if status >= 300 {
+			return fmt.Errorf("withholding IOF returned %d", status)
+		}
+		return nil
+	}
+
+	var breakdown struct {
+		Total int64 `json:"total"`
+	}
+	status, err := callAccountServiceJSON(internalClient, http.MethodPost, "/taxes/calculate", map[string]interface{}{
+		"operation_type": iofOperationType,
+		"amount":         op.Amount,
+		"date":           op.CreatedAt,
+	}, &breakdown)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return fmt.Errorf("calculating IOF returned %d", status)
+	}
+	if breakdown.Total == 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, card.ID).Error; err != nil {
+			return err
+		}
+		var existing int64
+		if err := tx.Model(&CardTransaction{}).Where("id = ?", op.ID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return nil
+		}
+
+		// IOF on a prepaid card comes out of its balance; on a credit card
+		// it is billed without using limit.
+		if card.Funding == fundingPrepaid {
+			card.SpentAmount += breakdown.Total
+			if err := tx.Save(&card).Error; err != nil {
+				return err
+			}
+		}
+		event := authorizationEvent(&auth, txnIOF, breakdown.Total, time.Now())
+		event.ID = op.ID
+		return tx.Create(&event).Error
+	})
+}
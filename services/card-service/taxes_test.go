@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestInternational(t *testing.T) {
+	cases := map[string]bool{
+		"":   false,
+		"BR": false,
+		"US": true,
+		"PT": true,
+	}
+	for country, want := range cases {
+		if got := international(&CardAuthorization{Country: country}); got != want {
+			t.Errorf("international(%q) = %v, want %v", country, got, want)
+		}
+	}
+
+	t.Setenv("ISSUER_COUNTRY", "PT")
+	if international(&CardAuthorization{Country: "PT"}) || !international(&CardAuthorization{Country: "BR"}) {
+		t.Error("ISSUER_COUNTRY is not honoured")
+	}
+}
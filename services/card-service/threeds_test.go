@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCheckOTP(t *testing.T) {
+	txn := &ThreeDSTransaction{ID: uuid.New(), TransStatus: threeDSChallenge, ChallengeStatus: challengeStatusPending}
+	txn.OTPHash = hashToken(txn.ID.String() + "123456")
+
+	checkOTP(txn, "123456")
+	if txn.TransStatus != threeDSAuthenticated || txn.ChallengeStatus != "completed" || txn.CAVVHash == "" {
+		t.Errorf("right code: status %s/%s", txn.TransStatus, txn.ChallengeStatus)
+	}
+}
+
+func TestCheckOTPFailsAfterMaxAttempts(t *testing.T) {
+	txn := &ThreeDSTransaction{ID: uuid.New(), TransStatus: threeDSChallenge, ChallengeStatus: challengeStatusPending}
+	txn.OTPHash = hashToken(txn.ID.String() + "123456")
+
+	for i := 1; i < threeDSMaxOTPAttempts; i++ {
+		checkOTP(txn, "000000")
+		if txn.TransStatus != threeDSChallenge {
+			t.Fatalf("failed after %d wrong codes", i)
+		}
+	}
+	checkOTP(txn, "000000")
+	if txn.TransStatus != threeDSNotAuthentic || txn.ChallengeStatus != "failed" {
+		t.Errorf("after %d wrong codes: status %s/%s", threeDSMaxOTPAttempts, txn.TransStatus, txn.ChallengeStatus)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	txnAuthorization = "authorization"
+	txnIncrement     = "increment"
+	txnDecline       = "decline"
+	txnCapture       = "capture"
+	txnVoid          = "void"
+	txnReversal      = "reversal"
+	txnExpiry        = "expiry"
+	txnRefund        = "refund"
+)
+
+var errAmountExceedsRefundable = errors.New("amount exceeds the captured amount not yet refunded")
+
+// CardTransaction is one event in a card's history, the basis of the card
+// statement. Declined attempts are kept along with their reason.
+type CardTransaction struct {
+	ID              uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	CardID          uuid.UUID  `json:"card_id" gorm:"type:uuid;index:idx_card_transactions_card_created"`
+	AuthorizationID *uuid.UUID `json:"authorization_id,omitempty" gorm:"type:uuid;index"`
+	Type            string     `json:"type"`
+	Amount          int64      `json:"amount"`
+	MerchantID      string     `json:"merchant_id"`
+	MCC             string     `json:"mcc,omitempty"`
+	Category        string     `json:"category,omitempty"`
+	Country         string     `json:"country,omitempty"`
+	Channel         string     `json:"channel,omitempty"`
+	Description     string     `json:"description,omitempty"`
+	ApprovalCode    string     `json:"approval_code,omitempty"`
+	DeclineCode     string     `json:"decline_code,omitempty"`
+	DeclineReason   string     `json:"decline_reason,omitempty"`
+	InvoiceID       *uuid.UUID `json:"invoice_id,omitempty" gorm:"type:uuid;index"`
+	CreatedAt       time.Time  `json:"created_at" gorm:"index:idx_card_transactions_card_created"`
+}
+
+// recordAuthorizationEvent adds an event for auth to the card's history,
+// in the transaction that changed the authorization.
+func recordAuthorizationEvent(tx *gorm.DB, auth *CardAuthorization, kind string, amount int64, now time.Time) (*CardTransaction, error) {
+	event := authorizationEvent(auth, kind, amount, now)
+	if err := tx.Create(&event).Error; err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func authorizationEvent(auth *CardAuthorization, kind string, amount int64, now time.Time) CardTransaction {
+	return CardTransaction{
+		ID:              uuid.New(),
+		CardID:          auth.CardID,
+		AuthorizationID: &auth.ID,
+		Type:            kind,
+		Amount:          amount,
+		MerchantID:      auth.MerchantID,
+		MCC:             auth.MCC,
+		Category:        auth.Category,
+		Country:         auth.Country,
+		Channel:         auth.Channel,
+		Description:     auth.Description,
+		ApprovalCode:    auth.ApprovalCode,
+		CreatedAt:       now,
+	}
+}
+
+// recordDecline keeps a refused authorization in the card's history. It
+// is written after the authorization's transaction was rolled back.
+func recordDecline(req authorizationRequest, d *declineError, now time.Time) {
+	db.Create(&CardTransaction{
+		ID:            uuid.New(),
+		CardID:        req.CardID,
+		Type:          txnDecline,
+		Amount:        req.Amount,
+		MerchantID:    req.MerchantID,
+		MCC:           req.MCC,
+		Category:      req.Category,
+		Country:       req.Country,
+		Channel:       req.Channel,
+		Description:   req.Description,
+		DeclineCode:   d.Code,
+		DeclineReason: d.Message,
+		CreatedAt:     now,
+	})
+}
+
+// refundAuthorization returns amount of what was captured to the card.
+// Unlike the other operations it applies to closed authorizations, since
+// refunds usually follow the final capture. Debit card refunds are
+// credited back to the account.
+func refundAuthorization(id uuid.UUID, amount int64) (*CardAuthorization, error) {
+	var auth CardAuthorization
+	debit := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&auth, id).Error; err != nil {
+			return errAuthorizationNotFound
+		}
+
+		var card Card
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&card, auth.CardID).Error; err != nil {
+			return errCardNotFound
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&auth, id).Error; err != nil {
+			return errAuthorizationNotFound
+		}
+		if amount > auth.CapturedAmount-auth.RefundedAmount {
+			return errAmountExceedsRefundable
+		}
+
+		now := time.Now()
+		auth.RefundedAmount += amount
+		card.SpentAmount -= amount
+		if err := tx.Save(&card).Error; err != nil {
+			return err
+		}
+		if err := tx.Save(&auth).Error; err != nil {
+			return err
+		}
+
+		event, err := recordAuthorizationEvent(tx, &auth, txnRefund, amount, now)
+		if err != nil {
+			return err
+		}
+		if err := enqueueRewardsReversal(tx, &card, &auth, event.ID, amount, now); err != nil {
+			return err
+		}
+		if card.Funding == fundingDebit {
+			debit = true
+			return enqueueCredit(tx, &card, &auth, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if debit {
+		kickAccountSync()
+	}
+	return &auth, nil
+}
+
+func refundAuthorizationHandler(c *gin.Context) {
+	var req struct {
+		Amount int64 `json:"amount" binding:"required,gt=0"`
+	}
+	handleAuthorizationUpdate(c, &req, func(id uuid.UUID) (*CardAuthorization, error) {
+		return refundAuthorization(id, req.Amount)
+	})
+}
+
+// getCardTransactions lists the card's history, newest first, optionally
+// filtered by type and date range.
+func getCardTransactions(c *gin.Context) {
+	cardID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid card ID"})
+		return
+	}
+
+	var card Card
+	if err := db.First(&card, cardID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Card not found"})
+		return
+	}
+
+	query := db.Model(&CardTransaction{}).Where("card_id = ?", card.ID)
+	if v := c.Query("type"); v != "" {
+		query = query.Where("type = ?", v)
+	}
+	if v := c.Query("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be RFC 3339"})
+			return
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be RFC 3339"})
+			return
+		}
+		query = query.Where("created_at < ?", to)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if pageSize < 1 || pageSize > 200 {
+		pageSize = 50
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var transactions []CardTransaction
+	query.Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&transactions)
+
+	c.JSON(http.StatusOK, gin.H{
+		"transactions": transactions,
+		"total":        total,
+		"page":         page,
+		"page_size":    pageSize,
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	usageMulti          = "multi"
+	usageSingleUse      = "single_use"
+	usageMerchantLocked = "merchant_locked"
+
+	maxCustomExpiry = 365 * 24 * time.Hour
+
+	singleUseClosedReason = "single-use card used"
+)
+
+// validateUsage checks the usage variant and custom expiry requested for a
+// new card, returning a message when they are not allowed.
+func validateUsage(cardType, usage string, expiresAt *time.Time) string {
+	if usage != usageMulti && cardType != "virtual" {
+		return "Single-use and merchant-locked cards must be virtual"
+	}
+	if expiresAt == nil {
+		return ""
+	}
+	if cardType != "virtual" {
+		return "Custom expiry is only available for virtual cards"
+	}
+	if !expiresAt.After(time.Now()) {
+		return "Expiry must be in the future"
+	}
+	if expiresAt.After(time.Now().Add(maxCustomExpiry)) {
+		return "Custom expiry cannot exceed one year"
+	}
+	return ""
+}
+
+// applyUsageRules updates a card after a successful authorization: a
+// single-use card closes and a merchant-locked card binds to its first
+// merchant.
+func applyUsageRules(tx *gorm.DB, card *Card, merchantID string) error {
+	switch card.Usage {
+	case usageSingleUse:
+		return changeCardStatus(tx, card, cardStatusClosed, "system", singleUseClosedReason)
+	case usageMerchantLocked:
+		if card.LockedMerchantID == "" {
+			card.LockedMerchantID = merchantID
+		}
+	}
+	return nil
+}
+
+// reopenSingleUseCard gives a single-use card back to the cardholder when
+// the authorization that closed it is voided, reversed or lapses without
+// being captured, as the card was never really used. It is the one way out
+// of closed, and only for a card that was closed by its use and has no
+// other authorization.
+func reopenSingleUseCard(tx *gorm.DB, card *Card, auth *CardAuthorization, now time.Time) error {
+	if card.Usage != usageSingleUse || card.Status != cardStatusClosed || auth.open() || auth.CapturedAmount > 0 {
+		return nil
+	}
+	if cardExpired(card, now) {
+		return nil
+	}
+
+	var others int64
+	if err := tx.Model(&CardAuthorization{}).Where("card_id = ? AND id <> ?", card.ID, auth.ID).
+		Count(&others).Error; err != nil {
+		return err
+	}
+	var last CardStatusChange
+	if err := tx.Where("card_id = ?", card.ID).Order("created_at DESC").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	if others > 0 || last.Reason != singleUseClosedReason {
+		return nil
+	}
+	return recordCardStatus(tx, card, cardStatusActive, "system", "single-use authorization released")
+}
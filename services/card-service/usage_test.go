@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateUsage(t *testing.T) {
+	soon := time.Now().Add(24 * time.Hour)
+	past := time.Now().Add(-time.Hour)
+	late := time.Now().Add(2 * maxCustomExpiry)
+
+	cases := []struct {
+		cardType, usage string
+		expiresAt       *time.Time
+		ok              bool
+	}{
+		{"virtual", usageSingleUse, &soon, true},
+		{"virtual", usageMerchantLocked, nil, true},
+		{"physical", usageMulti, nil, true},
+		{"physical", usageSingleUse, nil, false},
+		{"physical", usageMulti, &soon, false},
+		{"virtual", usageMulti, &past, false},
+		{"virtual", usageMulti, &late, false},
+	}
+	for _, tc := range cases {
+		if msg := validateUsage(tc.cardType, tc.usage, tc.expiresAt); (msg == "") != tc.ok {
+			t.Errorf("%s %s: %q", tc.cardType, tc.usage, msg)
+		}
+	}
+}
+
+func TestMerchantLockedCardBindsToFirstMerchant(t *testing.T) {
+	card := Card{Usage: usageMerchantLocked}
+	if err := applyUsageRules(nil, &card, "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyUsageRules(nil, &card, "m2"); err != nil {
+		t.Fatal(err)
+	}
+	if card.LockedMerchantID != "m1" {
+		t.Errorf("locked to %q, want m1", card.LockedMerchantID)
+	}
+}
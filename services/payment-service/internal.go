@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var accountServiceURL string
+var internalToken string
+
+var internalClient = &http.Client{Timeout: 3 * time.Second}
+
+type TaxWithholdingResult struct {
+	Breakdown struct {
+		OperationType string `json:"operation_type"`
+		Lines         []struct {
+			Tax         string  `json:"tax"`
+			Description string  `json:"description"`
+			Base        int64   `json:"base"`
+			Rate        float64 `json:"rate"`
+			Amount      int64   `json:"amount"`
+		} `json:"lines"`
+		Total int64 `json:"total"`
+	} `json:"breakdown"`
+}
+
+// withholdTaxes has account-service compute the taxes due on an operation
+// and debit them from the paying account, posting them to the tax ledger.
+// Withholding is idempotent by reference.
+func withholdTaxes(accountID, operationType string, amount int64, reference string) (*TaxWithholdingResult, error) {
+	var result TaxWithholdingResult
+	err := postInternal("/internal/taxes/withholdings", map[string]interface{}{
+		"account_id":     accountID,
+		"operation_type": operationType,
+		"amount":         amount,
+		"reference":      reference,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// reverseTaxes gives back whatever was withheld under reference, for an
+// operation that did not go through.
+func reverseTaxes(accountID, reference string) error {
+	return postInternal("/internal/taxes/withholdings/reverse", map[string]interface{}{
+		"account_id": accountID,
+		"reference":  reference,
+	}, nil)
+}
+
+func postInternal(path string, payload interface{}, result interface{}) error {
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequest(http.MethodPost, accountServiceURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Token", internalToken)
+
+	resp, err := internalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("account-service returned %d: %s", resp.StatusCode, failure.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// accrueRewards notifies account-service of a completed PIX payment so
+// active loyalty campaigns can credit points. It runs in the background and
+// a failure never affects the payment itself.
+func accrueRewards(payment Payment) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"account_id": payment.FromAccountID.String(),
+		"source":     "pix",
+		"source_id":  payment.ID.String(),
+		"amount":     payment.Amount,
+		"category":   "pix",
+	})
+
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, accountServiceURL+"/internal/rewards/accruals", bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Internal-Token", internalToken)
+
+		resp, err := internalClient.Do(req)
+		if err != nil {
+			log.Printf("rewards accrual for %s failed: %v", payment.ID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("rewards accrual for %s returned %d", payment.ID, resp.StatusCode)
+		}
+	}()
+}